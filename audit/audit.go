@@ -0,0 +1,107 @@
+package audit
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an audit event records
+type EventType string
+
+const (
+	// TokenRejectedEvent a client token was refused before authenticating, e.g. a replayed token
+	TokenRejectedEvent EventType = "token_rejected"
+	// SessionReauthenticatedEvent a tunnel refreshed its credentials in-band, Reason is set when refused
+	SessionReauthenticatedEvent EventType = "session_reauthenticated"
+	// SessionTerminatedEvent a tunnel was closed because its credentials expired or were revoked
+	SessionTerminatedEvent EventType = "session_terminated"
+	// ForwardRevokedEvent an active forward was closed because a policy reload denies it
+	ForwardRevokedEvent EventType = "forward_revoked"
+	// PolicyShadowDisagreementEvent the shadow policy decided a forward differently than the enforcing one
+	PolicyShadowDisagreementEvent EventType = "policy_shadow_disagreement"
+	// GrantCreatedEvent a just-in-time grant was created through the admin API, Reason is its justification
+	GrantCreatedEvent EventType = "grant_created"
+	// GrantExpiredEvent a just-in-time grant expired and was removed from the policy
+	GrantExpiredEvent EventType = "grant_expired"
+	// GrantRevokedEvent a just-in-time grant was revoked through the admin API before it expired
+	GrantRevokedEvent EventType = "grant_revoked"
+	// SessionAuthenticatedEvent a client opened a tunnel, Reason is set when its credentials were refused
+	SessionAuthenticatedEvent EventType = "session_authenticated"
+	// ForwardDecisionEvent a forward was allowed or denied, with the policy rules that matched
+	ForwardDecisionEvent EventType = "forward_decision"
+	// ConnectionClosedEvent a forwarded connection ended, with the bytes sent each way and why it was closed
+	ConnectionClosedEvent EventType = "connection_closed"
+)
+
+// Event is a security relevant action, recorded on the audit sink
+type Event struct {
+	Time       time.Time              `json:"time"`
+	Type       EventType              `json:"type"`
+	Subject    string                 `json:"subject,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty"`
+	Reason     string                 `json:"reason,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Sink records audit events
+type Sink interface {
+	Write(event Event)
+}
+
+var (
+	sinkLock sync.RWMutex
+	sink     Sink = logSink{}
+)
+
+// SetSink replaces where audit events are recorded, by default or with a nil sink they are logged
+func SetSink(s Sink) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	if s == nil {
+		s = logSink{}
+	}
+	sink = s
+}
+
+// Log records an audit event
+func Log(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+	sink.Write(event)
+}
+
+// multiSink records the events on every sink
+type multiSink []Sink
+
+// NewMultiSink records the events on all the sinks
+func NewMultiSink(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+func (m multiSink) Write(event Event) {
+	for _, sink := range m {
+		sink.Write(event)
+	}
+}
+
+// logSink writes audit events to the application log
+type logSink struct{}
+
+func (logSink) Write(event Event) {
+	fields := log.Fields{
+		"audit":   event.Type,
+		"subject": event.Subject,
+		"remote":  event.RemoteAddr,
+	}
+	if event.Reason != "" {
+		fields["reason"] = event.Reason
+	}
+	for name, value := range event.Fields {
+		fields[name] = value
+	}
+	log.WithFields(fields).WithTime(event.Time).Info("audit event")
+}
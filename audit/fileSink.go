@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileSink appends the events as JSON lines. Once the file reaches maxSize it's renamed to path.1,
+// older files shifted up to path.maxBackups and the oldest removed. If the new file can't be opened, it's retried
+// on the next event.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink appends the events to the configured file from a background queue, a MaxSize of zero never rotates it
+func NewFileSink(fileConfig config.AuditFileConfig) (Sink, error) {
+	s, err := newFileSink(fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedSink("file", s), nil
+}
+
+func newFileSink(fileConfig config.AuditFileConfig) (*fileSink, error) {
+	s := &fileSink{
+		path:       fileConfig.Path,
+		maxSize:    int64(fileConfig.MaxSize) * 1024 * 1024,
+		maxBackups: fileConfig.MaxBackups,
+	}
+	return s, s.open()
+}
+
+func (s *fileSink) Write(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("can not encode audit event %s: %v", event.Type, err)
+		metrics.IncrementAuditEventsDropped("file", 1)
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil && s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			log.Errorf("can not rotate audit file %s: %v", s.path, err)
+		}
+	}
+	if s.file == nil {
+		if err = s.open(); err != nil {
+			log.Errorf("can not open audit file %s, dropping audit event %s: %v", s.path, event.Type, err)
+			metrics.IncrementAuditEventsDropped("file", 1)
+			return
+		}
+	}
+	written, err := s.file.Write(line)
+	s.size += int64(written)
+	if err != nil {
+		log.Errorf("can not write audit event %s: %v", event.Type, err)
+		metrics.IncrementAuditEventsDropped("file", 1)
+	}
+}
+
+// open opens the file for appending, the caller holds the lock
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files and starts a new one, the caller holds the lock.
+// The file is left unset if the new one can't be opened.
+func (s *fileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	os.Remove(s.backup(s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var err error
+	if s.maxBackups > 0 {
+		err = os.Rename(s.path, s.backup(1))
+	} else {
+		err = os.Remove(s.path)
+	}
+	if openErr := s.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (s *fileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"edgeproxy/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// queuedSinkSize is how many events a queued sink holds before dropping them
+const queuedSinkSize = 10000
+
+// queuedSink writes the events on a sink from a background queue, so a slow file or syslog doesn't block the tunnels
+type queuedSink struct {
+	name   string
+	sink   Sink
+	events chan Event
+}
+
+// newQueuedSink starts writing the events queued for sink, name labels the dropped events
+func newQueuedSink(name string, sink Sink) Sink {
+	s := &queuedSink{name: name, sink: sink, events: make(chan Event, queuedSinkSize)}
+	go s.run()
+	return s
+}
+
+func (s *queuedSink) Write(event Event) {
+	select {
+	case s.events <- event:
+	default:
+		log.Warnf("audit %s queue full, dropping audit event %s", s.name, event.Type)
+		metrics.IncrementAuditEventsDropped(s.name, 1)
+	}
+}
+
+func (s *queuedSink) run() {
+	for event := range s.events {
+		s.sink.Write(event)
+	}
+}
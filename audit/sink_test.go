@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"bufio"
+	"edgeproxy/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newFileSink(config.AuditFileConfig{Path: path, MaxBackups: 2})
+	assert.NoError(t, err)
+	// a few events per file
+	sink.maxSize = 300
+	for i := 0; i < 20; i++ {
+		sink.Write(Event{Time: time.Now(), Type: ForwardDecisionEvent, Subject: "alice", Fields: map[string]interface{}{"forward": i}})
+	}
+
+	var forwards []float64
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		file, err := os.Open(name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		info, _ := file.Stat()
+		assert.LessOrEqual(t, info.Size(), int64(300))
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event Event
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			assert.Equal(t, ForwardDecisionEvent, event.Type)
+			forwards = append(forwards, event.Fields["forward"].(float64))
+		}
+		file.Close()
+	}
+	// the oldest events were dropped with the third backup, the rest are in order
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, float64(19), forwards[len(forwards)-1])
+	for i := 1; i < len(forwards); i++ {
+		assert.Equal(t, forwards[i-1]+1, forwards[i])
+	}
+}
+
+func TestFileSinkReopens(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	assert.NoError(t, os.Mkdir(dir, 0700))
+	path := filepath.Join(dir, "audit.log")
+	sink, err := newFileSink(config.AuditFileConfig{Path: path})
+	assert.NoError(t, err)
+	sink.maxSize = 1
+	sink.Write(Event{Time: time.Now(), Type: ForwardDecisionEvent, Subject: "alice"})
+
+	// the rotation can't open a new file, the events are dropped until it can
+	assert.NoError(t, os.RemoveAll(dir))
+	sink.Write(Event{Time: time.Now(), Type: ForwardDecisionEvent, Subject: "bob"})
+	assert.NoError(t, os.Mkdir(dir, 0700))
+	sink.Write(Event{Time: time.Now(), Type: ForwardDecisionEvent, Subject: "carol"})
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"subject":"carol"`)
+	assert.NotContains(t, string(content), `"subject":"bob"`)
+}
+
+func TestWebhookSink(t *testing.T) {
+	batches := make(chan []Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		var batch []Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		batches <- batch
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(config.AuditWebhookConfig{Url: server.URL, Headers: map[string]string{"Authorization": "Bearer token"},
+		Timeout: time.Second, BatchSize: 2, BufferSize: 10})
+	for _, subject := range []string{"alice", "bob", "carol"} {
+		sink.Write(Event{Time: time.Now(), Type: SessionAuthenticatedEvent, Subject: subject})
+	}
+	var subjects []string
+	for len(subjects) < 3 {
+		select {
+		case batch := <-batches:
+			assert.LessOrEqual(t, len(batch), 2)
+			for _, event := range batch {
+				subjects = append(subjects, event.Subject)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit events not posted")
+		}
+	}
+	assert.Equal(t, "alice,bob,carol", strings.Join(subjects, ","))
+}
+
+// blockingSink holds the events until released
+type blockingSink struct {
+	release chan struct{}
+	events  chan Event
+}
+
+func (s blockingSink) Write(event Event) {
+	<-s.release
+	s.events <- event
+}
+
+func TestQueuedSink(t *testing.T) {
+	blocking := blockingSink{release: make(chan struct{}), events: make(chan Event, 2)}
+	sink := newQueuedSink("test", blocking)
+	// a slow sink doesn't block the writers
+	sink.Write(Event{Type: SessionAuthenticatedEvent, Subject: "alice"})
+	sink.Write(Event{Type: SessionAuthenticatedEvent, Subject: "bob"})
+	close(blocking.release)
+	for _, subject := range []string{"alice", "bob"} {
+		select {
+		case event := <-blocking.events:
+			assert.Equal(t, subject, event.Subject)
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued audit events not written")
+		}
+	}
+}
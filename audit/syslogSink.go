@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"encoding/json"
+	"log/syslog"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogSink sends the events as JSON messages to syslog, with the authpriv facility
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the configured syslog, the local daemon if no address is set.
+// The events are sent from a background queue.
+func NewSyslogSink(syslogConfig config.AuditSyslogConfig) (Sink, error) {
+	writer, err := syslog.Dial(syslogConfig.Network, syslogConfig.Address, syslog.LOG_AUTHPRIV|syslog.LOG_INFO, syslogConfig.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return newQueuedSink("syslog", syslogSink{writer: writer}), nil
+}
+
+func (s syslogSink) Write(event Event) {
+	message, err := json.Marshal(event)
+	if err == nil {
+		err = s.writer.Info(string(message))
+	}
+	if err != nil {
+		log.Errorf("can not send audit event %s to syslog: %v", event.Type, err)
+		metrics.IncrementAuditEventsDropped("syslog", 1)
+	}
+}
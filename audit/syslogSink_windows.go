@@ -0,0 +1,11 @@
+package audit
+
+import (
+	"edgeproxy/config"
+	"errors"
+)
+
+// NewSyslogSink fails, syslog is not available on windows
+func NewSyslogSink(config.AuditSyslogConfig) (Sink, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
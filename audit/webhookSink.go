@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"bytes"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookSink posts the events as JSON arrays from a background queue, so a slow webhook doesn't block the tunnels.
+// Events queued while a batch is posted are sent together on the next one.
+type webhookSink struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+	batchSize  int
+	events     chan Event
+}
+
+// NewWebhookSink starts posting the events to the configured webhook
+func NewWebhookSink(webhookConfig config.AuditWebhookConfig) Sink {
+	s := &webhookSink{
+		url:        webhookConfig.Url,
+		headers:    webhookConfig.Headers,
+		httpClient: &http.Client{Timeout: webhookConfig.Timeout},
+		batchSize:  webhookConfig.BatchSize,
+		events:     make(chan Event, webhookConfig.BufferSize),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Write(event Event) {
+	select {
+	case s.events <- event:
+	default:
+		log.Warnf("audit webhook queue full, dropping audit event %s", event.Type)
+		metrics.IncrementAuditEventsDropped("webhook", 1)
+	}
+}
+
+func (s *webhookSink) run() {
+	for event := range s.events {
+		batch := []Event{event}
+	queued:
+		for len(batch) < s.batchSize {
+			select {
+			case event = <-s.events:
+				batch = append(batch, event)
+			default:
+				break queued
+			}
+		}
+		if err := s.post(batch); err != nil {
+			log.Errorf("can not post %d audit events: %v", len(batch), err)
+			metrics.IncrementAuditEventsDropped("webhook", len(batch))
+		}
+	}
+}
+
+func (s *webhookSink) post(batch []Event) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/server/auth"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+// policyDenied exit code of policy test when the forward is denied
+const policyDenied = 2
+
+var (
+	policyAcl         config.AclCollection
+	oldPolicyAcl      config.AclCollection
+	policySubject     string
+	policyAttributes  []string
+	policyDestination string
+	policyProto       string
+	policyForwards    string
+
+	policyCmd = &cobra.Command{
+		Use:   "policy",
+		Short: "Check ACL policies offline",
+		Long:  `Check ACL policies offline, the policies default to the server acl configuration`,
+	}
+	policyLintCmd = &cobra.Command{
+		Use:   "lint",
+		Short: "Load and validate the policies",
+		Run: func(cmd *cobra.Command, args []string) {
+			enforcer := loadPolicy(policyAcl)
+			problems := enforcer.Lint()
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			fmt.Printf("%s, %d problems\n", enforcer.Summary(), len(problems))
+			if len(problems) > 0 {
+				os.Exit(invalidConfig)
+			}
+		},
+	}
+	policyTestCmd = &cobra.Command{
+		Use:   "test",
+		Short: "Print if the policies allow a forward and the rules matched",
+		Run: func(cmd *cobra.Command, args []string) {
+			forwardAction := auth.ForwardAction{
+				Subject:         policySubject,
+				Attributes:      map[string][]string{},
+				DestinationAddr: policyDestination,
+				NetType:         policyProto,
+			}
+			for _, attribute := range policyAttributes {
+				split := strings.SplitN(attribute, "=", 2)
+				if len(split) != 2 {
+					fmt.Fprintf(os.Stderr, "invalid attribute %s, expected name=value\n", attribute)
+					os.Exit(invalidConfig)
+				}
+				forwardAction.Attributes[split[0]] = append(forwardAction.Attributes[split[0]], split[1])
+			}
+			decision := loadPolicy(policyAcl).Decide(forwardAction)
+			fmt.Printf("%s %s %s/%s (%s policy)\n", decisionString(decision.Allowed), forwardAction.Subject,
+				forwardAction.NetType, forwardAction.DestinationAddr, decision.Policy)
+			// rego decisions match the query result instead of casbin rules
+			matchFormat := "  %s: p, %s\n"
+			if decision.Policy == "rego" {
+				matchFormat = "  %s = %s\n"
+			}
+			for _, match := range decision.Matches {
+				fmt.Printf(matchFormat, match.Principal, strings.Join(match.Rule, ", "))
+			}
+			if !decision.Allowed {
+				os.Exit(policyDenied)
+			}
+		},
+	}
+	policyDiffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "Print the recorded forwards whose decision changes between the --old-* and the new policies",
+		Run: func(cmd *cobra.Command, args []string) {
+			oldEnforcer, newEnforcer := loadPolicy(oldPolicyAcl), loadPolicy(policyAcl)
+			if policyForwards == "" {
+				policyForwards = serverConfig.Forward.RecordPath
+			}
+			file, err := os.Open(policyForwards)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "can not read recorded forwards: %v\n", err)
+				os.Exit(invalidConfig)
+			}
+			defer file.Close()
+			forwardActions, err := auth.ReadForwardActions(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid recorded forwards %s: %v\n", policyForwards, err)
+				os.Exit(invalidConfig)
+			}
+
+			// identical forwards are reported once, with the times they were recorded, whatever client made them
+			var keys []string
+			distinct := map[string]auth.ForwardAction{}
+			recorded := map[string]int{}
+			for _, forwardAction := range forwardActions {
+				forwardAction.Client = nil
+				encoded, _ := json.Marshal(forwardAction)
+				key := string(encoded)
+				if recorded[key] == 0 {
+					keys = append(keys, key)
+					distinct[key] = forwardAction
+				}
+				recorded[key]++
+			}
+			changed := 0
+			for _, key := range keys {
+				forwardAction := distinct[key]
+				before, after := oldEnforcer.AuthorizeForward(forwardAction), newEnforcer.AuthorizeForward(forwardAction)
+				if before == after {
+					continue
+				}
+				changed += recorded[key]
+				fmt.Printf("%s -> %s  %s %s/%s (%d recorded)\n", decisionString(before), decisionString(after),
+					forwardAction.Subject, forwardAction.NetType, forwardAction.DestinationAddr, recorded[key])
+			}
+			fmt.Printf("%d of %d recorded forwards change\n", changed, len(forwardActions))
+		},
+	}
+)
+
+// loadPolicy loads the acl policies, the server acl configuration if none is set
+func loadPolicy(acl config.AclCollection) auth.PolicyChecker {
+	if !acl.Enabled() {
+		acl = serverConfig.Auth.AclPolicyPath
+	}
+	if err := acl.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(invalidConfig)
+	}
+	enforcer, err := auth.LoadPolicy(acl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(invalidConfig)
+	}
+	return enforcer
+}
+
+func decisionString(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+func addAclFlags(cmd *cobra.Command, acl *config.AclCollection, prefix string, version string) {
+	cmd.PersistentFlags().StringVar(&acl.IpPath, prefix+"ip", "", "IP policy CSV"+version)
+	cmd.PersistentFlags().StringVar(&acl.DomainPath, prefix+"domain", "", "Domain policy CSV"+version)
+	cmd.PersistentFlags().StringVar(&acl.GroupsPath, prefix+"groups", "", "Address and service groups YAML"+version)
+	cmd.PersistentFlags().StringVar(&acl.PolicyPath, prefix+"policy", "", "YAML policy"+version)
+	cmd.PersistentFlags().StringVar(&acl.RegoPath, prefix+"rego", "", "OPA Rego policy module"+version)
+	cmd.PersistentFlags().StringVar(&acl.RegoQuery, prefix+"rego-query", "", "Rego query allowing the forwards, data.edgeproxy.allow by default"+version)
+}
+
+func init() {
+	RootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(policyLintCmd, policyTestCmd, policyDiffCmd)
+	addAclFlags(policyCmd, &policyAcl, "", "")
+	addAclFlags(policyDiffCmd, &oldPolicyAcl, "old-", ", previous version")
+
+	policyTestCmd.Flags().StringVar(&policySubject, "subject", "", "Subject of the forward")
+	policyTestCmd.Flags().StringSliceVar(&policyAttributes, "attribute", nil, "Subject attribute name=value, e.g. groups=admins, can be repeated")
+	policyTestCmd.Flags().StringVar(&policyDestination, "destination", "", "Forward destination host:port")
+	policyTestCmd.Flags().StringVar(&policyProto, "proto", "tcp", "Forward protocol, tcp or udp")
+	policyTestCmd.MarkFlagRequired("subject")
+	policyTestCmd.MarkFlagRequired("destination")
+
+	policyDiffCmd.Flags().StringVar(&policyForwards, "forwards", "", "Forwards recorded by the server (server.forward.record)")
+}
@@ -13,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"time"
 )
 
 const (
@@ -33,10 +34,74 @@ var (
 			Socks5Port:                         9022,
 			TransportType:                      config.HttpMuxTransport,
 			TransportTypeMuxBackendConnections: 3,
+			Dns: config.DnsConfig{
+				ListenAddr:  "127.0.0.1:5353",
+				CacheSize:   4096,
+				MaxTTL:      time.Hour,
+				NegativeTTL: time.Minute,
+				Timeout:     5 * time.Second,
+			},
+			Reconnect: config.ReconnectConfig{
+				InitialInterval:  time.Second,
+				MaxInterval:      time.Minute,
+				Multiplier:       2,
+				Jitter:           true,
+				DialTimeout:      10 * time.Second,
+				BreakerThreshold: 3,
+			},
 		},
 		ServerConfig: &config.ServerConfig{
 			HttpPort:  9180,
 			HttpsPort: 9443,
+			Session: config.SessionConfig{
+				RevalidateInterval: 5 * time.Minute,
+			},
+			Admin: config.AdminConfig{
+				MaxGrantDuration: 24 * time.Hour,
+			},
+			Audit: config.AuditConfig{
+				File: config.AuditFileConfig{
+					MaxSize:    100,
+					MaxBackups: 10,
+				},
+				Syslog: config.AuditSyslogConfig{
+					Tag: "edgeproxy",
+				},
+				Webhook: config.AuditWebhookConfig{
+					Timeout:    5 * time.Second,
+					BatchSize:  100,
+					BufferSize: 10000,
+				},
+			},
+			Auth: config.ServerAuthConfig{
+				CaConfig: config.ServerAuthCaConfig{
+					Token: config.ClientTokenConfig{
+						NonceCacheSize: 100000,
+						MaxAge:         10 * time.Minute,
+						Leeway:         time.Minute,
+					},
+					Revocation: config.RevocationConfig{
+						Ocsp:         true,
+						OcspCacheTtl: time.Hour,
+						CrlRefresh:   5 * time.Minute,
+						Timeout:      10 * time.Second,
+					},
+				},
+				Oidc: config.ServerAuthOidcConfig{
+					JwksRefresh:     time.Hour,
+					Leeway:          time.Minute,
+					SubjectClaim:    "sub",
+					AttributeClaims: []string{"email", "groups"},
+				},
+				CfAccess: config.ServerAuthCfAccessConfig{
+					CertsRefresh: time.Hour,
+					Leeway:       time.Minute,
+				},
+				Webhook: config.WebhookConfig{
+					Timeout:  2 * time.Second,
+					CacheTtl: 30 * time.Second,
+				},
+			},
 		},
 	}
 	RootCmd = &cobra.Command{
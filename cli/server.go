@@ -1,8 +1,14 @@
 package cli
 
 import (
+	"context"
+	"edgeproxy/audit"
+	"edgeproxy/config"
 	"edgeproxy/server"
 	"edgeproxy/server/auth"
+	"edgeproxy/server/handlers"
+	"edgeproxy/transport"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
@@ -26,19 +32,96 @@ var (
 				log.Errorf("invalid Server Parameters %v", err)
 				os.Exit(invalidConfig)
 			}
-			var authenticate auth.Authenticate
-			authenticate = auth.NoopAuthorizer()
-			if serverConfig.Auth.CaConfig.TrustedRoot != "" {
-				authenticate = auth.NewSpireAuthorizer(cmd.Context(), serverConfig.Auth.CaConfig)
+			// the audit sinks are set first, so the events of the authenticators and grants loaded next are recorded
+			auditSink, err := newAuditSink(serverConfig.Audit)
+			if err != nil {
+				log.Errorf("invalid Server Parameters %v", err)
+				os.Exit(invalidConfig)
+			}
+			audit.SetSink(auditSink)
+			authenticators, err := loadServerAuthenticators(cmd.Context())
+			if err != nil {
+				log.Errorf("invalid Server Parameters %v", err)
+				os.Exit(invalidConfig)
+			}
+			var recorder *auth.ForwardRecorder
+			if serverConfig.Forward.RecordPath != "" {
+				if recorder, err = auth.NewForwardRecorder(serverConfig.Forward.RecordPath); err != nil {
+					log.Errorf("invalid Server Parameters %v", err)
+					os.Exit(invalidConfig)
+				}
+			}
+			var grants *auth.GrantStore
+			if serverConfig.Admin.Enabled() {
+				if grants, err = auth.NewGrantStore(serverConfig.Admin.GrantsPath, serverConfig.Admin.MaxGrantDuration); err != nil {
+					log.Errorf("invalid Server Parameters %v", err)
+					os.Exit(invalidConfig)
+				}
+			}
+			// the webhook is asked once the ACL policy allows a forward
+			var webhook auth.Authorize
+			if serverConfig.Auth.Webhook.Enabled() {
+				webhook = auth.NewWebhookAuthorizer(serverConfig.Auth.Webhook)
+			}
+			var tunnelRoutes []server.TunnelRoute
+			policyEnforcers := map[config.AclCollection]auth.Authorize{}
+			for _, tunnel := range serverConfig.TunnelConfigs() {
+				var chain []auth.Authenticate
+				for _, name := range tunnel.Authenticators {
+					chain = append(chain, authenticators[name])
+				}
+				authenticate := auth.Authenticate(auth.NoopAuthorizer())
+				if len(chain) > 0 {
+					authenticate = auth.NewAuthenticatorChain(chain...)
+				}
+				// tunnels sharing the same policy files share the enforcer
+				authorizer, ok := policyEnforcers[tunnel.Acl]
+				if !ok {
+					authorizer = auth.NoopAuthorizer()
+					if tunnel.Acl.Enabled() {
+						authorizer = newAclAuthorizer(tunnel.Acl)
+						if grants != nil {
+							grants.Attach(authorizer)
+						}
+					}
+					if shadowAcl := tunnel.Acl.ShadowAcl(); shadowAcl.Enabled() {
+						// the shadow policy gets the grants too, so they aren't reported as disagreements
+						shadow := newAclAuthorizer(shadowAcl)
+						if grants != nil {
+							grants.AttachShadow(shadow)
+						}
+						authorizer = auth.NewShadowAuthorizer(authorizer, shadow)
+					}
+					policyEnforcers[tunnel.Acl] = authorizer
+				}
+				if webhook != nil {
+					authorizer = auth.NewRequireAllAuthorizer(authorizer, webhook)
+				}
+				if recorder != nil {
+					authorizer = auth.RecordForwards(authorizer, recorder)
+				}
+				tunnelRoutes = append(tunnelRoutes, server.TunnelRoute{
+					Path:               tunnel.Path,
+					Authenticate:       authenticate,
+					Authorize:          authorizer,
+					RevalidateInterval: serverConfig.Session.RevalidateInterval,
+				})
 			}
-			var authorizer auth.Authorize
-			authorizer = auth.NoopAuthorizer()
-			if serverConfig.Auth.AclPolicyPath.IpPath != "" || serverConfig.Auth.AclPolicyPath.DomainPath != "" {
-				authorizer = auth.NewPolicyEnforcer(serverConfig.Auth.AclPolicyPath)
 
+			destinations, err := transport.NewDestinationPolicy(serverConfig.Forward)
+			if err != nil {
+				log.Errorf("invalid Server Parameters %v", err)
+				os.Exit(invalidConfig)
 			}
 
-			webSocketRelay := server.NewHttpServerWithTLS(cmd.Context(), authenticate, authorizer, serverConfig.HttpPort, serverConfig.HttpsPort, serverConfig.PublicKeyPath, serverConfig.PrivateKeyPath)
+			webSocketRelay := server.NewHttpServerWithTLS(cmd.Context(), tunnelRoutes, config.ListenAddress(serverConfig.BindAddress, serverConfig.HttpPort), config.ListenAddress(serverConfig.BindAddress, serverConfig.HttpsPort), serverConfig.PublicKeyPath, serverConfig.PrivateKeyPath, serverConfig.DnsResolver, destinations, transport.NewQuotas(serverConfig.Quota))
+			if grants != nil {
+				var chain []auth.Authenticate
+				for _, name := range serverConfig.AdminAuthenticators() {
+					chain = append(chain, authenticators[name])
+				}
+				webSocketRelay.HandleAdmin(handlers.NewAdminHandler(auth.NewAuthenticatorChain(chain...), serverConfig.Admin.Subjects, grants))
+			}
 			webSocketRelay.Start()
 
 			<-cmd.Context().Done()
@@ -48,10 +131,90 @@ var (
 	}
 )
 
+// newAuditSink records the audit events on the configured sinks, nil logs them
+func newAuditSink(auditConfig config.AuditConfig) (audit.Sink, error) {
+	var sinks []audit.Sink
+	if auditConfig.File.Path != "" {
+		sink, err := audit.NewFileSink(auditConfig.File)
+		if err != nil {
+			return nil, fmt.Errorf("can not open audit file: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if auditConfig.Syslog.Enable {
+		sink, err := audit.NewSyslogSink(auditConfig.Syslog)
+		if err != nil {
+			return nil, fmt.Errorf("can not connect to audit syslog: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if auditConfig.Webhook.Url != "" {
+		sinks = append(sinks, audit.NewWebhookSink(auditConfig.Webhook))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return audit.NewMultiSink(sinks...), nil
+}
+
+// newAclAuthorizer enforces the acl with its Rego module or its casbin policies
+func newAclAuthorizer(acl config.AclCollection) auth.Authorize {
+	if acl.RegoPath != "" {
+		return auth.NewRegoAuthorizer(acl)
+	}
+	return auth.NewPolicyEnforcer(acl)
+}
+
+// loadServerAuthenticators creates the configured authenticators by name, tunnels chain them in their own order
+func loadServerAuthenticators(ctx context.Context) (map[string]auth.Authenticate, error) {
+	authenticators := map[string]auth.Authenticate{}
+	var err error
+	for _, name := range serverConfig.Auth.EnabledAuthenticators() {
+		switch name {
+		case config.CertificateAuthenticator:
+			authenticators[name] = auth.NewSpireAuthorizer(ctx, serverConfig.Auth.CaConfig)
+		case config.OidcAuthenticator:
+			authenticators[name], err = auth.NewOidcAuthenticator(ctx, serverConfig.Auth.Oidc)
+		case config.CfAccessAuthenticator:
+			authenticators[name], err = auth.NewCfAccessAuthenticator(ctx, serverConfig.Auth.CfAccess)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return authenticators, nil
+}
+
 func init() {
 	RootCmd.AddCommand(serverCmd)
+	serverCmd.PersistentFlags().StringVar(&serverConfig.BindAddress, "bind-address", serverConfig.BindAddress, "Address the server listens on (0.0.0.0, ::), all interfaces dual-stack by default")
 	serverCmd.PersistentFlags().IntVar(&serverConfig.HttpPort, "http-port", serverConfig.HttpPort, "Http Server Listen Port")
 	serverCmd.PersistentFlags().IntVar(&serverConfig.HttpsPort, "https-port", serverConfig.HttpsPort, "Http TLS Server Listen Port")
 	serverCmd.PersistentFlags().StringVar(&serverConfig.PrivateKeyPath, "private-key", serverConfig.PrivateKeyPath, "Server Private Key Path")
 	serverCmd.PersistentFlags().StringVar(&serverConfig.PublicKeyPath, "public-key", serverConfig.PublicKeyPath, "Server Public Key Path")
+	serverCmd.PersistentFlags().StringVar((*string)(&serverConfig.Auth.CaConfig.Mode), "client-cert-mode", string(serverConfig.Auth.CaConfig.Mode), "Where client certificates are read from: header (X-Client-Certificate, TLS terminated by a WAF), mtls (TLS handshake) or any")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Auth.CaConfig.Token.BindEndpoint, "client-token-bind-endpoint", serverConfig.Auth.CaConfig.Token.BindEndpoint, "Require client tokens bound to the tunnel endpoint URL")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Auth.CaConfig.Token.BindCertificate, "client-token-bind-certificate", serverConfig.Auth.CaConfig.Token.BindCertificate, "Require client tokens bound to the TLS client certificate")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Auth.CaConfig.Revocation.HardFail, "revocation-hard-fail", serverConfig.Auth.CaConfig.Revocation.HardFail, "Reject client certificates whose revocation status can't be checked")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Auth.CaConfig.Revocation.Ocsp, "revocation-ocsp", serverConfig.Auth.CaConfig.Revocation.Ocsp, "Check client certificates against their OCSP responder")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Auth.Oidc.Jwks, "oidc-jwks", serverConfig.Auth.Oidc.Jwks, "JWKS file or URL with the keys of the OIDC or JWT-SVID bearer tokens")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Auth.Oidc.Issuer, "oidc-issuer", serverConfig.Auth.Oidc.Issuer, "Required issuer (iss) of the bearer tokens")
+	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.Auth.Oidc.Audiences, "oidc-audience", serverConfig.Auth.Oidc.Audiences, "Accepted audience (aud) of the bearer tokens, can be repeated")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Auth.CfAccess.TeamDomain, "cf-access-team-domain", serverConfig.Auth.CfAccess.TeamDomain, "Cloudflare Access team domain (myteam.cloudflareaccess.com) authenticating the clients")
+	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.Auth.CfAccess.Audiences, "cf-access-aud", serverConfig.Auth.CfAccess.Audiences, "Cloudflare Access application AUD tag, can be repeated")
+	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.Auth.Chain, "auth-chain", serverConfig.Auth.Chain, "Ordered authenticators (certificate, oidc, cfAccess), the first accepting a client supplies the subject (default all configured)")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.Session.RevalidateInterval, "session-revalidate-interval", serverConfig.Session.RevalidateInterval, "How often the credentials of open tunnels are checked for revocation, 0 disables it")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Forward.DenyPrivateNetworks, "deny-private-networks", serverConfig.Forward.DenyPrivateNetworks, "Deny forwards to private networks (RFC1918, CGNAT, IPv6 unique local)")
+	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.Forward.AllowedNetworks, "forward-allowed-network", serverConfig.Forward.AllowedNetworks, "Network (CIDR) reachable by forwards even if denied by default, e.g. 127.0.0.1/32, can be repeated")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Auth.Webhook.Url, "authz-webhook", serverConfig.Auth.Webhook.Url, "URL every forward is posted to for authorization, besides the ACL policy")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Auth.Webhook.FailOpen, "authz-webhook-fail-open", serverConfig.Auth.Webhook.FailOpen, "Allow forwards when the authorization webhook fails")
+	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.Admin.Subjects, "admin-subject", serverConfig.Admin.Subjects, "Subject or attribute:value (* globs) allowed to use the admin API, can be repeated, none disables it")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Admin.GrantsPath, "admin-grants", serverConfig.Admin.GrantsPath, "File persisting the just-in-time grants created through the admin API")
+	serverCmd.PersistentFlags().IntVar(&serverConfig.Quota.Sessions, "quota-sessions", serverConfig.Quota.Sessions, "Concurrent tunnel sessions of each subject, 0 is unlimited")
+	serverCmd.PersistentFlags().IntVar(&serverConfig.Quota.Streams, "quota-streams", serverConfig.Quota.Streams, "Concurrent forwarded streams of each subject, 0 is unlimited")
+	serverCmd.PersistentFlags().Float64Var(&serverConfig.Quota.ConnectionRate, "quota-connection-rate", serverConfig.Quota.ConnectionRate, "New forwarded streams per second of each subject, 0 is unlimited")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Audit.File.Path, "audit-file", serverConfig.Audit.File.Path, "File the audit events are appended to as JSON lines, rotated by size")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.Audit.Syslog.Enable, "audit-syslog", serverConfig.Audit.Syslog.Enable, "Send the audit events to the local syslog")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.Audit.Webhook.Url, "audit-webhook", serverConfig.Audit.Webhook.Url, "URL the audit events are posted to in JSON batches")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.DnsResolver, "dns-resolver", serverConfig.DnsResolver, "DNS resolver (host:port) used for client DNS queries, defaults to the first nameserver in /etc/resolv.conf")
 }
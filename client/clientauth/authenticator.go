@@ -1,7 +1,23 @@
 package clientauth
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
+
+// CredentialRenewBefore is how long before expiring credentials are renewed,
+// so they are still valid when they reach the server
+const CredentialRenewBefore = 30 * time.Second
 
 type Authenticator interface {
-	AddAuthenticationHeaders(headers *http.Header)
+	// AddAuthenticationHeaders is called for every new tunnel connection, implementations refresh their credentials here
+	AddAuthenticationHeaders(headers *http.Header) error
+}
+
+// ExpiringAuthenticator is implemented by authenticators whose credentials expire,
+// tunnels opened with them are reconnected before the credential expires.
+type ExpiringAuthenticator interface {
+	Authenticator
+	// CredentialExpiry returns when the credential sent on the last AddAuthenticationHeaders expires, zero if unknown
+	CredentialExpiry() time.Time
 }
@@ -0,0 +1,46 @@
+package clientauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	b64 "encoding/base64"
+	"net/http"
+	"net/url"
+)
+
+// TokenBinding restricts where a client token can be used, empty fields are not bound
+type TokenBinding struct {
+	// Endpoint is the tunnel endpoint URL, sent as htu claim
+	Endpoint string
+	// CertificateThumbprint of the TLS client certificate, sent as cnf x5t#S256 claim (RFC 8705)
+	CertificateThumbprint string
+}
+
+// BindingAuthenticator is implemented by authenticators able to bind their tokens to the tunnel connection
+type BindingAuthenticator interface {
+	Authenticator
+	AddBoundAuthenticationHeaders(headers *http.Header, binding TokenBinding) error
+}
+
+// NewTokenBinding binds tokens to the endpoint and the TLS client certificate, if any
+func NewTokenBinding(endpoint *url.URL, tlsConfig *tls.Config) TokenBinding {
+	binding := TokenBinding{Endpoint: endpoint.String()}
+	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 && len(tlsConfig.Certificates[0].Certificate) > 0 {
+		binding.CertificateThumbprint = CertificateThumbprint(tlsConfig.Certificates[0].Certificate[0])
+	}
+	return binding
+}
+
+// CertificateThumbprint returns the base64url sha256 of the DER certificate
+func CertificateThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return b64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AddAuthenticationHeaders adds the authenticator headers, binding the tokens when the authenticator supports it
+func AddAuthenticationHeaders(authenticator Authenticator, headers *http.Header, binding TokenBinding) error {
+	if bindingAuthenticator, ok := authenticator.(BindingAuthenticator); ok {
+		return bindingAuthenticator.AddBoundAuthenticationHeaders(headers, binding)
+	}
+	return authenticator.AddAuthenticationHeaders(headers)
+}
@@ -0,0 +1,136 @@
+package clientauth
+
+import (
+	"bytes"
+	"context"
+	"edgeproxy/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultExecTimeout = 30 * time.Second
+
+// ExecCredential is the output expected from the credential command, compatible with kubectl exec plugins.
+// Headers is an edgeproxy extension to send any header with the tunnel request.
+type ExecCredential struct {
+	APIVersion string               `json:"apiVersion,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+type ExecCredentialStatus struct {
+	Token               string            `json:"token,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	ExpirationTimestamp *time.Time        `json:"expirationTimestamp,omitempty"`
+}
+
+// ExecAuthenticator runs an external command to get the tunnel credentials,
+// the credentials are cached until they expire.
+type ExecAuthenticator struct {
+	mu         sync.Mutex
+	command    string
+	args       []string
+	env        []string
+	timeout    time.Duration
+	credential *ExecCredential
+	now        func() time.Time
+}
+
+func NewExecAuthenticator(execConfig config.ClientAuthExecConfig) *ExecAuthenticator {
+	timeout := execConfig.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	var env []string
+	for name, value := range execConfig.Env {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+	return &ExecAuthenticator{
+		command: execConfig.Command,
+		args:    execConfig.Args,
+		env:     env,
+		timeout: timeout,
+		now:     time.Now,
+	}
+}
+
+func (e *ExecAuthenticator) AddAuthenticationHeaders(headers *http.Header) error {
+	credential, err := e.getCredential()
+	if err != nil {
+		return err
+	}
+	if credential.Status.Token != "" {
+		headers.Set(HeaderAuthorization, fmt.Sprintf("Bearer %s", credential.Status.Token))
+	}
+	for name, value := range credential.Status.Headers {
+		headers.Set(name, value)
+	}
+	return nil
+}
+
+// CredentialExpiry returns when the cached credential expires, zero if unknown
+func (e *ExecAuthenticator) CredentialExpiry() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.credential == nil || e.credential.Status.ExpirationTimestamp == nil {
+		return time.Time{}
+	}
+	return *e.credential.Status.ExpirationTimestamp
+}
+
+func (e *ExecAuthenticator) getCredential() (*ExecCredential, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.credential != nil && !e.expired(e.credential) {
+		return e.credential, nil
+	}
+	credential, err := e.run()
+	if err != nil {
+		return nil, err
+	}
+	e.credential = credential
+	return credential, nil
+}
+
+func (e *ExecAuthenticator) expired(credential *ExecCredential) bool {
+	expiration := credential.Status.ExpirationTimestamp
+	// credentials without expiration are valid until the process restarts
+	if expiration == nil {
+		return false
+	}
+	return !e.now().Add(CredentialRenewBefore).Before(*expiration)
+}
+
+func (e *ExecAuthenticator) run() (*ExecCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	log.Debugf("Getting tunnel credentials from %s", e.command)
+	cmd := exec.CommandContext(ctx, e.command, e.args...)
+	cmd.Env = append(os.Environ(), e.env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential command %s failed: %v: %s", e.command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	credential := &ExecCredential{}
+	if err := json.Unmarshal(stdout.Bytes(), credential); err != nil {
+		return nil, fmt.Errorf("invalid credential command output: %v", err)
+	}
+	if credential.Status.Token == "" && len(credential.Status.Headers) == 0 {
+		return nil, errors.New("credential command returned no token nor headers")
+	}
+	if e.expired(credential) {
+		return nil, fmt.Errorf("credential command returned an expired credential %s", credential.Status.ExpirationTimestamp)
+	}
+	return credential, nil
+}
@@ -0,0 +1,69 @@
+package clientauth
+
+import (
+	"edgeproxy/config"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecAuthenticatorCachesUntilExpiry(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	// Every execution appends to the counter file and returns a token with the execution number
+	script := fmt.Sprintf(`echo x >> %s; n=$(wc -l < %s | tr -d ' '); echo '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"token-'$n'","expirationTimestamp":"%s","headers":{"X-Tenant":"acme"}}}'`, counter, counter, expiration)
+	authenticator := NewExecAuthenticator(config.ClientAuthExecConfig{Command: "sh", Args: []string{"-c", script}})
+
+	headers := http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, "Bearer token-1", headers.Get(HeaderAuthorization))
+	assert.Equal(t, "acme", headers.Get("X-Tenant"))
+
+	headers = http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, "Bearer token-1", headers.Get(HeaderAuthorization))
+
+	assert.Equal(t, expiration, authenticator.CredentialExpiry().Format(time.RFC3339))
+
+	// Once the cached credential is close to expire the command is executed again
+	authenticator.now = func() time.Time { return time.Now().Add(time.Hour - CredentialRenewBefore/2) }
+	headers = http.Header{}
+	err := authenticator.AddAuthenticationHeaders(&headers)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "expired")
+	}
+	authenticator.now = time.Now
+	authenticator.credential = nil
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, "Bearer token-3", headers.Get(HeaderAuthorization))
+}
+
+func TestExecAuthenticatorFailure(t *testing.T) {
+	authenticator := NewExecAuthenticator(config.ClientAuthExecConfig{Command: "sh", Args: []string{"-c", "echo denied >&2; exit 1"}})
+	headers := http.Header{}
+	err := authenticator.AddAuthenticationHeaders(&headers)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "denied")
+	}
+}
+
+func TestTokenFileAuthenticator(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	authenticator := NewTokenFileAuthenticator(tokenFile)
+	headers := http.Header{}
+	assert.Error(t, authenticator.AddAuthenticationHeaders(&headers))
+
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, "Bearer first", headers.Get(HeaderAuthorization))
+
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("rotated"), 0600))
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, "Bearer rotated", headers.Get(HeaderAuthorization))
+}
@@ -1,18 +1,20 @@
 package clientauth
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"edgeproxy/config"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -20,9 +22,19 @@ import (
 
 type ClientAuthorizationClaims struct {
 	*jwt.StandardClaims
-	Nonce string `json:"nonce"`
+	Nonce        string             `json:"nonce"`
+	Endpoint     string             `json:"htu,omitempty"`
+	Confirmation *TokenConfirmation `json:"cnf,omitempty"`
 }
 
+// TokenConfirmation binds the token to the TLS client certificate
+type TokenConfirmation struct {
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+}
+
+// clientTokenLifetime is how long client tokens are valid, the server rejects their replay meanwhile
+const clientTokenLifetime = 10 * time.Minute
+
 var (
 	signKey        *rsa.PrivateKey
 	signKeyEc      *ecdsa.PrivateKey
@@ -33,6 +45,8 @@ var (
 const (
 	HeaderAuthorization = "Authorization"
 	HeaderCertificate   = "X-Client-Certificate"
+	// HeaderCertificateOcsp carries a base64 DER OCSP response for the client certificate, stapled by the client or the WAF
+	HeaderCertificateOcsp = "X-Client-Certificate-Ocsp"
 )
 
 func SetSigningKey(pemPath string) {
@@ -82,30 +96,73 @@ func SetCertificate(pemPath string) {
 }
 
 func CreateClientToken() (string, error) {
+	return createClientToken(TokenBinding{})
+}
+
+func createClientToken(binding TokenBinding) (string, error) {
 	if signKey != nil {
-		t := jwt.New(jwt.GetSigningMethod("RS256"))
-		t.Claims = &ClientAuthorizationClaims{
-			&jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(time.Minute * 10).Unix(),
-				Audience:  "edgeproxy",
-			},
-			strconv.Itoa(rand.Int()),
-		}
-		return t.SignedString(signKey)
+		return signClientToken(signKey, binding)
 	} else if signKeyEc != nil {
-		t := jwt.New(jwt.GetSigningMethod("ES256"))
-		t.Claims = &ClientAuthorizationClaims{
-			&jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(time.Minute * 10).Unix(),
-				Audience:  "edgeproxy",
-			},
-			strconv.Itoa(rand.Int()),
-		}
-		return t.SignedString(signKeyEc)
+		return signClientToken(signKeyEc, binding)
 	}
 	return "", nil
 }
 
+// signClientToken creates the JWT proving the possession of the client certificate key,
+// every token has a unique id so the server can reject replays
+func signClientToken(key crypto.PrivateKey, binding TokenBinding) (string, error) {
+	var method jwt.SigningMethod
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		// the ECDSA method is tied to the curve of the key
+		switch bits := key.Curve.Params().BitSize; bits {
+		case 256:
+			method = jwt.SigningMethodES256
+		case 384:
+			method = jwt.SigningMethodES384
+		case 521:
+			method = jwt.SigningMethodES512
+		default:
+			return "", fmt.Errorf("unsupported ECDSA signing key curve P-%d", bits)
+		}
+	default:
+		return "", fmt.Errorf("unsupported signing key type %T", key)
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &ClientAuthorizationClaims{
+		StandardClaims: &jwt.StandardClaims{
+			Id:        hex.EncodeToString(jti),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(clientTokenLifetime).Unix(),
+			Audience:  "edgeproxy",
+		},
+		Endpoint: binding.Endpoint,
+	}
+	// servers not checking jti still get a random nonce
+	claims.Nonce = claims.Id
+	if binding.CertificateThumbprint != "" {
+		claims.Confirmation = &TokenConfirmation{CertificateThumbprint: binding.CertificateThumbprint}
+	}
+	t := jwt.New(method)
+	t.Claims = claims
+	return t.SignedString(key)
+}
+
+// encodeCertificates encodes the certificate chain as base64 PEM bundle, the X-Client-Certificate header format
+func encodeCertificates(certs []*x509.Certificate) string {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return b64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
 func GetClientCertificate() (string, error) {
 
 	return certificatePem, nil
@@ -114,11 +171,19 @@ func GetClientCertificate() (string, error) {
 type JwtAuthenticator struct {
 }
 
-func (receiver JwtAuthenticator) AddAuthenticationHeaders(headers *http.Header) {
-	token, _ := CreateClientToken()
+func (receiver JwtAuthenticator) AddAuthenticationHeaders(headers *http.Header) error {
+	return receiver.AddBoundAuthenticationHeaders(headers, TokenBinding{})
+}
+
+func (receiver JwtAuthenticator) AddBoundAuthenticationHeaders(headers *http.Header, binding TokenBinding) error {
+	token, err := createClientToken(binding)
+	if err != nil {
+		return fmt.Errorf("error creating client token: %v", err)
+	}
 	cert, _ := GetClientCertificate()
 	headers.Add(HeaderAuthorization, fmt.Sprintf("Bearer %s", token))
 	headers.Add(HeaderCertificate, cert)
+	return nil
 }
 
 func (receiver JwtAuthenticator) Load(config config.ClientAuthCaConfig) {
@@ -8,6 +8,7 @@ import (
 type NoopAuthenticator struct {
 }
 
-func (receiver NoopAuthenticator) AddAuthenticationHeaders(headers *http.Header) {
+func (receiver NoopAuthenticator) AddAuthenticationHeaders(headers *http.Header) error {
 	log.Trace("skipping clientauth")
+	return nil
 }
@@ -0,0 +1,34 @@
+package clientauth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// TokenFileAuthenticator sends the bearer token stored on a file,
+// the file is read on every tunnel connection so rotated tokens are picked up.
+type TokenFileAuthenticator struct {
+	path string
+}
+
+func NewTokenFileAuthenticator(path string) *TokenFileAuthenticator {
+	return &TokenFileAuthenticator{
+		path: path,
+	}
+}
+
+func (t *TokenFileAuthenticator) AddAuthenticationHeaders(headers *http.Header) error {
+	buf, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("error reading token file: %v", err)
+	}
+	token := bytes.TrimSpace(buf)
+	if len(token) == 0 {
+		return errors.New("token file is empty")
+	}
+	headers.Set(HeaderAuthorization, fmt.Sprintf("Bearer %s", token))
+	return nil
+}
@@ -0,0 +1,90 @@
+package clientauth
+
+import (
+	"context"
+	"edgeproxy/config"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// WorkloadAuthenticator gets the client X.509-SVID from a SPIFFE Workload API (e.g. SPIRE agent),
+// the SVID is kept up to date in memory so every tunnel connection uses the latest one.
+type WorkloadAuthenticator struct {
+	source *workloadapi.X509Source
+}
+
+const defaultWorkloadTimeout = 30 * time.Second
+
+// NewWorkloadAuthenticator connects to the Workload API and waits for the first SVID.
+// An empty socket uses the SPIFFE_ENDPOINT_SOCKET environment variable.
+func NewWorkloadAuthenticator(ctx context.Context, workloadConfig config.ClientAuthWorkloadConfig) (*WorkloadAuthenticator, error) {
+	var clientOptions []workloadapi.ClientOption
+	if workloadConfig.Socket != "" {
+		clientOptions = append(clientOptions, workloadapi.WithAddr(workloadConfig.Socket))
+	}
+	timeout := workloadConfig.Timeout
+	if timeout <= 0 {
+		timeout = defaultWorkloadTimeout
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(fetchCtx, workloadapi.WithClientOptions(clientOptions...))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching SVID from workload API: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		source.Close()
+	}()
+
+	w := &WorkloadAuthenticator{source: source}
+	if svid, err := source.GetX509SVID(); err == nil {
+		log.Infof("Using SVID %s from workload API", svid.ID)
+	}
+	go w.logRotations(ctx)
+	return w, nil
+}
+
+func (w *WorkloadAuthenticator) AddAuthenticationHeaders(headers *http.Header) error {
+	return w.AddBoundAuthenticationHeaders(headers, TokenBinding{})
+}
+
+func (w *WorkloadAuthenticator) AddBoundAuthenticationHeaders(headers *http.Header, binding TokenBinding) error {
+	svid, err := w.source.GetX509SVID()
+	if err != nil {
+		return err
+	}
+	token, err := signClientToken(svid.PrivateKey, binding)
+	if err != nil {
+		return fmt.Errorf("error creating client token: %v", err)
+	}
+	headers.Add(HeaderAuthorization, fmt.Sprintf("Bearer %s", token))
+	headers.Add(HeaderCertificate, encodeCertificates(svid.Certificates))
+	return nil
+}
+
+// CredentialExpiry returns when the current SVID expires
+func (w *WorkloadAuthenticator) CredentialExpiry() time.Time {
+	svid, err := w.source.GetX509SVID()
+	if err != nil || len(svid.Certificates) == 0 {
+		return time.Time{}
+	}
+	return svid.Certificates[0].NotAfter
+}
+
+func (w *WorkloadAuthenticator) logRotations(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.source.Updated():
+			if svid, err := w.source.GetX509SVID(); err == nil && len(svid.Certificates) > 0 {
+				log.Debugf("SVID %s rotated, expires at %s", svid.ID, svid.Certificates[0].NotAfter)
+			}
+		}
+	}
+}
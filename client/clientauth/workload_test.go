@@ -0,0 +1,248 @@
+package clientauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"edgeproxy/config"
+	b64 "encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// fakeWorkloadAPI is a stand-in SPIFFE Workload API streaming the SVIDs sent to its updates channel
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	updates chan *workload.X509SVIDResponse
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case resp := <-f.updates:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type workloadCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// parent issued an intermediate CA, nil for the root
+	parent *workloadCA
+	// svidCurve is the curve of the SVID keys, P-256 if nil
+	svidCurve elliptic.Curve
+}
+
+func newWorkloadCA(t *testing.T) *workloadCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tml := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "workload CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, tml, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &workloadCA{cert: cert, key: key}
+}
+
+// newIntermediate creates an intermediate CA issued by ca, as SPIRE with an upstream authority
+func (ca *workloadCA) newIntermediate(t *testing.T) *workloadCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tml := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "workload intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &workloadCA{cert: cert, key: key, parent: ca}
+}
+
+// svidResponse issues a new SVID, returned as Workload API response
+func (ca *workloadCA) svidResponse(t *testing.T, spiffeID string, serial int64, notAfter time.Time) *workload.X509SVIDResponse {
+	curve := ca.svidCurve
+	if curve == nil {
+		curve = elliptic.P256()
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	assert.NoError(t, err)
+	uri, err := url.Parse(spiffeID)
+	assert.NoError(t, err)
+	tml := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	// the SVID is followed by the intermediates up to the root of the bundle
+	root := ca
+	for ; root.parent != nil; root = root.parent {
+		der = append(der, root.cert.Raw...)
+	}
+	return &workload.X509SVIDResponse{Svids: []*workload.X509SVID{{
+		SpiffeId:    spiffeID,
+		X509Svid:    der,
+		X509SvidKey: keyDer,
+		Bundle:      root.cert.Raw,
+	}}}
+}
+
+// headerCertificate decodes the X-Client-Certificate header and validates the token was signed with its key
+func headerCertificate(t *testing.T, headers http.Header) *x509.Certificate {
+	buf, err := b64.StdEncoding.DecodeString(headers.Get(HeaderCertificate))
+	assert.NoError(t, err)
+	block, _ := pem.Decode(buf)
+	if !assert.NotNil(t, block) {
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+
+	token := strings.TrimPrefix(headers.Get(HeaderAuthorization), "Bearer ")
+	_, err = jwt.ParseWithClaims(token, &ClientAuthorizationClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return cert.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	return cert
+}
+
+func TestWorkloadAuthenticatorRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ca := newWorkloadCA(t)
+
+	api := &fakeWorkloadAPI{updates: make(chan *workload.X509SVIDResponse, 1)}
+	firstExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	api.updates <- ca.svidResponse(t, "spiffe://example.com/users/client", 2, firstExpiry)
+	authenticator, err := NewWorkloadAuthenticator(ctx, config.ClientAuthWorkloadConfig{Socket: startWorkloadAPI(t, api), Timeout: 5 * time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	headers := http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	cert := headerCertificate(t, headers)
+	assert.Equal(t, "spiffe://example.com/users/client", cert.URIs[0].String())
+	assert.Equal(t, int64(2), cert.SerialNumber.Int64())
+	assert.True(t, firstExpiry.Equal(authenticator.CredentialExpiry()))
+
+	// New connections use the rotated SVID
+	secondExpiry := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	api.updates <- ca.svidResponse(t, "spiffe://example.com/users/client", 3, secondExpiry)
+	assert.Eventually(t, func() bool {
+		return secondExpiry.Equal(authenticator.CredentialExpiry())
+	}, 5*time.Second, 10*time.Millisecond)
+	headers = http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	assert.Equal(t, int64(3), headerCertificate(t, headers).SerialNumber.Int64())
+}
+
+// startWorkloadAPI serves a fake Workload API on a unix socket, returning its address
+func startWorkloadAPI(t *testing.T, api *fakeWorkloadAPI) string {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(grpcServer, api)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return "unix://" + socket
+}
+
+func TestWorkloadAuthenticatorIntermediates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := newWorkloadCA(t)
+	intermediate := root.newIntermediate(t)
+
+	api := &fakeWorkloadAPI{updates: make(chan *workload.X509SVIDResponse, 1)}
+	api.updates <- intermediate.svidResponse(t, "spiffe://example.com/users/client", 2, time.Now().Add(time.Hour))
+	authenticator, err := NewWorkloadAuthenticator(ctx, config.ClientAuthWorkloadConfig{Socket: startWorkloadAPI(t, api), Timeout: 5 * time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The intermediates are sent after the SVID, so the server can chain it to the bundle
+	headers := http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	cert := headerCertificate(t, headers)
+	buf, err := b64.StdEncoding.DecodeString(headers.Get(HeaderCertificate))
+	assert.NoError(t, err)
+	intermediates := x509.NewCertPool()
+	for block, rest := pem.Decode(buf); block != nil; block, rest = pem.Decode(rest) {
+		chained, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		intermediates.AddCert(chained)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	assert.NoError(t, err)
+}
+
+func TestWorkloadAuthenticatorP384(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ca := newWorkloadCA(t)
+	ca.svidCurve = elliptic.P384()
+
+	api := &fakeWorkloadAPI{updates: make(chan *workload.X509SVIDResponse, 1)}
+	api.updates <- ca.svidResponse(t, "spiffe://example.com/users/client", 2, time.Now().Add(time.Hour))
+	authenticator, err := NewWorkloadAuthenticator(ctx, config.ClientAuthWorkloadConfig{Socket: startWorkloadAPI(t, api), Timeout: 5 * time.Second})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The token is signed with the method of the key curve
+	headers := http.Header{}
+	assert.NoError(t, authenticator.AddAuthenticationHeaders(&headers))
+	headerCertificate(t, headers)
+	token, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(headers.Get(HeaderAuthorization), "Bearer "), &ClientAuthorizationClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, jwt.SigningMethodES384.Alg(), token.Method.Alg())
+}
+
+func TestWorkloadAuthenticatorUnavailable(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "missing.sock")
+	_, err := NewWorkloadAuthenticator(context.Background(), config.ClientAuthWorkloadConfig{Socket: "unix://" + socket, Timeout: 200 * time.Millisecond})
+	assert.Error(t, err)
+}
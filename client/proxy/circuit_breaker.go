@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"edgeproxy/metrics"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	// breakerClosed the tunnel is up, dials go through
+	breakerClosed breakerState = iota
+	// breakerReconnecting the tunnel is down, dials wait for the reconnection
+	breakerReconnecting
+	// breakerOpen reconnection failed too many times, dials fail fast until the tunnel is back
+	breakerOpen
+)
+
+var ErrTunnelUnavailable = errors.New("tunnel unavailable")
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerReconnecting:
+		return "reconnecting"
+	case breakerOpen:
+		return "open"
+	}
+	return ""
+}
+
+type circuitBreaker struct {
+	mu          sync.Mutex
+	name        string
+	state       breakerState
+	failures    int
+	threshold   int
+	reconnected chan struct{}
+}
+
+func newCircuitBreaker(name string, threshold int) *circuitBreaker {
+	return &circuitBreaker{
+		name:        name,
+		state:       breakerClosed,
+		threshold:   threshold,
+		reconnected: make(chan struct{}),
+	}
+}
+
+// Trip marks the tunnel as down, pending dials will wait for the reconnection
+func (c *circuitBreaker) Trip() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == breakerClosed {
+		c.transition(breakerReconnecting)
+	}
+}
+
+// Failure records a failed reconnection attempt and opens the breaker once the threshold is reached
+func (c *circuitBreaker) Failure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	if c.state == breakerClosed {
+		c.transition(breakerReconnecting)
+	}
+	if c.threshold > 0 && c.failures >= c.threshold && c.state != breakerOpen {
+		c.transition(breakerOpen)
+	}
+}
+
+// Success closes the breaker and wakes up the dials waiting for the reconnection
+func (c *circuitBreaker) Success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = 0
+	if c.state != breakerClosed {
+		c.transition(breakerClosed)
+		close(c.reconnected)
+		c.reconnected = make(chan struct{})
+	}
+}
+
+func (c *circuitBreaker) State() breakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Wait blocks until the tunnel is reconnected, the timeout expires or the context is done.
+// It returns immediately when the breaker is closed (tunnel up) or open (tunnel down).
+func (c *circuitBreaker) Wait(ctx context.Context, timeout time.Duration) error {
+	c.mu.Lock()
+	state := c.state
+	reconnected := c.reconnected
+	c.mu.Unlock()
+
+	switch state {
+	case breakerClosed:
+		return nil
+	case breakerOpen:
+		metrics.IncrementTunnelDialsRejected()
+		return fmt.Errorf("%s: %w", c.name, ErrTunnelUnavailable)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-reconnected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		metrics.IncrementTunnelDialsRejected()
+		return fmt.Errorf("%s: timeout waiting for reconnection: %w", c.name, ErrTunnelUnavailable)
+	}
+}
+
+func (c *circuitBreaker) transition(state breakerState) {
+	log.Infof("Tunnel %s state %s -> %s", c.name, c.state, state)
+	c.state = state
+	metrics.IncrementTunnelStateTransitions(state.String())
+}
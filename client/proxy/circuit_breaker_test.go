@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerWaitsForReconnection(t *testing.T) {
+	breaker := newCircuitBreaker("test", 3)
+	assert.NoError(t, breaker.Wait(context.Background(), time.Second))
+
+	breaker.Trip()
+	assert.Equal(t, breakerReconnecting, breaker.State())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		breaker.Success()
+	}()
+	assert.NoError(t, breaker.Wait(context.Background(), 5*time.Second))
+	assert.Equal(t, breakerClosed, breaker.State())
+}
+
+func TestCircuitBreakerTimeout(t *testing.T) {
+	breaker := newCircuitBreaker("test", 3)
+	breaker.Trip()
+	assert.ErrorIs(t, breaker.Wait(context.Background(), 10*time.Millisecond), ErrTunnelUnavailable)
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker := newCircuitBreaker("test", 2)
+	breaker.Trip()
+	breaker.Failure()
+	assert.Equal(t, breakerReconnecting, breaker.State())
+	breaker.Failure()
+	assert.Equal(t, breakerOpen, breaker.State())
+
+	// Open breaker fails fast without waiting for the timeout
+	start := time.Now()
+	assert.ErrorIs(t, breaker.Wait(context.Background(), time.Minute), ErrTunnelUnavailable)
+	assert.Less(t, time.Since(start), time.Second)
+
+	breaker.Success()
+	assert.Equal(t, breakerClosed, breaker.State())
+	assert.NoError(t, breaker.Wait(context.Background(), time.Minute))
+}
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"context"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"edgeproxy/transport"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsRouteTunnel    = "tunnel"
+	dnsRouteLocal     = "local"
+	dnsMaxMessageSize = 65535
+	dnsMinUDPSize     = 512
+	dnsDefaultTimeout = 5 * time.Second
+)
+
+type dnsProxy struct {
+	ctx         context.Context
+	dialer      Dialer
+	listenAddr  string
+	zones       []string
+	upstream    string
+	timeout     time.Duration
+	cache       *dnsCache
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	queries     *uint64
+	hits        *uint64
+}
+
+// NewDnsProxy creates a DNS server that resolves the configured zones through the tunnel
+// and everything else with the local upstream resolver.
+func NewDnsProxy(ctx context.Context, dialer Dialer, dnsConfig config.DnsConfig) Proxy {
+	var zones []string
+	for _, zone := range dnsConfig.Zones {
+		zone = strings.ToLower(strings.TrimSpace(zone))
+		if zone == "" {
+			continue
+		}
+		if !strings.HasSuffix(zone, ".") {
+			zone += "."
+		}
+		zones = append(zones, zone)
+	}
+	upstream := dnsConfig.Upstream
+	if upstream == "" {
+		var err error
+		upstream, err = transport.SystemNameserver()
+		if err != nil {
+			log.Warnf("No local DNS upstream available, only tunnel zones will be resolved: %v", err)
+		}
+	}
+	timeout := dnsConfig.Timeout
+	if timeout <= 0 {
+		timeout = dnsDefaultTimeout
+	}
+	return &dnsProxy{
+		ctx:        ctx,
+		dialer:     dialer,
+		listenAddr: dnsConfig.ListenAddr,
+		zones:      zones,
+		upstream:   upstream,
+		timeout:    timeout,
+		cache:      newDnsCache(dnsConfig.CacheSize, dnsConfig.MaxTTL, dnsConfig.NegativeTTL),
+		queries:    new(uint64),
+		hits:       new(uint64),
+	}
+}
+
+func (d *dnsProxy) Start() {
+	var err error
+	log.Infof("Starting DNS Proxy at Addr %s, tunnel zones %q, local upstream %s", d.listenAddr, d.zones, d.upstream)
+	d.udpConn, err = net.ListenPacket(config.ListenNetwork("udp", d.listenAddr), d.listenAddr)
+	if err != nil {
+		log.Fatalf("DNS Proxy UDP Listen failure: %v", err)
+	}
+	d.tcpListener, err = net.Listen(config.ListenNetwork("tcp", d.listenAddr), d.listenAddr)
+	if err != nil {
+		log.Fatalf("DNS Proxy TCP Listen failure: %v", err)
+	}
+	go d.serveUDP()
+	go d.serveTCP()
+}
+
+func (d *dnsProxy) Stop() {
+	log.Infof("Stopping DNS Proxy")
+	if d.udpConn != nil {
+		d.udpConn.Close()
+	}
+	if d.tcpListener != nil {
+		d.tcpListener.Close()
+	}
+}
+
+func (d *dnsProxy) serveUDP() {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := d.udpConn.ReadFrom(buf)
+		if err != nil {
+			if d.ctx.Err() != nil || isClosedConnError(err) {
+				return
+			}
+			log.Warnf("Error when reading DNS query: %v", err)
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp := d.handleQuery(query, true)
+			if resp == nil {
+				return
+			}
+			if _, err := d.udpConn.WriteTo(resp, addr); err != nil {
+				log.Debugf("Error when writing DNS response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (d *dnsProxy) serveTCP() {
+	for {
+		conn, err := d.tcpListener.Accept()
+		if err != nil {
+			if d.ctx.Err() != nil || isClosedConnError(err) {
+				return
+			}
+			log.Warnf("Error when accepting DNS connection: %v", err)
+			continue
+		}
+		go d.serveTCPConnection(conn)
+	}
+}
+
+func (d *dnsProxy) serveTCPConnection(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(d.timeout * 2))
+		query, err := readTCPDnsMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := d.handleQuery(query, false)
+		if resp == nil {
+			return
+		}
+		if err = writeTCPDnsMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (d *dnsProxy) handleQuery(query []byte, udp bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		log.Debugf("Invalid DNS query: %v", err)
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return dnsErrorResponse(header, nil, dnsmessage.RCodeFormatError)
+	}
+	maxSize := dnsMaxMessageSize
+	if udp {
+		maxSize = dnsUDPSize(&parser)
+	}
+
+	atomic.AddUint64(d.queries, 1)
+	if resp, negative, ok := d.cache.Get(header.ID, question); ok {
+		hits := atomic.AddUint64(d.hits, 1)
+		kind := dnsCacheHitPositive
+		if negative {
+			kind = dnsCacheHitNegative
+		}
+		metrics.IncrementDnsCacheHits(kind)
+		metrics.SetDnsCacheHitRatio(float64(hits) / float64(atomic.LoadUint64(d.queries)))
+		return truncateDnsResponse(resp, maxSize)
+	}
+	metrics.IncrementDnsCacheMisses()
+	metrics.SetDnsCacheHitRatio(float64(atomic.LoadUint64(d.hits)) / float64(atomic.LoadUint64(d.queries)))
+
+	route := dnsRouteLocal
+	if d.isTunnelZone(question.Name.String()) {
+		route = dnsRouteTunnel
+	}
+	metrics.IncrementDnsQueries(route)
+	log.Debugf("Resolving %s %s via %s", question.Name, question.Type, route)
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+	defer cancel()
+	var resp []byte
+	if route == dnsRouteTunnel {
+		resp, err = d.exchangeTunnel(ctx, query)
+	} else {
+		resp, err = d.exchangeLocal(ctx, query)
+	}
+	if err != nil {
+		log.Warnf("Error resolving %s via %s: %v", question.Name, route, err)
+		metrics.IncrementDnsErrors(route)
+		return dnsErrorResponse(header, &question, dnsmessage.RCodeServerFailure)
+	}
+	d.cache.Put(question, resp)
+	return truncateDnsResponse(resp, maxSize)
+}
+
+func (d *dnsProxy) isTunnelZone(name string) bool {
+	name = strings.ToLower(name)
+	for _, zone := range d.zones {
+		if zone == "." || name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dnsProxy) exchangeTunnel(ctx context.Context, query []byte) ([]byte, error) {
+	dnsDialer, ok := d.dialer.(DnsDialer)
+	if !ok {
+		return nil, fmt.Errorf("dialer does not support DNS resolution")
+	}
+	conn, err := dnsDialer.DialDns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeTCPDns(ctx, conn, query)
+}
+
+func (d *dnsProxy) exchangeLocal(ctx context.Context, query []byte) ([]byte, error) {
+	if d.upstream == "" {
+		return nil, fmt.Errorf("no local upstream configured")
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", d.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore responses not matching our query ID
+		if n < 2 || binary.BigEndian.Uint16(buf[:2]) != binary.BigEndian.Uint16(query[:2]) {
+			continue
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !header.Truncated {
+			resp := make([]byte, n)
+			copy(resp, buf[:n])
+			return resp, nil
+		}
+		break
+	}
+
+	// Response did not fit in UDP, retry over TCP
+	tcpConn, err := dialer.DialContext(ctx, "tcp", d.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	return exchangeTCPDns(ctx, tcpConn, query)
+}
+
+func exchangeTCPDns(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writeTCPDnsMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPDnsMessage(conn)
+}
+
+func readTCPDnsMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPDnsMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsUDPSize returns the max response size accepted by the client, from EDNS0 if present.
+func dnsUDPSize(parser *dnsmessage.Parser) int {
+	if err := parser.SkipAllQuestions(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return dnsMinUDPSize
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		return dnsMinUDPSize
+	}
+	for _, additional := range additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT && int(additional.Header.Class) > dnsMinUDPSize {
+			return int(additional.Header.Class)
+		}
+	}
+	return dnsMinUDPSize
+}
+
+// truncateDnsResponse replaces responses bigger than maxSize by an empty response with TC flag,
+// so the client retries over TCP.
+func truncateDnsResponse(resp []byte, maxSize int) []byte {
+	if len(resp) <= maxSize {
+		return resp
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return nil
+	}
+	header.Truncated = true
+	questions, _ := parser.AllQuestions()
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	builder.StartQuestions()
+	for _, q := range questions {
+		builder.Question(q)
+	}
+	truncated, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return truncated
+}
+
+func dnsErrorResponse(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.StartQuestions()
+	if question != nil {
+		builder.Question(*question)
+	}
+	resp, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheHitPositive = "positive"
+	dnsCacheHitNegative = "negative"
+)
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	msg      []byte
+	negative bool
+	stored   time.Time
+	expires  time.Time
+}
+
+// dnsCache is a LRU cache of packed DNS responses indexed by question.
+// Negative answers (NXDOMAIN and NODATA) are cached too, following RFC 2308.
+type dnsCache struct {
+	mu          sync.Mutex
+	size        int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	entries     map[dnsCacheKey]*list.Element
+	lru         *list.List
+	now         func() time.Time
+}
+
+func newDnsCache(size int, maxTTL, negativeTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		size:        size,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+		entries:     make(map[dnsCacheKey]*list.Element),
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+func newDnsCacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+	}
+}
+
+// Get returns a copy of the cached response for the question with the given id and the TTLs
+// decreased by the time the entry spent in the cache.
+func (c *dnsCache) Get(id uint16, q dnsmessage.Question) (msg []byte, negative bool, ok bool) {
+	if c.size <= 0 {
+		return nil, false, false
+	}
+	key := newDnsCacheKey(q)
+	now := c.now()
+
+	c.mu.Lock()
+	elem, found := c.entries[key]
+	if !found {
+		c.mu.Unlock()
+		return nil, false, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if !now.Before(entry.expires) {
+		c.removeElement(elem)
+		c.mu.Unlock()
+		return nil, false, false
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	var m dnsmessage.Message
+	if err := m.Unpack(entry.msg); err != nil {
+		return nil, false, false
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	m.Header.ID = id
+	for _, section := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if section[i].Header.TTL > elapsed {
+				section[i].Header.TTL -= elapsed
+			} else {
+				section[i].Header.TTL = 0
+			}
+		}
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, false, false
+	}
+	return packed, entry.negative, true
+}
+
+// Put stores the response if it is cacheable, the lifetime of the entry is the lowest TTL of the answer
+// or the SOA minimum for negative answers.
+func (c *dnsCache) Put(q dnsmessage.Question, msg []byte) {
+	if c.size <= 0 {
+		return
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return
+	}
+	if m.Header.Truncated {
+		return
+	}
+
+	var ttl time.Duration
+	negative := false
+	switch {
+	case m.Header.RCode == dnsmessage.RCodeSuccess && len(m.Answers) > 0:
+		ttl = minResourceTTL(m.Answers)
+	case m.Header.RCode == dnsmessage.RCodeNameError || m.Header.RCode == dnsmessage.RCodeSuccess:
+		negative = true
+		ttl = c.negativeTTL
+		for _, authority := range m.Authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				ttl = time.Duration(authority.Header.TTL) * time.Second
+				if soaMin := time.Duration(soa.MinTTL) * time.Second; soaMin < ttl {
+					ttl = soaMin
+				}
+				if c.negativeTTL > 0 && c.negativeTTL < ttl {
+					ttl = c.negativeTTL
+				}
+				break
+			}
+		}
+	default:
+		// SERVFAIL, REFUSED... are not cached
+		return
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := c.now()
+	entry := &dnsCacheEntry{
+		key:      newDnsCacheKey(q),
+		msg:      msg,
+		negative: negative,
+		stored:   now,
+		expires:  now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[entry.key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *dnsCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *dnsCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*dnsCacheEntry)
+	delete(c.entries, entry.key)
+}
+
+func minResourceTTL(resources []dnsmessage.Resource) time.Duration {
+	var minTTL uint32
+	for i, resource := range resources {
+		if i == 0 || resource.Header.TTL < minTTL {
+			minTTL = resource.Header.TTL
+		}
+	}
+	return time.Duration(minTTL) * time.Second
+}
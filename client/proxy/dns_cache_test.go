@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildDnsResponse(t *testing.T, q dnsmessage.Question, rcode dnsmessage.RCode, answerTTL uint32, soaTTL uint32) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true, RCode: rcode})
+	assert.NoError(t, builder.StartQuestions())
+	assert.NoError(t, builder.Question(q))
+	if answerTTL > 0 {
+		assert.NoError(t, builder.StartAnswers())
+		assert.NoError(t, builder.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: answerTTL}, dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}))
+	}
+	if soaTTL > 0 {
+		assert.NoError(t, builder.StartAuthorities())
+		assert.NoError(t, builder.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("corp."), Class: q.Class, TTL: soaTTL}, dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.corp."),
+			MBox:   dnsmessage.MustNewName("admin.corp."),
+			MinTTL: 30,
+		}))
+	}
+	msg, err := builder.Finish()
+	assert.NoError(t, err)
+	return msg
+}
+
+func TestDnsCachePositive(t *testing.T) {
+	now := time.Now()
+	cache := newDnsCache(10, time.Hour, time.Minute)
+	cache.now = func() time.Time { return now }
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("db.corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	_, _, ok := cache.Get(7, q)
+	assert.False(t, ok)
+
+	cache.Put(q, buildDnsResponse(t, q, dnsmessage.RCodeSuccess, 60, 0))
+	now = now.Add(20 * time.Second)
+	upperQ := q
+	upperQ.Name = dnsmessage.MustNewName("DB.corp.")
+	resp, negative, ok := cache.Get(7, upperQ)
+	assert.True(t, ok)
+	assert.False(t, negative)
+
+	var m dnsmessage.Message
+	assert.NoError(t, m.Unpack(resp))
+	assert.Equal(t, uint16(7), m.Header.ID)
+	assert.Equal(t, uint32(40), m.Answers[0].Header.TTL)
+
+	now = now.Add(time.Minute)
+	_, _, ok = cache.Get(7, q)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestDnsCacheNegative(t *testing.T) {
+	cache := newDnsCache(10, time.Hour, time.Minute)
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("missing.corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	cache.Put(q, buildDnsResponse(t, q, dnsmessage.RCodeNameError, 0, 300))
+	_, negative, ok := cache.Get(1, q)
+	assert.True(t, ok)
+	assert.True(t, negative)
+	// SOA minimum wins over the SOA record TTL
+	elem := cache.entries[newDnsCacheKey(q)]
+	entry := elem.Value.(*dnsCacheEntry)
+	assert.Equal(t, 30*time.Second, entry.expires.Sub(entry.stored))
+
+	failQ := dnsmessage.Question{Name: dnsmessage.MustNewName("fail.corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	cache.Put(failQ, buildDnsResponse(t, failQ, dnsmessage.RCodeServerFailure, 0, 0))
+	_, _, ok = cache.Get(1, failQ)
+	assert.False(t, ok)
+}
+
+func TestDnsCacheEviction(t *testing.T) {
+	cache := newDnsCache(2, time.Hour, time.Minute)
+	names := []string{"a.corp.", "b.corp.", "c.corp."}
+	for _, name := range names {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+		cache.Put(q, buildDnsResponse(t, q, dnsmessage.RCodeSuccess, 60, 0))
+	}
+	assert.Equal(t, 2, cache.Len())
+	_, _, ok := cache.Get(1, dnsmessage.Question{Name: dnsmessage.MustNewName("a.corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	assert.False(t, ok)
+}
@@ -2,9 +2,10 @@ package proxy
 
 import (
 	"context"
-	"fmt"
+	"edgeproxy/config"
 	"github.com/elazarl/goproxy"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 )
 
@@ -14,7 +15,7 @@ type HTTPProxy struct {
 	srv   *http.Server
 }
 
-func NewHttpProxy(ctx context.Context, proxyDialer Dialer, proxyPort int) Proxy {
+func NewHttpProxy(ctx context.Context, proxyDialer Dialer, listenAddr string) Proxy {
 	proxy := goproxy.NewProxyHttpServer()
 	/*	proxy.OnRequest(goproxy.UrlIs("ifconfig.me")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		fmt.Printf("asd")
@@ -27,7 +28,7 @@ func NewHttpProxy(ctx context.Context, proxyDialer Dialer, proxyPort int) Proxy
 		ctx:   ctx,
 		proxy: proxy,
 		srv: &http.Server{
-			Addr:    fmt.Sprintf(":%d", proxyPort),
+			Addr:    listenAddr,
 			Handler: proxy,
 		},
 	}
@@ -38,7 +39,11 @@ func (h *HTTPProxy) Start() {
 
 	go func() {
 		log.Infof("Starting HTTP Proxy at Addr %s", h.srv.Addr)
-		err := h.srv.ListenAndServe()
+		listener, err := net.Listen(config.ListenNetwork("tcp", h.srv.Addr), h.srv.Addr)
+		if err != nil {
+			log.Fatalf("Http Proxy Client Listen failure: %v", err)
+		}
+		err = h.srv.Serve(listener)
 		if err != http.ErrServerClosed {
 			log.Fatalf("Http Proxy Client Listen failure: %v", err)
 		}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net"
 )
@@ -26,10 +27,29 @@ func (d *lbDialer) Dial(network string, addr string) (net.Conn, error) {
 	return d.getDialer().Dial(network, addr)
 }
 
+func (d *lbDialer) DialDns(ctx context.Context) (net.Conn, error) {
+	dnsDialer, ok := d.getDialer().(DnsDialer)
+	if !ok {
+		return nil, fmt.Errorf("dialer does not support DNS resolution")
+	}
+	return dnsDialer.DialDns(ctx)
+}
+
+// healthDialer is implemented by dialers able to report if their tunnel is up
+type healthDialer interface {
+	Healthy() bool
+}
+
 func (d *lbDialer) getDialer() Dialer {
-	selectedDialer := 0
-	if len(d.dialers) > 1 {
-		selectedDialer = rand.Intn(len(d.dialers) - 1)
+	var healthy []Dialer
+	for _, dialer := range d.dialers {
+		if hd, ok := dialer.(healthDialer); !ok || hd.Healthy() {
+			healthy = append(healthy, dialer)
+		}
+	}
+	// When all the tunnels are down we let the dialer decide whether to wait or fail fast
+	if len(healthy) == 0 {
+		healthy = d.dialers
 	}
-	return d.dialers[selectedDialer]
+	return healthy[rand.Intn(len(healthy))]
 }
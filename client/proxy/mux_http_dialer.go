@@ -3,42 +3,50 @@ package proxy
 import (
 	"context"
 	"edgeproxy/client/clientauth"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
 	"edgeproxy/stream"
 	"edgeproxy/transport"
 	"fmt"
 	"github.com/hashicorp/yamux"
-	"github.com/recws-org/recws"
+	"github.com/jpillora/backoff"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type muxHttpDialer struct {
 	io.ReadWriteCloser
-	rw             sync.RWMutex
-	endpoint       *url.URL
-	authenticator  clientauth.Authenticator
-	ctx            context.Context
-	muxSession     *yamux.Session
-	ws             recws.RecConn
-	forceReconnect chan uint8
-	yamuxConfig    *yamux.Config
+	rw              sync.RWMutex
+	endpoint        *url.URL
+	authenticator   clientauth.Authenticator
+	ctx             context.Context
+	muxSession      *yamux.Session
+	forceReconnect  chan uint8
+	yamuxConfig     *yamux.Config
+	reconnectConfig config.ReconnectConfig
+	breaker         *circuitBreaker
+	reconnecting    int32
+	dialOptions     *stream.DialOptions
+	rotationTimer   *time.Timer
+	// rotationBackoff spaces the retries of a failed credentials rotation, like the reconnections
+	rotationBackoff *backoff.Backoff
+	tokenBinding    clientauth.TokenBinding
+	// forwardStatus are the sessions whose server answers each forward with a status
+	forwardStatus map[*yamux.Session]bool
 }
 
-func NewMuxHTTPDialer(ctx context.Context, endpoint string, authenticator clientauth.Authenticator) (*muxHttpDialer, error) {
+func NewMuxHTTPDialer(ctx context.Context, endpoint string, authenticator clientauth.Authenticator, reconnectConfig config.ReconnectConfig, dialOptions *stream.DialOptions) (*muxHttpDialer, error) {
 	endpointUrl, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	ws := recws.RecConn{
-		KeepAliveTimeout: 10 * time.Second,
-	}
-
 	yamuxConfig := &yamux.Config{
 		AcceptBacklog:          256,
 		EnableKeepAlive:        true,
@@ -51,14 +59,19 @@ func NewMuxHTTPDialer(ctx context.Context, endpoint string, authenticator client
 	}
 
 	wssMux := &muxHttpDialer{
-		ctx:            ctx,
-		rw:             sync.RWMutex{},
-		endpoint:       endpointUrl,
-		authenticator:  authenticator,
-		ws:             ws,
-		yamuxConfig:    yamuxConfig,
-		forceReconnect: make(chan uint8, 2),
+		ctx:             ctx,
+		rw:              sync.RWMutex{},
+		endpoint:        endpointUrl,
+		authenticator:   authenticator,
+		yamuxConfig:     yamuxConfig,
+		forceReconnect:  make(chan uint8, 2),
+		reconnectConfig: reconnectConfig,
+		breaker:         newCircuitBreaker(endpointUrl.String(), reconnectConfig.BreakerThreshold),
+		dialOptions:     dialOptions,
+		tokenBinding:    newTokenBinding(endpointUrl, dialOptions),
+		forwardStatus:   map[*yamux.Session]bool{},
 	}
+	wssMux.rotationBackoff = wssMux.newBackoff()
 
 	err = wssMux.initializeConnection()
 	if err != nil {
@@ -69,14 +82,34 @@ func NewMuxHTTPDialer(ctx context.Context, endpoint string, authenticator client
 	return wssMux, nil
 }
 
-func (d *muxHttpDialer) OpenMuxConnection() (net.Conn, error) {
-	conn, err := d.muxSession.Open()
-	if err != nil {
-		//We wait 5 seconds for reconnection, in case is not capable to get new connection we finally fail
-		<-time.After(time.Second * 5)
-		return d.muxSession.Open()
+func (d *muxHttpDialer) session() *yamux.Session {
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	return d.muxSession
+}
+
+func (d *muxHttpDialer) OpenMuxConnection(ctx context.Context) (net.Conn, error) {
+	// Wait for the reconnection, or fail fast if the tunnel is known to be down
+	if d.breaker.State() != breakerClosed {
+		if err := d.breaker.Wait(ctx, d.reconnectConfig.DialTimeout); err != nil {
+			return nil, err
+		}
 	}
-	return conn, nil
+	conn, err := d.session().Open()
+	if err == nil {
+		return conn, nil
+	}
+	log.Debugf("Error opening mux connection, waiting for reconnection: %v", err)
+	d.triggerReconnect()
+	if err = d.breaker.Wait(ctx, d.reconnectConfig.DialTimeout); err != nil {
+		return nil, err
+	}
+	return d.session().Open()
+}
+
+// Healthy reports if the tunnel is up, used to skip broken tunnels when balancing
+func (d *muxHttpDialer) Healthy() bool {
+	return d.breaker.State() == breakerClosed
 }
 
 func (d *muxHttpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -84,7 +117,7 @@ func (d *muxHttpDialer) DialContext(ctx context.Context, network, addr string) (
 	if err != nil {
 		return nil, fmt.Errorf("not Support %s network", network)
 	}
-	conn, err := d.OpenMuxConnection()
+	conn, err := d.OpenMuxConnection(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -104,10 +137,52 @@ func (d *muxHttpDialer) DialContext(ctx context.Context, network, addr string) (
 	if err != nil {
 		return nil, fmt.Errorf("error when Writting Forward Frame: %v", err)
 	}
+	// the server tells if the forward was denied, exceeded a quota or failed to connect
+	if d.readsForwardStatus(conn) {
+		if err = transport.ReadForwardStatus(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
 	return conn, nil
 }
 
+// readsForwardStatus reports if the session of the stream confirmed it answers forwards with a status
+func (d *muxHttpDialer) readsForwardStatus(conn net.Conn) bool {
+	muxStream, ok := conn.(*yamux.Stream)
+	if !ok {
+		return false
+	}
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	return d.forwardStatus[muxStream.Session()]
+}
+
+func (d *muxHttpDialer) DialDns(ctx context.Context) (net.Conn, error) {
+	conn, err := d.OpenMuxConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	_, err = conn.Write(transport.NewDnsFrame())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error when Writting DNS Frame: %v", err)
+	}
+	// DNS forwards are denied or exceed the quotas like the other forwards
+	if d.readsForwardStatus(conn) {
+		if err = transport.ReadForwardStatus(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
 func (d *muxHttpDialer) Dial(network string, addr string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, addr)
 }
@@ -116,35 +191,151 @@ func (d *muxHttpDialer) initializeConnection() error {
 	log.Infof("Connecting to tunnel endpoint %s", d.endpoint)
 	headers := http.Header{}
 	headers.Add(transport.HeaderMuxerType, string(transport.YamuxMuxer))
+	headers.Add(transport.HeaderForwardStatus, "1")
 	if d.authenticator != nil {
-		d.authenticator.AddAuthenticationHeaders(&headers)
+		if err := clientauth.AddAuthenticationHeaders(d.authenticator, &headers, d.tokenBinding); err != nil {
+			return fmt.Errorf("error getting tunnel credentials: %v", err)
+		}
 	}
 	var conn io.ReadWriteCloser
-	conn, err := stream.NewHttpBiStreamConnFromEndpoint(d.ctx, d.endpoint, headers)
+	conn, err := stream.NewHttpBiStreamConnFromEndpoint(d.ctx, d.endpoint, headers, d.dialOptions)
 	if err != nil {
 		return err
 	}
 
 	session, err := yamux.Client(conn, d.yamuxConfig)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
-	//Close old connection if exists
-	if d.muxSession != nil {
-		d.muxSession.Close()
-	}
-
-	if d.ReadWriteCloser != nil {
-		d.ReadWriteCloser.Close()
+	// servers not confirming the forward status close the denied streams without telling why
+	forwardStatus := false
+	if responseConn, ok := conn.(stream.ResponseHeaderConn); ok {
+		forwardStatus = responseConn.ResponseHeader().Get(transport.HeaderForwardStatus) != ""
 	}
 
+	d.rw.Lock()
+	oldSession := d.muxSession
 	//Assign new
 	d.ReadWriteCloser = conn
 	d.muxSession = session
+	d.forwardStatus[session] = forwardStatus
+	d.rw.Unlock()
 	log.Infof("Connected to tunnel %s", d.endpoint)
+
+	//Close old connection if exists, once its streams are done
+	if oldSession != nil {
+		go d.drainSession(oldSession)
+	}
+	if expiring, ok := d.authenticator.(clientauth.ExpiringAuthenticator); ok {
+		d.scheduleRotation(expiring.CredentialExpiry())
+	}
 	return nil
 }
+
+// drainSession closes a replaced session after its streams finish, or when they time out
+func (d *muxHttpDialer) drainSession(session *yamux.Session) {
+	deadline := time.Now().Add(d.yamuxConfig.StreamCloseTimeout)
+	for !session.IsClosed() && session.NumStreams() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-d.ctx.Done():
+			deadline = time.Now()
+		case <-time.After(time.Second):
+		}
+	}
+	session.Close()
+	d.rw.Lock()
+	delete(d.forwardStatus, session)
+	d.rw.Unlock()
+}
+
+// scheduleRotation reconnects the tunnel with fresh credentials before the current ones expire.
+// Half of the remaining lifetime is waited at least, so short lived credentials don't reconnect in a loop.
+func (d *muxHttpDialer) scheduleRotation(expiry time.Time) {
+	if expiry.IsZero() {
+		return
+	}
+	remaining := time.Until(expiry)
+	wait := remaining - clientauth.CredentialRenewBefore
+	if wait < remaining/2 {
+		wait = remaining / 2
+	}
+	d.rw.Lock()
+	defer d.rw.Unlock()
+	if d.rotationTimer != nil {
+		d.rotationTimer.Stop()
+	}
+	log.Debugf("Tunnel credentials expire at %s, reconnecting in %s", expiry, wait)
+	d.rotationTimer = time.AfterFunc(wait, d.rotate)
+}
+
+func (d *muxHttpDialer) rotate() {
+	if d.ctx.Err() != nil {
+		return
+	}
+	// A running reconnection already opens the tunnel with fresh credentials
+	if !atomic.CompareAndSwapInt32(&d.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&d.reconnecting, 0)
+	// Refresh the credentials in-band so streams are not dropped, servers not supporting it close the stream
+	err := d.reauthenticate()
+	if err == nil {
+		log.Debugf("Tunnel credentials refreshed on %s", d.endpoint)
+		d.rotationBackoff.Reset()
+		d.scheduleRotation(d.authenticator.(clientauth.ExpiringAuthenticator).CredentialExpiry())
+		return
+	}
+	log.Infof("Tunnel credentials about to expire, reconnecting to %s: %v", d.endpoint, err)
+	if err := d.initializeConnection(); err != nil {
+		metrics.IncrementTunnelReconnectAttempts("failure")
+		// dials keep using the current session until it's lost, only then the failures count on the breaker
+		if d.session().IsClosed() {
+			d.breaker.Failure()
+		}
+		wait := d.rotationBackoff.Duration()
+		log.Warnf("Failed to reconnect with fresh credentials: %v, retrying in %s", err, wait)
+		d.rw.Lock()
+		d.rotationTimer = time.AfterFunc(wait, d.rotate)
+		d.rw.Unlock()
+		return
+	}
+	metrics.IncrementTunnelReconnectAttempts("success")
+	d.breaker.Success()
+	d.rotationBackoff.Reset()
+}
+
+// reauthenticate sends fresh credentials on the current session
+func (d *muxHttpDialer) reauthenticate() error {
+	headers := http.Header{}
+	if err := clientauth.AddAuthenticationHeaders(d.authenticator, &headers, d.tokenBinding); err != nil {
+		return fmt.Errorf("error getting tunnel credentials: %v", err)
+	}
+	conn, err := d.session().Open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.yamuxConfig.ConnectionWriteTimeout))
+	f, reauth := transport.NewReauthenticateFrame(headers)
+	if _, err = conn.Write(f); err != nil {
+		return fmt.Errorf("error when Writting Proto Frame: %v", err)
+	}
+	if _, err = conn.Write(reauth); err != nil {
+		return fmt.Errorf("error when Writting Reauthenticate Frame: %v", err)
+	}
+	return transport.ReadReauthenticateStatus(conn)
+}
+
+func (d *muxHttpDialer) triggerReconnect() {
+	select {
+	case d.forceReconnect <- 0:
+	default:
+		// a reconnection is already queued
+	}
+}
+
 func (d *muxHttpDialer) monitorConnection() {
 	for {
 		select {
@@ -157,34 +348,60 @@ func (d *muxHttpDialer) monitorConnection() {
 }
 
 func (d *muxHttpDialer) reconnect() bool {
-	d.rw.Lock()
-	defer d.rw.Unlock()
+	// Only one reconnection loop at a time, the lock is not held while waiting so dials are not blocked
+	if !atomic.CompareAndSwapInt32(&d.reconnecting, 0, 1) {
+		return false
+	}
+	defer atomic.StoreInt32(&d.reconnecting, 0)
+
 	//Before Reconnect we double check if connection is broken
-	_, err := d.muxSession.Ping()
-	if err != nil {
-		for {
-			log.Warnf("Tunnel connection lost, reconnecting...")
-			err := d.initializeConnection()
-			if err != nil {
-				log.Warnf("Failed on Reconnection: %v", err)
-				<-time.After(time.Second * 5)
-				continue
-			}
+	if _, err := d.session().Ping(); err == nil {
+		d.breaker.Success()
+		return false
+	}
+	d.breaker.Trip()
+	b := d.newBackoff()
+	for {
+		log.Warnf("Tunnel connection lost, reconnecting...")
+		err := d.initializeConnection()
+		if err == nil {
+			metrics.IncrementTunnelReconnectAttempts("success")
+			d.breaker.Success()
 			return true
 		}
+		metrics.IncrementTunnelReconnectAttempts("failure")
+		d.breaker.Failure()
+		wait := b.Duration()
+		log.Warnf("Failed on Reconnection: %v, retrying in %s", err, wait)
+		select {
+		case <-d.ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
 	}
-	return false
 }
+
+// newBackoff is the backoff between reconnection attempts
+func (d *muxHttpDialer) newBackoff() *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    d.reconnectConfig.InitialInterval,
+		Max:    d.reconnectConfig.MaxInterval,
+		Factor: d.reconnectConfig.Multiplier,
+		Jitter: d.reconnectConfig.Jitter,
+	}
+}
+
 func (d *muxHttpDialer) keepAlive() {
 	for {
 		select {
 		case <-d.ctx.Done():
 			return
 		case <-time.After(time.Second * 5):
-			log.Debugf("Yamux Num Streams %d", d.muxSession.NumStreams())
-			t, err := d.muxSession.Ping()
+			session := d.session()
+			log.Debugf("Yamux Num Streams %d", session.NumStreams())
+			t, err := session.Ping()
 			if err != nil {
-				d.forceReconnect <- 0
+				d.triggerReconnect()
 			} else {
 				log.Debugf("yamux ping: ms %d", t.Milliseconds())
 			}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"edgeproxy/client/clientauth"
 	"edgeproxy/stream"
 	"edgeproxy/transport"
@@ -16,9 +17,20 @@ type httpDialer struct {
 	net.Conn
 	Endpoint      *url.URL
 	Authenticator clientauth.Authenticator
+	DialOptions   *stream.DialOptions
+	TokenBinding  clientauth.TokenBinding
 }
 
-func NewNoMuxHttpDialer(ctx context.Context, endpoint string, authenticator clientauth.Authenticator) (*httpDialer, error) {
+// newTokenBinding binds the client tokens to the tunnel endpoint and the TLS client certificate
+func newTokenBinding(endpoint *url.URL, dialOptions *stream.DialOptions) clientauth.TokenBinding {
+	var tlsConfig *tls.Config
+	if dialOptions != nil {
+		tlsConfig = dialOptions.TLSConfig
+	}
+	return clientauth.NewTokenBinding(endpoint, tlsConfig)
+}
+
+func NewNoMuxHttpDialer(ctx context.Context, endpoint string, authenticator clientauth.Authenticator, dialOptions *stream.DialOptions) (*httpDialer, error) {
 	endpointUrl, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -26,6 +38,8 @@ func NewNoMuxHttpDialer(ctx context.Context, endpoint string, authenticator clie
 	return &httpDialer{
 		Endpoint:      endpointUrl,
 		Authenticator: authenticator,
+		DialOptions:   dialOptions,
+		TokenBinding:  newTokenBinding(endpointUrl, dialOptions),
 	}, nil
 }
 
@@ -41,9 +55,24 @@ func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (net
 	headers.Add(transport.HeaderMuxerType, string(transport.HttpNoMuxer))
 	headers.Add(transport.HeaderRouterAction, transport.ConnectionForwardRouterAction.String())
 	if d.Authenticator != nil {
-		d.Authenticator.AddAuthenticationHeaders(&headers)
+		if err := clientauth.AddAuthenticationHeaders(d.Authenticator, &headers, d.TokenBinding); err != nil {
+			return nil, fmt.Errorf("error getting tunnel credentials: %v", err)
+		}
+	}
+	return stream.NewHttpBiStreamConnFromEndpoint(ctx, d.Endpoint, headers, d.DialOptions)
+}
+
+func (d *httpDialer) DialDns(ctx context.Context) (net.Conn, error) {
+	log.Debugf("Connecting to tunnel endpoint %s, Forwarding DNS", d.Endpoint.String())
+	headers := http.Header{}
+	headers.Add(transport.HeaderMuxerType, string(transport.HttpNoMuxer))
+	headers.Add(transport.HeaderRouterAction, transport.DnsResolveRouterAction.String())
+	if d.Authenticator != nil {
+		if err := clientauth.AddAuthenticationHeaders(d.Authenticator, &headers, d.TokenBinding); err != nil {
+			return nil, fmt.Errorf("error getting tunnel credentials: %v", err)
+		}
 	}
-	return stream.NewHttpBiStreamConnFromEndpoint(ctx, d.Endpoint, headers)
+	return stream.NewHttpBiStreamConnFromEndpoint(ctx, d.Endpoint, headers, d.DialOptions)
 }
 
 func (d *httpDialer) Dial(network string, addr string) (net.Conn, error) {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"edgeproxy/config"
 	"edgeproxy/stream"
-	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
@@ -15,7 +14,9 @@ type portForwarding struct {
 	ctx                   context.Context
 	portForwardingMapping []config.PortForwardingMapping
 	dialer                Dialer
+	bindAddress           string
 	runningListeners      []*listenerPortForwardingMapping
+	dialOptions           *stream.DialOptions
 }
 
 type listenerPortForwardingMapping struct {
@@ -23,11 +24,13 @@ type listenerPortForwardingMapping struct {
 	listener net.Listener
 }
 
-func NewPortForwarding(ctx context.Context, dialer Dialer, portForwardingMapping []config.PortForwardingMapping) *portForwarding {
+func NewPortForwarding(ctx context.Context, dialer Dialer, portForwardingMapping []config.PortForwardingMapping, bindAddress string, dialOptions *stream.DialOptions) *portForwarding {
 	portForwarding := &portForwarding{
 		ctx:                   ctx,
 		portForwardingMapping: portForwardingMapping,
 		dialer:                dialer,
+		bindAddress:           bindAddress,
+		dialOptions:           dialOptions,
 	}
 	return portForwarding
 
@@ -35,11 +38,11 @@ func NewPortForwarding(ctx context.Context, dialer Dialer, portForwardingMapping
 
 func (t *portForwarding) Start() {
 	for _, mapping := range t.portForwardingMapping {
-		localAddr := fmt.Sprintf(":%d", mapping.ListenPort)
+		localAddr := mapping.ListenAddress(t.bindAddress)
 		log.Infof("Starting Port Forwarding: %s", mapping.String())
-		listener, err := net.Listen(mapping.Network, localAddr)
+		listener, err := net.Listen(config.ListenNetwork(mapping.Network, localAddr), localAddr)
 		if err != nil {
-			log.Fatalf("Error when listening port %d: %v", mapping.ListenPort, err)
+			log.Fatalf("Error when listening %s: %v", localAddr, err)
 		}
 		listenerMapping := &listenerPortForwardingMapping{
 			PortForwardingMapping: mapping,
@@ -72,7 +75,7 @@ func (t *portForwarding) acceptSocketConnection(listener net.Listener, endpoint
 
 func (t *portForwarding) handleSocketConnection(originConn net.Conn, endpoint *url.URL) error {
 	defer originConn.Close()
-	tunnelConn, err := stream.NewWebsocketConnFromEndpoint(context.Background(), endpoint, nil)
+	tunnelConn, err := stream.NewWebsocketConnFromEndpoint(context.Background(), endpoint, nil, t.dialOptions)
 	if err != nil {
 		return err
 	}
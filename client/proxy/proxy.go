@@ -11,6 +11,12 @@ type Dialer interface {
 	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
+// DnsDialer opens a stream to the DNS resolver selected by the tunnel server.
+// The stream carries DNS messages using TCP framing.
+type DnsDialer interface {
+	DialDns(ctx context.Context) (net.Conn, error)
+}
+
 type Proxy interface {
 	Start()
 	Stop()
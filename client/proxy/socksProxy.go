@@ -2,7 +2,7 @@ package proxy
 
 import (
 	"context"
-	"fmt"
+	"edgeproxy/config"
 	"github.com/armon/go-socks5"
 	log "github.com/sirupsen/logrus"
 	"net/http"
@@ -14,7 +14,7 @@ type SocksProxy struct {
 	addr string
 }
 
-func NewSocksProxy(ctx context.Context, proxyDialer Dialer, socksPort int) Proxy {
+func NewSocksProxy(ctx context.Context, proxyDialer Dialer, listenAddr string) Proxy {
 	conf := &socks5.Config{
 		Rules: socks5.PermitAll(),
 		//Resolver: nil, //Custom Domain Resolution on the cloud side?
@@ -27,7 +27,7 @@ func NewSocksProxy(ctx context.Context, proxyDialer Dialer, socksPort int) Proxy
 	sockProxy := &SocksProxy{
 		ctx:  ctx,
 		srv:  server,
-		addr: fmt.Sprintf(":%d", socksPort),
+		addr: listenAddr,
 	}
 	return sockProxy
 }
@@ -36,7 +36,7 @@ func (s *SocksProxy) Start() {
 
 	go func() {
 		log.Infof("Starting Socks Proxy at Addr %s", s.addr)
-		err := s.srv.ListenAndServe("tcp", s.addr)
+		err := s.srv.ListenAndServe(config.ListenNetwork("tcp", s.addr), s.addr)
 		if err != http.ErrServerClosed {
 			log.Fatalf("Socks Proxy Client Listen failure: %v", err)
 		}
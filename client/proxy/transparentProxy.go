@@ -4,7 +4,6 @@ import (
 	"context"
 	"edgeproxy/config"
 	"edgeproxy/stream"
-	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
 )
@@ -13,6 +12,7 @@ type transparentProxy struct {
 	ctx                      context.Context
 	transparentProxyMappings []config.TransparentProxyMapping
 	dialer                   Dialer
+	bindAddress              string
 	runningListeners         []*listenerTransparentProxyMapping
 }
 
@@ -21,11 +21,12 @@ type listenerTransparentProxyMapping struct {
 	listener net.Listener
 }
 
-func NewTransparentProxy(ctx context.Context, dialer Dialer, transparentProxyMappings []config.TransparentProxyMapping) Proxy {
+func NewTransparentProxy(ctx context.Context, dialer Dialer, transparentProxyMappings []config.TransparentProxyMapping, bindAddress string) Proxy {
 	transparentProxy := &transparentProxy{
 		ctx:                      ctx,
 		transparentProxyMappings: transparentProxyMappings,
 		dialer:                   dialer,
+		bindAddress:              bindAddress,
 	}
 	return transparentProxy
 
@@ -33,11 +34,11 @@ func NewTransparentProxy(ctx context.Context, dialer Dialer, transparentProxyMap
 
 func (t *transparentProxy) Start() {
 	for _, mapping := range t.transparentProxyMappings {
-		localAddr := fmt.Sprintf(":%d", mapping.ListenPort)
+		localAddr := mapping.ListenAddress(t.bindAddress)
 		log.Infof("Starting Transparent Proxy: %s", mapping.String())
-		listener, err := net.Listen("tcp", localAddr)
+		listener, err := net.Listen(config.ListenNetwork("tcp", localAddr), localAddr)
 		if err != nil {
-			log.Fatalf("Error when listening port %d: %v", mapping.ListenPort, err)
+			log.Fatalf("Error when listening %s: %v", localAddr, err)
 		}
 		listenerMapping := &listenerTransparentProxyMapping{
 			TransparentProxyMapping: mapping,
@@ -50,7 +51,7 @@ func (t *transparentProxy) Start() {
 
 func (s *transparentProxy) Stop() {
 	for _, listenerMapping := range s.runningListeners {
-		log.Infof("Stopping Transparent Proxy %s --> %s:%d", listenerMapping.listener.Addr(), listenerMapping.DestinationHost, listenerMapping.DestinationPort)
+		log.Infof("Stopping Transparent Proxy %s --> %s", listenerMapping.listener.Addr(), listenerMapping.DestinationAddr())
 		if err := listenerMapping.listener.Close(); err != nil {
 			log.Errorf("Error closing Listener %s", listenerMapping.listener.Addr().String())
 		}
@@ -58,7 +59,7 @@ func (s *transparentProxy) Stop() {
 }
 
 func (t *transparentProxy) serve(listener net.Listener, mapping *listenerTransparentProxyMapping) {
-	destinationAddr := fmt.Sprintf("%s:%d", mapping.DestinationHost, mapping.DestinationPort)
+	destinationAddr := mapping.DestinationAddr()
 	for {
 		//TODO How we stop this gracefully?
 		originConn, err := listener.Accept()
@@ -6,11 +6,20 @@ import (
 )
 
 type PortForwardingMapping struct {
-	ListenPort int
-	Network    string
-	Endpoint   *url.URL
+	BindAddress string
+	ListenPort  int
+	Network     string
+	Endpoint    *url.URL
+}
+
+// ListenAddress is the local address of the mapping, bindAddress applies when the mapping has none
+func (mapping PortForwardingMapping) ListenAddress(bindAddress string) string {
+	if mapping.BindAddress != "" {
+		bindAddress = mapping.BindAddress
+	}
+	return ListenAddress(bindAddress, mapping.ListenPort)
 }
 
 func (mapping PortForwardingMapping) String() string {
-	return fmt.Sprintf("%d:%s:%s", mapping.ListenPort, mapping.Network, mapping.Endpoint.String())
+	return fmt.Sprintf("%s:%s:%s", mapping.ListenAddress(""), mapping.Network, mapping.Endpoint.String())
 }
@@ -1,14 +1,32 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
 
 type TransparentProxyMapping struct {
+	BindAddress     string
 	ListenPort      int
 	Network         string
 	DestinationHost string
 	DestinationPort int
 }
 
+// ListenAddress is the local address of the mapping, bindAddress applies when the mapping has none
+func (mapping TransparentProxyMapping) ListenAddress(bindAddress string) string {
+	if mapping.BindAddress != "" {
+		bindAddress = mapping.BindAddress
+	}
+	return ListenAddress(bindAddress, mapping.ListenPort)
+}
+
+// DestinationAddr is the mapping destination, IPv6 hosts are bracketed
+func (mapping TransparentProxyMapping) DestinationAddr() string {
+	return net.JoinHostPort(mapping.DestinationHost, strconv.Itoa(mapping.DestinationPort))
+}
+
 func (mapping TransparentProxyMapping) String() string {
-	return fmt.Sprintf("%d:%s:%s:%d", mapping.ListenPort, mapping.Network, mapping.DestinationHost, mapping.DestinationPort)
+	return fmt.Sprintf("%s:%s:%s", mapping.ListenAddress(""), mapping.Network, mapping.DestinationAddr())
 }
@@ -9,9 +9,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type TransportType string
+type CertificateAuthMode string
 type TransparentProxyMappingList []TransparentProxyMapping
 type PortForwardingMappingList []PortForwardingMapping
 
@@ -22,6 +24,18 @@ const (
 	WireguardTransport TransportType = "WireguardTransport"
 	UdpTransport       TransportType = "UDPTransport"
 	QuickTransport     TransportType = "QUICKTransport"
+
+	// HeaderCertificateAuthMode client certificate is sent in the X-Client-Certificate header, when TLS is terminated by a WAF
+	HeaderCertificateAuthMode CertificateAuthMode = "header"
+	// MtlsCertificateAuthMode client certificate is validated from the TLS handshake
+	MtlsCertificateAuthMode CertificateAuthMode = "mtls"
+	// AnyCertificateAuthMode uses the TLS client certificate if present, otherwise the header
+	AnyCertificateAuthMode CertificateAuthMode = "any"
+
+	// Server authenticator names used on authenticator chains
+	CertificateAuthenticator = "certificate"
+	OidcAuthenticator        = "oidc"
+	CfAccessAuthenticator    = "cfAccess"
 )
 
 func (t *TransportType) String() string {
@@ -46,11 +60,14 @@ func (t *TransparentProxyMappingList) String() string {
 }
 
 func (t *TransparentProxyMappingList) Set(s string) (err error) {
-	//5000#TCP#1.1.1.1:5000
+	//5000#TCP#1.1.1.1:5000, [::1]:5000#TCP#[2001:db8::1]:5000
 	var portString string
 	transparentProxy := TransparentProxyMapping{}
 	transparentProxyString := strings.Split(s, "#")
-	transparentProxy.ListenPort, err = strconv.Atoi(transparentProxyString[0])
+	if len(transparentProxyString) != 3 {
+		return fmt.Errorf("invalid Format for Transparent Proxy Mapping: %s, expected listen#network#destination", s)
+	}
+	transparentProxy.BindAddress, transparentProxy.ListenPort, err = parseListenAddress(transparentProxyString[0])
 	if err != nil {
 		return fmt.Errorf("invalid Format for Transparent Proxy Mapping: %s, %v", s, err)
 	}
@@ -81,11 +98,14 @@ func (t *PortForwardingMappingList) String() string {
 }
 
 func (t *PortForwardingMappingList) Set(s string) (err error) {
-	//5000#TCP#wss://myendpoint:443
+	//5000#TCP#wss://myendpoint:443, [::1]:5000#TCP#wss://myendpoint:443
 
 	portForwardingMapping := PortForwardingMapping{}
 	transparentProxyString := strings.Split(s, "#")
-	portForwardingMapping.ListenPort, err = strconv.Atoi(transparentProxyString[0])
+	if len(transparentProxyString) != 3 {
+		return fmt.Errorf("invalid Format for Port Forwarding Mapping: %s, expected listen#network#endpoint", s)
+	}
+	portForwardingMapping.BindAddress, portForwardingMapping.ListenPort, err = parseListenAddress(transparentProxyString[0])
 	if err != nil {
 		return fmt.Errorf("invalid Format for Transparent Proxy Mapping: %s, %v", s, err)
 	}
@@ -109,8 +129,9 @@ type ApplicationConfig struct {
 }
 
 type ClientConfig struct {
-	EnableProxy                        bool `mapstructure:"proxy"`
-	EnableSocks5                       bool `mapstructure:"socks5"`
+	EnableProxy                        bool   `mapstructure:"proxy"`
+	EnableSocks5                       bool   `mapstructure:"socks5"`
+	BindAddress                        string `mapstructure:"bindAddress"`
 	HttpProxyPort                      int
 	Socks5Port                         int
 	TransportType                      TransportType
@@ -119,27 +140,427 @@ type ClientConfig struct {
 	PortForwardList                    PortForwardingMappingList
 	Auth                               ClientAuthConfig `mapstructure:"clientauth"`
 	TransportTypeMuxBackendConnections int
+	Dns                                DnsConfig           `mapstructure:"dns"`
+	MetricsAddr                        string              `mapstructure:"metrics"`
+	Reconnect                          ReconnectConfig     `mapstructure:"reconnect"`
+	UpstreamProxy                      UpstreamProxyConfig `mapstructure:"upstreamProxy"`
+	TLS                                ClientTLSConfig     `mapstructure:"tls"`
+}
+
+// ClientTLSConfig configures how the client verifies the tunnel endpoint certificate.
+// Pins are base64 sha256 hashes of the Subject Public Key Info, optionally prefixed by "sha256/".
+type ClientTLSConfig struct {
+	Certificate string   `mapstructure:"cert"`
+	Key         string   `mapstructure:"key"`
+	CaBundle    string   `mapstructure:"caBundle"`
+	ServerName  string   `mapstructure:"serverName"`
+	Pins        []string `mapstructure:"pins"`
+	MinVersion  string   `mapstructure:"minVersion"`
+	Insecure    bool     `mapstructure:"insecureSkipVerify"`
+}
+
+// UpstreamProxyConfig configures the outbound proxy used to reach the tunnel endpoint.
+// Url has precedence over the environment variables.
+type UpstreamProxyConfig struct {
+	Url             string `mapstructure:"url"`
+	FromEnvironment bool   `mapstructure:"fromEnvironment"`
+}
+
+// ReconnectConfig configures the exponential backoff between tunnel reconnection attempts
+// and the circuit breaker failing dials while the tunnel is down
+type ReconnectConfig struct {
+	InitialInterval  time.Duration `mapstructure:"initialInterval"`
+	MaxInterval      time.Duration `mapstructure:"maxInterval"`
+	Multiplier       float64       `mapstructure:"multiplier"`
+	Jitter           bool          `mapstructure:"jitter"`
+	DialTimeout      time.Duration `mapstructure:"dialTimeout"`
+	BreakerThreshold int           `mapstructure:"breakerThreshold"`
+}
+
+type DnsConfig struct {
+	Enable      bool          `mapstructure:"enable"`
+	ListenAddr  string        `mapstructure:"listen"`
+	Zones       []string      `mapstructure:"zones"`
+	Upstream    string        `mapstructure:"upstream"`
+	CacheSize   int           `mapstructure:"cacheSize"`
+	MaxTTL      time.Duration `mapstructure:"maxTTL"`
+	NegativeTTL time.Duration `mapstructure:"negativeTTL"`
+	Timeout     time.Duration `mapstructure:"timeout"`
 }
 
 type ServerConfig struct {
 	HttpPort       int              `mapstructure:"httpPort"`
 	HttpsPort      int              `mapstructure:"httpsPort"`
+	BindAddress    string           `mapstructure:"bindAddress"`
 	Auth           ServerAuthConfig `mapstructure:"clientauth"`
 	PublicKeyPath  string           `mapstructure:"pubkey"`
 	PrivateKeyPath string           `mapstructure:"privatekey"`
+	DnsResolver    string           `mapstructure:"dnsResolver"`
+	Tunnels        []TunnelConfig   `mapstructure:"tunnels"`
+	Session        SessionConfig    `mapstructure:"session"`
+	Forward        ForwardConfig    `mapstructure:"forward"`
+	Admin          AdminConfig      `mapstructure:"admin"`
+	Quota          QuotaConfig      `mapstructure:"quota"`
+	Audit          AuditConfig      `mapstructure:"audit"`
+}
+
+// AuditConfig records the audit events as JSON on every configured sink, they're logged if none is set
+type AuditConfig struct {
+	File    AuditFileConfig    `mapstructure:"file"`
+	Syslog  AuditSyslogConfig  `mapstructure:"syslog"`
+	Webhook AuditWebhookConfig `mapstructure:"webhook"`
+}
+
+// AuditFileConfig appends the events to Path, rotated once it reaches MaxSize megabytes keeping MaxBackups old files
+type AuditFileConfig struct {
+	Path       string `mapstructure:"path"`
+	MaxSize    int    `mapstructure:"maxSize"`
+	MaxBackups int    `mapstructure:"maxBackups"`
+}
+
+// AuditSyslogConfig sends the events to syslog, the local daemon unless Network and Address are set
+type AuditSyslogConfig struct {
+	Enable  bool   `mapstructure:"enable"`
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	Tag     string `mapstructure:"tag"`
+}
+
+// AuditWebhookConfig posts the events in batches of up to BatchSize, events are dropped while the webhook is down
+// and BufferSize are queued
+type AuditWebhookConfig struct {
+	Url        string            `mapstructure:"url"`
+	Headers    map[string]string `mapstructure:"headers"`
+	Timeout    time.Duration     `mapstructure:"timeout"`
+	BatchSize  int               `mapstructure:"batchSize"`
+	BufferSize int               `mapstructure:"bufferSize"`
+}
+
+func (c AuditConfig) Validate() error {
+	if c.File.Path != "" && (c.File.MaxSize < 0 || c.File.MaxBackups < 0) {
+		return errors.New("invalid audit file rotation, maxSize and maxBackups can't be negative")
+	}
+	if c.Syslog.Enable && (c.Syslog.Network == "") != (c.Syslog.Address == "") {
+		return errors.New("audit syslog needs both network and address, or none for the local daemon")
+	}
+	if c.Webhook.Url != "" {
+		webhookUrl, err := url.Parse(c.Webhook.Url)
+		if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+			return fmt.Errorf("invalid audit webhook url %s", c.Webhook.Url)
+		}
+		if c.Webhook.Timeout <= 0 || c.Webhook.BatchSize <= 0 || c.Webhook.BufferSize <= 0 {
+			return errors.New("invalid audit webhook, timeout, batchSize and bufferSize must be positive")
+		}
+	}
+	return nil
+}
+
+// QuotaConfig limits what each subject can open: concurrent tunnel Sessions, concurrent forwarded Streams and
+// new streams per second (ConnectionRate, bursting up to ConnectionBurst). Zero is unlimited.
+// Roles override the limits of the subjects matching their members (subjects, attribute:value, * globs), the first matching role applies.
+type QuotaConfig struct {
+	QuotaLimits `mapstructure:",squash"`
+	Roles       []QuotaRole `mapstructure:"roles"`
+}
+
+type QuotaLimits struct {
+	Sessions        int     `mapstructure:"sessions"`
+	Streams         int     `mapstructure:"streams"`
+	ConnectionRate  float64 `mapstructure:"connectionRate"`
+	ConnectionBurst int     `mapstructure:"connectionBurst"`
+}
+
+type QuotaRole struct {
+	Name        string   `mapstructure:"name"`
+	Members     []string `mapstructure:"members"`
+	QuotaLimits `mapstructure:",squash"`
+}
+
+func (l QuotaLimits) Validate() error {
+	if l.Sessions < 0 || l.Streams < 0 || l.ConnectionRate < 0 || l.ConnectionBurst < 0 {
+		return errors.New("quota limits can't be negative")
+	}
+	return nil
+}
+
+func (c QuotaConfig) Validate() error {
+	if err := c.QuotaLimits.Validate(); err != nil {
+		return err
+	}
+	for _, role := range c.Roles {
+		if role.Name == "" || len(role.Members) == 0 {
+			return errors.New("quota roles need a name and members")
+		}
+		if err := role.Validate(); err != nil {
+			return fmt.Errorf("quota role %s: %v", role.Name, err)
+		}
+	}
+	return nil
+}
+
+// AdminConfig serves the admin API on /admin/ to the Subjects (subjects or attribute:value, * globs) authenticated
+// by the Authenticators chain, the server auth chain by default. Just-in-time grants are persisted to GrantsPath
+// and can't last longer than MaxGrantDuration.
+type AdminConfig struct {
+	Subjects         []string      `mapstructure:"subjects"`
+	Authenticators   []string      `mapstructure:"authenticators"`
+	GrantsPath       string        `mapstructure:"grants"`
+	MaxGrantDuration time.Duration `mapstructure:"maxGrantDuration"`
+}
+
+// Enabled reports if the admin API is served
+func (a AdminConfig) Enabled() bool {
+	return len(a.Subjects) > 0
+}
+
+// ForwardConfig restricts the addresses forwards can reach. Loopback, link-local (cloud metadata), multicast
+// and unspecified networks are always denied, private networks optionally. AllowedNetworks take precedence.
+type ForwardConfig struct {
+	DenyPrivateNetworks bool          `mapstructure:"denyPrivateNetworks"`
+	DeniedNetworks      []string      `mapstructure:"deniedNetworks"`
+	AllowedNetworks     []string      `mapstructure:"allowedNetworks"`
+	ResolveTimeout      time.Duration `mapstructure:"resolveTimeout"`
+	// RecordPath is a JSON lines file recording every forward authorization, replayed by edgeproxy policy diff
+	RecordPath string `mapstructure:"record"`
+}
+
+// SessionConfig controls how the credentials of open tunnels are checked again.
+// Tunnels are always closed when their credentials expire, revocations are checked every RevalidateInterval.
+type SessionConfig struct {
+	RevalidateInterval time.Duration `mapstructure:"revalidateInterval"`
+}
+
+// paths served by the server besides the tunnels
+var reservedServerPaths = map[string]bool{"/version": true, "/healthz": true, "/readyz": true, "/metrics": true, "/admin": true}
+
+// TunnelConfig serves tunnels on a path with its own authenticator chain and ACL policies,
+// empty authenticators or acl use the server auth ones.
+type TunnelConfig struct {
+	Path           string        `mapstructure:"path"`
+	Authenticators []string      `mapstructure:"authenticators"`
+	Acl            AclCollection `mapstructure:"acl"`
+}
+
+// TunnelConfigs returns the configured tunnels with the defaults applied, a single "/" tunnel if none is configured
+func (s ServerConfig) TunnelConfigs() []TunnelConfig {
+	tunnels := s.Tunnels
+	if len(tunnels) == 0 {
+		tunnels = []TunnelConfig{{Path: "/"}}
+	}
+	var configs []TunnelConfig
+	for _, tunnel := range tunnels {
+		if len(tunnel.Authenticators) == 0 {
+			tunnel.Authenticators = s.Auth.AuthenticatorChain()
+		}
+		if tunnel.Acl == (AclCollection{}) {
+			tunnel.Acl = s.Auth.AclPolicyPath
+		}
+		configs = append(configs, tunnel)
+	}
+	return configs
 }
 
 type ClientAuthConfig struct {
-	CaConfig ClientAuthCaConfig `mapstructure:"ca"`
+	CaConfig  ClientAuthCaConfig       `mapstructure:"ca"`
+	Exec      ClientAuthExecConfig     `mapstructure:"exec"`
+	TokenFile string                   `mapstructure:"tokenFile"`
+	Workload  ClientAuthWorkloadConfig `mapstructure:"workloadApi"`
+}
+
+// ClientAuthWorkloadConfig gets the client X.509-SVID from a SPIFFE Workload API,
+// an empty socket uses the SPIFFE_ENDPOINT_SOCKET environment variable
+type ClientAuthWorkloadConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Socket  string        `mapstructure:"socket"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// ClientAuthExecConfig runs a command printing a kubectl like ExecCredential JSON with the tunnel credentials
+type ClientAuthExecConfig struct {
+	Command string            `mapstructure:"command"`
+	Args    []string          `mapstructure:"args"`
+	Env     map[string]string `mapstructure:"env"`
+	Timeout time.Duration     `mapstructure:"timeout"`
 }
 
 type ServerAuthConfig struct {
-	CaConfig      ServerAuthCaConfig `mapstructure:"ca"`
-	AclPolicyPath AclCollection      `mapstructure:"acl"`
+	Chain         []string                 `mapstructure:"chain"`
+	CaConfig      ServerAuthCaConfig       `mapstructure:"ca"`
+	Oidc          ServerAuthOidcConfig     `mapstructure:"oidc"`
+	CfAccess      ServerAuthCfAccessConfig `mapstructure:"cfAccess"`
+	AclPolicyPath AclCollection            `mapstructure:"acl"`
+	Webhook       WebhookConfig            `mapstructure:"webhook"`
+}
+
+// WebhookConfig posts every forward authorization to an external service (ext_authz), which must allow it
+// along with the ACL policy. Socket is a unix socket the Url is requested through, the Url host is then ignored.
+// Decisions are cached for CacheTtl, failed requests deny the forward unless FailOpen.
+type WebhookConfig struct {
+	Url      string            `mapstructure:"url"`
+	Socket   string            `mapstructure:"socket"`
+	Headers  map[string]string `mapstructure:"headers"`
+	Timeout  time.Duration     `mapstructure:"timeout"`
+	CacheTtl time.Duration     `mapstructure:"cacheTtl"`
+	FailOpen bool              `mapstructure:"failOpen"`
+}
+
+// Enabled reports if forwards are authorized by the webhook
+func (c WebhookConfig) Enabled() bool {
+	return c.Url != ""
+}
+
+func (c WebhookConfig) Validate() error {
+	webhookUrl, err := url.Parse(c.Url)
+	if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || (webhookUrl.Host == "" && c.Socket == "") {
+		return fmt.Errorf("invalid authorization webhook url %s", c.Url)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid authorization webhook timeout %s", c.Timeout)
+	}
+	if c.CacheTtl < 0 {
+		return fmt.Errorf("invalid authorization webhook cache ttl %s", c.CacheTtl)
+	}
+	return nil
+}
+
+// ServerAuthOidcConfig validates OIDC or JWT-SVID bearer tokens with the keys of a JWKS file or URL.
+// The subject claim becomes the policy subject, attribute claims (email, groups...) are matched as "claim:value".
+type ServerAuthOidcConfig struct {
+	Jwks            string        `mapstructure:"jwks"`
+	JwksRefresh     time.Duration `mapstructure:"jwksRefresh"`
+	Issuer          string        `mapstructure:"issuer"`
+	Audiences       []string      `mapstructure:"audiences"`
+	Leeway          time.Duration `mapstructure:"leeway"`
+	SubjectClaim    string        `mapstructure:"subjectClaim"`
+	AttributeClaims []string      `mapstructure:"attributeClaims"`
+}
+
+// ServerAuthCfAccessConfig validates the Cf-Access-Jwt-Assertion header injected by Cloudflare Access.
+// Certs defaults to the team domain signing certs URL.
+type ServerAuthCfAccessConfig struct {
+	TeamDomain   string        `mapstructure:"teamDomain"`
+	Audiences    []string      `mapstructure:"audiences"`
+	Certs        string        `mapstructure:"certs"`
+	CertsRefresh time.Duration `mapstructure:"certsRefresh"`
+	Leeway       time.Duration `mapstructure:"leeway"`
+}
+
+func (c ServerAuthCfAccessConfig) Validate() error {
+	if len(c.Audiences) == 0 {
+		return errors.New("must set the Cloudflare Access application AUD")
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("invalid Cloudflare Access leeway %s", c.Leeway)
+	}
+	return nil
+}
+
+func (c ServerAuthOidcConfig) Validate() error {
+	if len(c.Audiences) == 0 {
+		return errors.New("must set at least one OIDC audience")
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("invalid OIDC leeway %s", c.Leeway)
+	}
+	return nil
+}
+
+// EnabledAuthenticators returns the configured authenticators, in the default chain order
+func (c ServerAuthConfig) EnabledAuthenticators() []string {
+	var enabled []string
+	if c.CaConfig.TrustedRoot != "" {
+		enabled = append(enabled, CertificateAuthenticator)
+	}
+	if c.Oidc.Jwks != "" {
+		enabled = append(enabled, OidcAuthenticator)
+	}
+	if c.CfAccess.TeamDomain != "" {
+		enabled = append(enabled, CfAccessAuthenticator)
+	}
+	return enabled
+}
+
+// AuthenticatorChain returns the configured chain, or every enabled authenticator
+func (c ServerAuthConfig) AuthenticatorChain() []string {
+	if len(c.Chain) > 0 {
+		return c.Chain
+	}
+	return c.EnabledAuthenticators()
 }
+
+func (c ServerAuthConfig) validateAuthenticators(names []string) error {
+	enabled := map[string]bool{}
+	for _, name := range c.EnabledAuthenticators() {
+		enabled[name] = true
+	}
+	for _, name := range names {
+		if !enabled[name] {
+			return fmt.Errorf("authenticator %s is not configured, expected one of %v", name, c.EnabledAuthenticators())
+		}
+	}
+	return nil
+}
+
+// AclCollection are the policy files of an enforcer, active forwards denied after a reload are closed once RevokeGrace elapses.
+// GroupsPath is a YAML file with the address and service groups referenced from the policies.
+// PolicyPath is a YAML policy with both the IP and domain rules, replacing the CSV policies.
+// RegoPath is an OPA Rego module replacing the other policies, forwards are allowed when RegoQuery is true
+// and its decisions are logged as JSON lines to DecisionLogPath.
+// The Shadow policy is evaluated next to the enforcing one, its disagreements are reported but never enforced.
 type AclCollection struct {
+	IpPath          string        `mapstructure:"ip"`
+	DomainPath      string        `mapstructure:"domain"`
+	GroupsPath      string        `mapstructure:"groups"`
+	PolicyPath      string        `mapstructure:"policy"`
+	RegoPath        string        `mapstructure:"rego"`
+	RegoQuery       string        `mapstructure:"regoQuery"`
+	DecisionLogPath string        `mapstructure:"decisionLog"`
+	RevokeGrace     time.Duration `mapstructure:"revokeGrace"`
+	Shadow          ShadowAcl     `mapstructure:"shadow"`
+}
+
+// ShadowAcl are the policy files of a shadow (dry-run) policy
+type ShadowAcl struct {
 	IpPath     string `mapstructure:"ip"`
 	DomainPath string `mapstructure:"domain"`
+	GroupsPath string `mapstructure:"groups"`
+	PolicyPath string `mapstructure:"policy"`
+	RegoPath   string `mapstructure:"rego"`
+	RegoQuery  string `mapstructure:"regoQuery"`
+}
+
+// ShadowAcl returns the shadow policy files as an AclCollection
+func (a AclCollection) ShadowAcl() AclCollection {
+	return AclCollection{IpPath: a.Shadow.IpPath, DomainPath: a.Shadow.DomainPath, GroupsPath: a.Shadow.GroupsPath,
+		PolicyPath: a.Shadow.PolicyPath, RegoPath: a.Shadow.RegoPath, RegoQuery: a.Shadow.RegoQuery}
+}
+
+// Enabled reports if any policy is configured
+func (a AclCollection) Enabled() bool {
+	return a.IpPath != "" || a.DomainPath != "" || a.PolicyPath != "" || a.RegoPath != ""
+}
+
+func (a AclCollection) Validate() error {
+	if a.PolicyPath != "" && (a.IpPath != "" || a.DomainPath != "") {
+		return errors.New("a YAML acl policy can't be combined with the ip and domain policies")
+	}
+	if a.RegoPath != "" && (a.IpPath != "" || a.DomainPath != "" || a.PolicyPath != "" || a.GroupsPath != "") {
+		return errors.New("a Rego acl policy can't be combined with the other policies and groups")
+	}
+	if a.RegoPath == "" && (a.RegoQuery != "" || a.DecisionLogPath != "") {
+		return errors.New("the Rego query and decision log need a Rego acl policy")
+	}
+	for _, policyPath := range []string{a.IpPath, a.DomainPath, a.GroupsPath, a.PolicyPath, a.RegoPath} {
+		if policyPath != "" && !checkFileExist(policyPath) {
+			return fmt.Errorf("acl policy %s not exists", policyPath)
+		}
+	}
+	if a.Shadow != (ShadowAcl{}) {
+		if err := a.ShadowAcl().Validate(); err != nil {
+			return fmt.Errorf("shadow %v", err)
+		}
+	}
+	return nil
 }
 
 type PathsConfig struct {
@@ -173,6 +594,29 @@ type ServerAuthCaConfig struct {
 	TrustedRoot      string `mapstructure:"root_bundle"`
 	SpireTrustDomain string `mapstructure:"trust_domain"`
 	Paths            PathsConfig
+	Mode             CertificateAuthMode `mapstructure:"mode"`
+	Token            ClientTokenConfig   `mapstructure:"token"`
+	Revocation       RevocationConfig    `mapstructure:"revocation"`
+}
+
+// RevocationConfig controls how client certificates are checked against CRLs and OCSP responders.
+// With HardFail a certificate whose revocation status can't be determined is rejected.
+type RevocationConfig struct {
+	HardFail     bool          `mapstructure:"hardFail"`
+	Ocsp         bool          `mapstructure:"ocsp"`
+	OcspCacheTtl time.Duration `mapstructure:"ocspCacheTtl"`
+	CrlRefresh   time.Duration `mapstructure:"crlRefresh"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+}
+
+// ClientTokenConfig protects the client tokens sent with the X-Client-Certificate header against replays.
+// Bindings require tokens to be bound to the tunnel endpoint URL or to the TLS client certificate.
+type ClientTokenConfig struct {
+	NonceCacheSize  int           `mapstructure:"nonceCacheSize"`
+	MaxAge          time.Duration `mapstructure:"maxAge"`
+	Leeway          time.Duration `mapstructure:"leeway"`
+	BindEndpoint    bool          `mapstructure:"bindEndpoint"`
+	BindCertificate bool          `mapstructure:"bindCertificate"`
 }
 
 func (s ServerConfig) Validate() error {
@@ -183,6 +627,60 @@ func (s ServerConfig) Validate() error {
 		if s.Auth.CaConfig.SpireTrustDomain == "" {
 			return errors.New("must set a SPIFFE trust domain")
 		}
+		switch s.Auth.CaConfig.Mode {
+		case "", HeaderCertificateAuthMode, MtlsCertificateAuthMode, AnyCertificateAuthMode:
+		default:
+			return fmt.Errorf("invalid certificate auth mode %s, expected header, mtls or any", s.Auth.CaConfig.Mode)
+		}
+	}
+
+	if s.Auth.Oidc.Jwks != "" {
+		if err := s.Auth.Oidc.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Auth.CfAccess.TeamDomain != "" {
+		if err := s.Auth.CfAccess.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := s.Auth.validateAuthenticators(s.Auth.Chain); err != nil {
+		return err
+	}
+	if s.Auth.Webhook.Enabled() {
+		if err := s.Auth.Webhook.Validate(); err != nil {
+			return err
+		}
+	}
+	paths := map[string]bool{}
+	for _, tunnel := range s.Tunnels {
+		if !strings.HasPrefix(tunnel.Path, "/") {
+			return fmt.Errorf("invalid tunnel path %s, must start with /", tunnel.Path)
+		}
+		if paths[tunnel.Path] || reservedServerPaths[tunnel.Path] || strings.HasPrefix(tunnel.Path, "/admin/") {
+			return fmt.Errorf("tunnel path %s is already in use", tunnel.Path)
+		}
+		paths[tunnel.Path] = true
+		if err := s.Auth.validateAuthenticators(tunnel.Authenticators); err != nil {
+			return fmt.Errorf("tunnel %s: %v", tunnel.Path, err)
+		}
+	}
+	for _, tunnel := range s.TunnelConfigs() {
+		if err := tunnel.Acl.Validate(); err != nil {
+			return fmt.Errorf("tunnel %s: %v", tunnel.Path, err)
+		}
+	}
+
+	if err := s.Quota.Validate(); err != nil {
+		return err
+	}
+	if err := s.Audit.Validate(); err != nil {
+		return err
+	}
+	if s.Admin.Enabled() {
+		if err := s.validateAdmin(); err != nil {
+			return fmt.Errorf("admin API: %v", err)
+		}
 	}
 
 	if s.PublicKeyPath != "" && !checkFileExist(s.PublicKeyPath) {
@@ -195,6 +693,30 @@ func (s ServerConfig) Validate() error {
 	return nil
 }
 
+// AdminAuthenticators returns the authenticator chain of the admin API
+func (s ServerConfig) AdminAuthenticators() []string {
+	if len(s.Admin.Authenticators) > 0 {
+		return s.Admin.Authenticators
+	}
+	return s.Auth.AuthenticatorChain()
+}
+
+func (s ServerConfig) validateAdmin() error {
+	if len(s.AdminAuthenticators()) == 0 {
+		return errors.New("no authenticator configured")
+	}
+	if err := s.Auth.validateAuthenticators(s.Admin.Authenticators); err != nil {
+		return err
+	}
+	if s.Admin.GrantsPath == "" {
+		return errors.New("must set the grants file")
+	}
+	if s.Admin.MaxGrantDuration <= 0 {
+		return fmt.Errorf("invalid max grant duration %s", s.Admin.MaxGrantDuration)
+	}
+	return nil
+}
+
 func checkFileExist(path string) bool {
 	if _, err := os.Stat(path); err == nil {
 		return true
@@ -213,6 +735,61 @@ func (c ClientConfig) Validate() (err error) {
 			return err
 		}
 	}
+	if c.Dns.Enable {
+		if err = c.Dns.Validate(); err != nil {
+			return err
+		}
+	}
+	if err = c.Reconnect.Validate(); err != nil {
+		return err
+	}
+	if err = c.TLS.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c ClientTLSConfig) Validate() error {
+	if c.CaBundle != "" && !checkFileExist(c.CaBundle) {
+		return fmt.Errorf("CA bundle %s not exists", c.CaBundle)
+	}
+	if (c.Certificate == "") != (c.Key == "") {
+		return errors.New("TLS client certificate and key must be set together")
+	}
+	switch c.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("invalid TLS min version %s", c.MinVersion)
+	}
+	return nil
+}
+
+func (c ReconnectConfig) Validate() error {
+	if c.InitialInterval <= 0 || c.MaxInterval < c.InitialInterval {
+		return fmt.Errorf("invalid reconnect intervals initial %s max %s", c.InitialInterval, c.MaxInterval)
+	}
+	if c.Multiplier < 1 {
+		return fmt.Errorf("invalid reconnect multiplier %f, must be >= 1", c.Multiplier)
+	}
+	// dials during a reconnection wait up to the timeout, zero would fail them right away
+	if c.DialTimeout <= 0 {
+		return fmt.Errorf("invalid dial timeout %s, must be > 0", c.DialTimeout)
+	}
+	return nil
+}
+
+func (c DnsConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid DNS listen address %s: %v", c.ListenAddr, err)
+	}
+	if c.Upstream != "" {
+		if _, _, err := net.SplitHostPort(c.Upstream); err != nil {
+			return fmt.Errorf("invalid DNS upstream %s: %v", c.Upstream, err)
+		}
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("invalid DNS cache size %d", c.CacheSize)
+	}
 	return nil
 }
 
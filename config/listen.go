@@ -0,0 +1,46 @@
+package config
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenAddress joins the bind address and port, an empty bind address listens on every interface.
+// IPv6 bind addresses may be bracketed.
+func ListenAddress(bindAddress string, port int) string {
+	return net.JoinHostPort(strings.Trim(bindAddress, "[]"), strconv.Itoa(port))
+}
+
+// ListenNetwork narrows a tcp or udp network to the address family of the listen address:
+// IPv4 addresses listen on tcp4, IPv6 addresses on tcp6, empty hosts and names keep dual-stack listeners.
+func ListenNetwork(network string, listenAddr string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return network
+	}
+	ip := net.ParseIP(strings.SplitN(host, "%", 2)[0])
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	default:
+		return network + "6"
+	}
+}
+
+// parseListenAddress parses the listen part of a mapping, a port or a bind address and port ([::1]:5000)
+func parseListenAddress(s string) (bindAddress string, port int, err error) {
+	portString := s
+	if strings.Contains(s, ":") {
+		if bindAddress, portString, err = net.SplitHostPort(s); err != nil {
+			return "", 0, err
+		}
+	}
+	port, err = strconv.Atoi(portString)
+	return bindAddress, port, err
+}
@@ -0,0 +1,17 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	auditEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_audit_events_dropped",
+		Help: "Audit events a sink failed to record, by sink (file, syslog or webhook)",
+	}, []string{"sink"})
+)
+
+func IncrementAuditEventsDropped(sink string, events int) {
+	auditEventsDropped.WithLabelValues(sink).Add(float64(events))
+}
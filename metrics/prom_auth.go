@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	authTokenRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_auth_token_rejected",
+		Help: "Client tokens rejected by the replay protection, by reason",
+	}, []string{"reason"})
+	authNonceCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeproxy_auth_nonce_cache_entries",
+		Help: "Token ids remembered to detect replays",
+	})
+	authPolicyShadowDisagreements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_auth_policy_shadow_disagreements",
+		Help: "Forward authorizations the shadow policy decides differently, by enforced and shadow decision",
+	}, []string{"enforced", "shadow"})
+	authWebhookDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_auth_webhook_decisions",
+		Help: "Forward authorizations of the authorization webhook, by decision and source (webhook, cache or failure)",
+	}, []string{"decision", "source"})
+	authRegoDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_auth_rego_decisions",
+		Help: "Forward authorizations of the Rego policy, by decision (allow, deny or error)",
+	}, []string{"decision"})
+	authGrantsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeproxy_auth_grants_active",
+		Help: "Just-in-time grants not expired nor revoked",
+	})
+)
+
+func IncrementAuthTokenRejected(reason string) {
+	authTokenRejected.WithLabelValues(reason).Inc()
+}
+
+func SetAuthNonceCacheSize(entries int) {
+	authNonceCacheSize.Set(float64(entries))
+}
+
+func IncrementAuthPolicyShadowDisagreements(enforced string, shadow string) {
+	authPolicyShadowDisagreements.WithLabelValues(enforced, shadow).Inc()
+}
+
+func SetAuthGrantsActive(grants int) {
+	authGrantsActive.Set(float64(grants))
+}
+
+func IncrementAuthWebhookDecisions(decision string, source string) {
+	authWebhookDecisions.WithLabelValues(decision, source).Inc()
+}
+
+func IncrementAuthRegoDecisions(decision string) {
+	authRegoDecisions.WithLabelValues(decision).Inc()
+}
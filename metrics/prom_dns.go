@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dnsQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_dns_queries",
+		Help: "DNS queries received by the client DNS listener by route (tunnel, local)",
+	}, []string{"route"})
+	dnsCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_dns_cache_hits",
+		Help: "DNS queries answered from cache by kind (positive, negative)",
+	}, []string{"kind"})
+	dnsCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgeproxy_dns_cache_misses",
+		Help: "DNS queries not found in cache",
+	})
+	dnsCacheHitRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeproxy_dns_cache_hit_ratio",
+		Help: "Ratio of DNS queries answered from cache since start",
+	})
+	dnsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_dns_errors",
+		Help: "DNS queries that could not be resolved by route (tunnel, local)",
+	}, []string{"route"})
+)
+
+func IncrementDnsQueries(route string) {
+	dnsQueries.WithLabelValues(route).Inc()
+}
+
+func IncrementDnsErrors(route string) {
+	dnsErrors.WithLabelValues(route).Inc()
+}
+
+func IncrementDnsCacheHits(kind string) {
+	dnsCacheHits.WithLabelValues(kind).Inc()
+}
+
+func IncrementDnsCacheMisses() {
+	dnsCacheMisses.Inc()
+}
+
+func SetDnsCacheHitRatio(ratio float64) {
+	dnsCacheHitRatio.Set(ratio)
+}
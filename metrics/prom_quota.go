@@ -0,0 +1,17 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	quotaRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_quota_rejected",
+		Help: "Sessions and streams rejected by the subject quotas, by limit (sessions, streams or rate) and quota role",
+	}, []string{"limit", "role"})
+)
+
+func IncrementQuotaRejected(limit string, role string) {
+	quotaRejected.WithLabelValues(limit, role).Inc()
+}
@@ -10,6 +10,18 @@ var (
 		Name: "edgeproxy_router_forward_accepted",
 		Help: "Accepted forwarding connections",
 	})
+	routerForwardRevoked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgeproxy_router_forward_revoked",
+		Help: "Active forwarding connections closed because a policy reload denies them",
+	})
+	routerForwardBlockedDestinations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgeproxy_router_forward_blocked_destinations",
+		Help: "Forward destination addresses refused because their network is denied (loopback, link-local, metadata...)",
+	})
+	routerDnsForward = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgeproxy_router_dns_forward",
+		Help: "DNS streams forwarded to the server resolver",
+	})
 	routerReadBytes = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "edgeproxy_router_read_kilobytes",
 		Help: "Read bytes by routerForwardAccepted",
@@ -24,6 +36,18 @@ func IncrementRouterForwardAcceptedConnections() {
 	routerForwardAccepted.Inc()
 }
 
+func IncrementRouterForwardRevoked() {
+	routerForwardRevoked.Inc()
+}
+
+func IncrementRouterForwardBlockedDestinations() {
+	routerForwardBlockedDestinations.Inc()
+}
+
+func IncrementRouterDnsForwardConnections() {
+	routerDnsForward.Inc()
+}
+
 func IncrementRouterReadBytes(readedBytes int64) {
 	routerReadBytes.Add(float64(readedBytes) / 1024)
 }
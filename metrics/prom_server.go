@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Server exposes the prometheus metrics on processes that don't run the tunnel http server
+type Server struct {
+	ctx context.Context
+	srv *http.Server
+}
+
+func NewServer(ctx context.Context, addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &Server{
+		ctx: ctx,
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		},
+	}
+}
+
+func (s *Server) Start() {
+	go func() {
+		log.Infof("Starting Metrics Server at Addr %s", s.srv.Addr)
+		err := s.srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalf("Metrics Server Listen failure: %v", err)
+		}
+	}()
+}
+
+func (s *Server) Stop() {
+	log.Infof("Stopping Metrics Server")
+	if err := s.srv.Shutdown(s.ctx); err != nil {
+		log.Error(err)
+	}
+}
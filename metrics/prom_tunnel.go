@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tunnelStateTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_tunnel_state_transitions",
+		Help: "Tunnel circuit breaker transitions by destination state (closed, reconnecting, open)",
+	}, []string{"state"})
+	tunnelReconnectAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_tunnel_reconnect_attempts",
+		Help: "Tunnel reconnection attempts by result (success, failure)",
+	}, []string{"result"})
+	tunnelDialsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "edgeproxy_tunnel_dials_rejected",
+		Help: "Dials failed fast because the tunnel is down",
+	})
+	tunnelSessionsTerminated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_tunnel_sessions_terminated",
+		Help: "Server tunnels closed by reason (expired, revoked)",
+	}, []string{"reason"})
+	tunnelReauthentications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeproxy_tunnel_reauthentications",
+		Help: "In-band tunnel re-authentications by result (success, failure)",
+	}, []string{"result"})
+)
+
+func IncrementTunnelStateTransitions(state string) {
+	tunnelStateTransitions.WithLabelValues(state).Inc()
+}
+
+func IncrementTunnelReconnectAttempts(result string) {
+	tunnelReconnectAttempts.WithLabelValues(result).Inc()
+}
+
+func IncrementTunnelDialsRejected() {
+	tunnelDialsRejected.Inc()
+}
+
+func IncrementTunnelSessionsTerminated(reason string) {
+	tunnelSessionsTerminated.WithLabelValues(reason).Inc()
+}
+
+func IncrementTunnelReauthentications(result string) {
+	tunnelReauthentications.WithLabelValues(result).Inc()
+}
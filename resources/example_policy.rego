@@ -0,0 +1,34 @@
+package edgeproxy
+
+default allow = false
+
+giphy_members := {
+	"spiffe://example.com/users/good-user-123",
+	"spiffe://example.com/users/ok-user-456",
+}
+
+giphy_domains := ["*.giphy.com", "giphy.com", "s3.amazonaws.com"]
+
+web_ports := {80, 443}
+
+allow {
+	startswith(input.subject, "spiffe://example.com/users/")
+	input.host == "ifconfig.me"
+	input.port == 443
+	input.network == "tcp"
+}
+
+allow {
+	giphy_members[input.subject]
+	glob.match(giphy_domains[_], ["."], input.host)
+	web_ports[input.port]
+	input.network == "tcp"
+}
+
+allow {
+	giphy_members[input.subject]
+	input.destinationType == "ip"
+	net.cidr_contains("34.117.59.81/32", input.host)
+	input.port == 80
+	input.network == "tcp"
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"net/http"
+	"time"
 )
 
 type Authenticate interface {
@@ -11,3 +12,37 @@ type Authenticate interface {
 type Subject interface {
 	GetSubject() string
 }
+
+// AttributesSubject is implemented by subjects carrying extra identity attributes (email, groups...)
+type AttributesSubject interface {
+	Subject
+	GetAttributes() map[string][]string
+}
+
+// SubjectAttributes returns the subject attributes, nil if it has none
+func SubjectAttributes(subject Subject) map[string][]string {
+	if attributesSubject, ok := subject.(AttributesSubject); ok {
+		return attributesSubject.GetAttributes()
+	}
+	return nil
+}
+
+// ExpiringSubject is implemented by subjects whose credentials expire, their tunnels are closed at that time
+type ExpiringSubject interface {
+	Subject
+	CredentialExpiry() time.Time
+}
+
+// RevalidatingSubject is implemented by subjects whose credentials can be revoked while their tunnels are open
+type RevalidatingSubject interface {
+	Subject
+	Revalidate() error
+}
+
+// SubjectCredentialExpiry returns when the subject credentials expire, zero if they don't
+func SubjectCredentialExpiry(subject Subject) time.Time {
+	if expiringSubject, ok := subject.(ExpiringSubject); ok {
+		return expiringSubject.CredentialExpiry()
+	}
+	return time.Time{}
+}
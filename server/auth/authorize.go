@@ -1,16 +1,82 @@
 package auth
 
+import (
+	"sort"
+
+	"github.com/casbin/casbin/v2/util"
+)
+
 type ForwardAction struct {
-	Subject         string
-	DestinationAddr string
-	NetType         string
+	Subject         string              `json:"subject"`
+	Attributes      map[string][]string `json:"attributes,omitempty"`
+	DestinationAddr string              `json:"destination"`
+	NetType         string              `json:"network"`
+	// Client describes the tunnel the forward came from (remoteIp, userAgent, tunnel path), for external authorizers
+	Client map[string]string `json:"client,omitempty"`
 }
 
-func NewForwardAction(subject, destinationAddr, netType string) ForwardAction {
-	return ForwardAction{Subject: subject,
+func NewForwardAction(subject Subject, destinationAddr, netType string) ForwardAction {
+	return ForwardAction{Subject: subject.GetSubject(), Attributes: SubjectAttributes(subject),
 		DestinationAddr: destinationAddr, NetType: netType}
 }
 
+// Principals returns the names the policy can match for this action, the subject
+// followed by an "attribute:value" entry for each subject attribute, e.g. groups:admins
+func (f ForwardAction) Principals() []string {
+	principals := []string{f.Subject}
+	names := make([]string, 0, len(f.Attributes))
+	for name := range f.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range f.Attributes[name] {
+			principals = append(principals, name+":"+value)
+		}
+	}
+	return principals
+}
+
 type Authorize interface {
 	AuthorizeForward(forwardAction ForwardAction) bool
 }
+
+// Decider is an authorizer explaining its decisions with the policy and the rules that matched
+type Decider interface {
+	Decide(forwardAction ForwardAction) PolicyDecision
+}
+
+// Decide authorizes a forward, with the rules that matched if the authorizer is a Decider
+func Decide(authorizer Authorize, forwardAction ForwardAction) PolicyDecision {
+	if decider, ok := authorizer.(Decider); ok {
+		return decider.Decide(forwardAction)
+	}
+	return PolicyDecision{Allowed: authorizer.AuthorizeForward(forwardAction)}
+}
+
+// ResolvedAuthorizer is implemented by authorizers checking the addresses a domain forward resolved to
+type ResolvedAuthorizer interface {
+	AuthorizeResolved(forwardAction ForwardAction) bool
+}
+
+// AuthorizeResolved authorizes a forward to an address its domain resolved to. Only the IP policies are asked,
+// the domain forward is already decided so it isn't recorded, posted or compared with the shadow policy again.
+// Authorizers without an IP policy allow it.
+func AuthorizeResolved(authorizer Authorize, forwardAction ForwardAction) bool {
+	if resolved, ok := authorizer.(ResolvedAuthorizer); ok {
+		return resolved.AuthorizeResolved(forwardAction)
+	}
+	return true
+}
+
+// SubjectMatches reports if any principal of the subject matches a pattern, * globs as on the policy roles
+func SubjectMatches(subject Subject, patterns []string) bool {
+	for _, principal := range NewForwardAction(subject, "", "").Principals() {
+		for _, pattern := range patterns {
+			if util.KeyMatch(principal, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"edgeproxy/config"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderCfAccessJwtAssertion = "Cf-Access-Jwt-Assertion"
+	cfAccessDomainSuffix       = ".cloudflareaccess.com"
+	cfAccessCertsPath          = "/cdn-cgi/access/certs"
+)
+
+// cfAccessAuthenticator trusts the identities authenticated by Cloudflare Access in front of the server,
+// validating the JWT assertion Access injects on every request.
+type cfAccessAuthenticator struct {
+	validator *jwtValidator
+}
+
+// NewCfAccessAuthenticator validates the Cf-Access-Jwt-Assertion header for the team domain and application AUD
+func NewCfAccessAuthenticator(ctx context.Context, cfAccessConfig config.ServerAuthCfAccessConfig) (Authenticate, error) {
+	teamDomain := CfAccessTeamDomain(cfAccessConfig.TeamDomain)
+	certs := cfAccessConfig.Certs
+	if certs == "" {
+		certs = "https://" + teamDomain + cfAccessCertsPath
+	}
+	validator, err := newJwtValidator(ctx, certs, cfAccessConfig.CertsRefresh, "https://"+teamDomain, cfAccessConfig.Audiences, cfAccessConfig.Leeway)
+	if err != nil {
+		return nil, err
+	}
+	return &cfAccessAuthenticator{validator: validator}, nil
+}
+
+// CfAccessTeamDomain normalizes the team domain, accepting the team name, domain or URL
+func CfAccessTeamDomain(teamDomain string) string {
+	teamDomain = strings.TrimPrefix(teamDomain, "https://")
+	teamDomain = strings.TrimSuffix(teamDomain, "/")
+	if !strings.Contains(teamDomain, ".") {
+		teamDomain += cfAccessDomainSuffix
+	}
+	return teamDomain
+}
+
+func (c *cfAccessAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, Subject) {
+	assertion := r.Header.Get(HeaderCfAccessJwtAssertion)
+	if assertion == "" {
+		return false, nil
+	}
+	subject, err := c.validateAssertion(assertion)
+	if err != nil {
+		log.Debugf("invalid Cloudflare Access assertion: %v", err)
+		return false, nil
+	}
+	return true, subject
+}
+
+func (c *cfAccessAuthenticator) validateAssertion(assertion string) (Subject, error) {
+	claims, err := c.validator.Validate(assertion)
+	if err != nil {
+		return nil, err
+	}
+	// tunnels are closed once the token is no longer accepted
+	expiry, _, _ := claimTime(claims, "exp")
+	expiry = expiry.Add(c.validator.leeway)
+	// users are identified by their email, service tokens by their client id
+	if email, _ := claims["email"].(string); email != "" {
+		return ClaimsSubject{subject: email, expiry: expiry}, nil
+	}
+	if commonName, _ := claims["common_name"].(string); commonName != "" {
+		return ClaimsSubject{subject: commonName, expiry: expiry}, nil
+	}
+	return nil, fmt.Errorf("assertion for %v has no email nor common_name", claims["sub"])
+}
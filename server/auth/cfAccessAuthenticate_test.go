@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"edgeproxy/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestCfAccessAuthenticator(t *testing.T) {
+	jwks := newTestJwks(t, "access-key")
+	// Access certs endpoint publishes the JWKS plus the PEM certificates
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := jwks.keys["access-key"]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys":        []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "access-key", Algorithm: "ES256", Use: "sig"}},
+			"public_cert": map[string]string{"kid": "access-key", "cert": "-----BEGIN CERTIFICATE-----"},
+		})
+	}))
+	defer srv.Close()
+
+	authenticator, err := NewCfAccessAuthenticator(context.Background(), config.ServerAuthCfAccessConfig{
+		TeamDomain: "myteam",
+		Audiences:  []string{"app-aud-tag"},
+		Certs:      srv.URL,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertion := func(overrides jwt.MapClaims) *http.Request {
+		claims := jwt.MapClaims{
+			"iss": "https://myteam.cloudflareaccess.com",
+			"aud": []string{"app-aud-tag"},
+			"sub": "7335d417-61da-459d-899c-0a01c76a2e94",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range overrides {
+			claims[name] = value
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(HeaderCfAccessJwtAssertion, jwks.sign(t, "access-key", claims))
+		return req
+	}
+
+	ok, subject := authenticator.Authenticate(httptest.NewRecorder(), assertion(jwt.MapClaims{"email": "alice@example.com"}))
+	if assert.True(t, ok) {
+		assert.Equal(t, "alice@example.com", subject.GetSubject())
+	}
+
+	// Service tokens have no email, the client id is used
+	ok, subject = authenticator.Authenticate(httptest.NewRecorder(), assertion(jwt.MapClaims{"sub": "", "common_name": "88bf3b6d86161464f6509f7219099e57.access"}))
+	if assert.True(t, ok) {
+		assert.Equal(t, "88bf3b6d86161464f6509f7219099e57.access", subject.GetSubject())
+	}
+
+	ok, _ = authenticator.Authenticate(httptest.NewRecorder(), assertion(jwt.MapClaims{"email": "alice@example.com", "aud": "other-app"}))
+	assert.False(t, ok)
+	ok, _ = authenticator.Authenticate(httptest.NewRecorder(), assertion(jwt.MapClaims{"email": "alice@example.com", "iss": "https://otherteam.cloudflareaccess.com"}))
+	assert.False(t, ok)
+	ok, _ = authenticator.Authenticate(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, ok)
+}
+
+func TestCfAccessTeamDomain(t *testing.T) {
+	assert.Equal(t, "myteam.cloudflareaccess.com", CfAccessTeamDomain("myteam"))
+	assert.Equal(t, "myteam.cloudflareaccess.com", CfAccessTeamDomain("https://myteam.cloudflareaccess.com/"))
+	assert.Equal(t, "access.example.com", CfAccessTeamDomain("access.example.com"))
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http"
+)
+
+type chainAuthenticator struct {
+	authenticators []Authenticate
+}
+
+// NewAuthenticatorChain tries the authenticators in order, the first one accepting the request supplies the subject
+func NewAuthenticatorChain(authenticators ...Authenticate) Authenticate {
+	if len(authenticators) == 1 {
+		return authenticators[0]
+	}
+	return &chainAuthenticator{authenticators: authenticators}
+}
+
+func (c *chainAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, Subject) {
+	for _, authenticator := range c.authenticators {
+		if ok, subject := authenticator.Authenticate(w, r); ok {
+			return true, subject
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type headerAuthenticator string
+
+func (h headerAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, Subject) {
+	if value := r.Header.Get(string(h)); value != "" {
+		return true, ClaimsSubject{subject: string(h) + "/" + value}
+	}
+	return false, nil
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	chain := NewAuthenticatorChain(headerAuthenticator("X-Workload"), headerAuthenticator("X-User"))
+	request := func(headers map[string]string) (bool, Subject) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return chain.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	ok, subject := request(map[string]string{"X-User": "alice"})
+	if assert.True(t, ok) {
+		assert.Equal(t, "X-User/alice", subject.GetSubject())
+	}
+	// First accepting authenticator wins
+	ok, subject = request(map[string]string{"X-User": "alice", "X-Workload": "billing"})
+	if assert.True(t, ok) {
+		assert.Equal(t, "X-Workload/billing", subject.GetSubject())
+	}
+	ok, _ = request(nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ForwardRecorder appends the forward actions submitted for authorization to a JSON lines file,
+// so policy changes can be checked against past traffic with edgeproxy policy diff
+type ForwardRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewForwardRecorder(recordPath string) (*ForwardRecorder, error) {
+	file, err := os.OpenFile(recordPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardRecorder{file: file}, nil
+}
+
+func (r *ForwardRecorder) Record(forwardAction ForwardAction) {
+	line, err := json.Marshal(forwardAction)
+	if err != nil {
+		log.Errorf("can not record forward: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err = r.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("can not record forward: %v", err)
+	}
+}
+
+// ReadForwardActions reads the forward actions recorded by a ForwardRecorder
+func ReadForwardActions(r io.Reader) ([]ForwardAction, error) {
+	var forwardActions []ForwardAction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var forwardAction ForwardAction
+		if err := json.Unmarshal(scanner.Bytes(), &forwardAction); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		forwardActions = append(forwardActions, forwardAction)
+	}
+	return forwardActions, scanner.Err()
+}
+
+// recordingAuthorizer records the forward actions before authorizing them
+type recordingAuthorizer struct {
+	Authorize
+	recorder *ForwardRecorder
+}
+
+// RecordForwards records the forward actions submitted to authorizer, allowed or not
+func RecordForwards(authorizer Authorize, recorder *ForwardRecorder) Authorize {
+	return recordingAuthorizer{Authorize: authorizer, recorder: recorder}
+}
+
+func (r recordingAuthorizer) AuthorizeForward(forwardAction ForwardAction) bool {
+	return r.Decide(forwardAction).Allowed
+}
+
+func (r recordingAuthorizer) Decide(forwardAction ForwardAction) PolicyDecision {
+	r.recorder.Record(forwardAction)
+	return Decide(r.Authorize, forwardAction)
+}
+
+// AuthorizeResolved isn't recorded, the domain forward was
+func (r recordingAuthorizer) AuthorizeResolved(forwardAction ForwardAction) bool {
+	return AuthorizeResolved(r.Authorize, forwardAction)
+}
+
+func (r recordingAuthorizer) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	if tracker, ok := r.Authorize.(ForwardTracker); ok {
+		return tracker.TrackForward(forwardAction, closeForward)
+	}
+	return func() {}
+}
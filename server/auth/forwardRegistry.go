@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"edgeproxy/audit"
+	"edgeproxy/metrics"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ForwardTracker is implemented by authorizers whose policy can change while forwards are running,
+// tracked forwards are authorized again on every change and closed if denied.
+type ForwardTracker interface {
+	// TrackForward registers an authorized forward until the returned untrack is called
+	TrackForward(forwardAction ForwardAction, closeForward func()) (untrack func())
+}
+
+// forwardRegistry keeps the active forwards, so they can be re-authorized after a policy reload
+type forwardRegistry struct {
+	mu       sync.Mutex
+	nextId   uint64
+	forwards map[uint64]*activeForward
+}
+
+type activeForward struct {
+	forwardAction ForwardAction
+	closeForward  func()
+	// revoking is set while the grace period of a denied forward runs
+	revoking bool
+}
+
+func newForwardRegistry() *forwardRegistry {
+	return &forwardRegistry{forwards: map[uint64]*activeForward{}}
+}
+
+func (r *forwardRegistry) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextId++
+	id := r.nextId
+	r.forwards[id] = &activeForward{forwardAction: forwardAction, closeForward: closeForward}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.forwards, id)
+	}
+}
+
+// Reauthorize closes the active forwards the authorizer now denies. With a grace period they are closed
+// once it elapses, unless the policy allows them again meanwhile.
+func (r *forwardRegistry) Reauthorize(authorizer Authorize, grace time.Duration) {
+	r.mu.Lock()
+	forwards := make(map[uint64]*activeForward, len(r.forwards))
+	for id, forward := range r.forwards {
+		if !forward.revoking {
+			forwards[id] = forward
+		}
+	}
+	r.mu.Unlock()
+
+	for id, forward := range forwards {
+		if authorizer.AuthorizeForward(forward.forwardAction) {
+			continue
+		}
+		if grace <= 0 {
+			r.revoke(id, forward, grace)
+			continue
+		}
+		log.Infof("%s access to %s/%s denied by the new policy, closing in %s", forward.forwardAction.Subject,
+			forward.forwardAction.NetType, forward.forwardAction.DestinationAddr, grace)
+		r.mu.Lock()
+		forward.revoking = true
+		r.mu.Unlock()
+		id, forward := id, forward
+		time.AfterFunc(grace, func() {
+			if authorizer.AuthorizeForward(forward.forwardAction) {
+				r.mu.Lock()
+				forward.revoking = false
+				r.mu.Unlock()
+				return
+			}
+			r.revoke(id, forward, grace)
+		})
+	}
+}
+
+func (r *forwardRegistry) revoke(id uint64, forward *activeForward, grace time.Duration) {
+	r.mu.Lock()
+	_, active := r.forwards[id]
+	delete(r.forwards, id)
+	r.mu.Unlock()
+	if !active {
+		return
+	}
+	log.Infof("Closing %s access to %s/%s, denied by the new policy", forward.forwardAction.Subject,
+		forward.forwardAction.NetType, forward.forwardAction.DestinationAddr)
+	metrics.IncrementRouterForwardRevoked()
+	audit.Log(audit.Event{
+		Type:    audit.ForwardRevokedEvent,
+		Subject: forward.forwardAction.Subject,
+		Reason:  "denied_by_policy_reload",
+		Fields: map[string]interface{}{
+			"destination": forward.forwardAction.DestinationAddr,
+			"network":     forward.forwardAction.NetType,
+			"grace":       grace.String(),
+		},
+	})
+	forward.closeForward()
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"edgeproxy/audit"
+	"edgeproxy/metrics"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// grantResolveTimeout bounds the resolution of a domain grant
+const grantResolveTimeout = 5 * time.Second
+
+// Grant is a time-bound allow rule created through the admin API, e.g. to let a subject reach a host during an incident
+type Grant struct {
+	Id          string    `json:"id"`
+	Subject     string    `json:"subject"`
+	Destination string    `json:"destination"`
+	Ports       string    `json:"ports"`
+	Protocol    string    `json:"protocol"`
+	Expiry      time.Time `json:"expiry"`
+	Reason      string    `json:"reason"`
+	CreatedBy   string    `json:"createdBy"`
+	Created     time.Time `json:"created"`
+	// Addresses a domain resolved to when granted, the IP policy allows them too as it checks the resolved forwards
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// rules are the casbin allow rules of the grant on the IP and the domain policy
+func (g Grant) rules() (ip [][]string, domain [][]string) {
+	rule := func(destination string) []string {
+		return []string{g.Subject, destination, g.Ports, g.Protocol, "allow"}
+	}
+	if kind, _ := destinationKind(g.Destination); kind == "ip" {
+		return [][]string{rule(g.Destination)}, nil
+	}
+	for _, address := range g.Addresses {
+		ip = append(ip, rule(address))
+	}
+	return ip, [][]string{rule(g.Destination)}
+}
+
+// GrantStore keeps the active grants, persisted to a JSON file so they survive restarts. Grants are added in memory
+// to the attached policy enforcers, and removed from them when they expire or are revoked.
+type GrantStore struct {
+	mu          sync.Mutex
+	grantsPath  string
+	maxDuration time.Duration
+	grants      map[string]Grant
+	timers      map[string]*time.Timer
+	enforcers   []*policyEnforcer
+	// enforcing are the enforcers deciding the forwards, shadow ones excluded
+	enforcing []*policyEnforcer
+}
+
+// NewGrantStore loads the grants persisted on grantsPath, the ones that expired meanwhile are dropped
+func NewGrantStore(grantsPath string, maxDuration time.Duration) (*GrantStore, error) {
+	s := &GrantStore{
+		grantsPath:  grantsPath,
+		maxDuration: maxDuration,
+		grants:      map[string]Grant{},
+		timers:      map[string]*time.Timer{},
+	}
+	content, err := ioutil.ReadFile(grantsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var grants []Grant
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &grants); err != nil {
+			return nil, fmt.Errorf("invalid grants %s: %v", grantsPath, err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, grant := range grants {
+		if !grant.Expiry.After(time.Now()) {
+			auditGrant(audit.GrantExpiredEvent, grant, "expired", nil)
+			continue
+		}
+		s.add(grant)
+	}
+	return s, s.persist()
+}
+
+// Attach adds the grants to the policy enforcer of a tunnel, and again after every policy reload.
+// Rego policies can't hold grants, they're skipped.
+func (s *GrantStore) Attach(authorizer Authorize) {
+	s.attach(authorizer, true)
+}
+
+// AttachShadow adds the grants to a shadow policy, so they aren't reported as disagreements.
+// Grants are only created if an enforcing policy holds them.
+func (s *GrantStore) AttachShadow(authorizer Authorize) {
+	s.attach(authorizer, false)
+}
+
+func (s *GrantStore) attach(authorizer Authorize, enforcing bool) {
+	enforcer, ok := authorizer.(*policyEnforcer)
+	if !ok {
+		log.Warnf("Just-in-time grants don't apply to Rego policies")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforcers = append(s.enforcers, enforcer)
+	if enforcing {
+		s.enforcing = append(s.enforcing, enforcer)
+	}
+	enforcer.grants = s
+	for _, grant := range s.grants {
+		enforcer.addGrant(grant)
+	}
+}
+
+// Grants returns the active grants, the next to expire first
+func (s *GrantStore) Grants() []Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants := make([]Grant, 0, len(s.grants))
+	for _, grant := range s.grants {
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Expiry.Before(grants[j].Expiry)
+	})
+	return grants
+}
+
+// Create validates and activates a grant requested by createdBy, the protocol defaults to tcp
+func (s *GrantStore) Create(grant Grant, createdBy string) (Grant, error) {
+	if grant.Protocol == "" {
+		grant.Protocol = "tcp"
+	}
+	if err := s.validate(grant); err != nil {
+		return Grant{}, err
+	}
+	if kind, _ := destinationKind(grant.Destination); kind == "domain" {
+		addresses, err := resolveGrant(grant.Destination)
+		if err != nil {
+			return Grant{}, err
+		}
+		grant.Addresses = addresses
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Grant{}, err
+	}
+	grant.Id = hex.EncodeToString(id)
+	grant.CreatedBy = createdBy
+	grant.Created = time.Now()
+
+	s.mu.Lock()
+	held := false
+	for _, enforcer := range s.enforcing {
+		held = held || enforcer.holds(grant)
+	}
+	if !held {
+		s.mu.Unlock()
+		return Grant{}, errors.New("no tunnel policy can hold the grant, domain grants need a domain policy and Rego policies can't hold grants")
+	}
+	s.add(grant)
+	if err := s.persist(); err != nil {
+		s.remove(grant.Id)
+		s.mu.Unlock()
+		return Grant{}, fmt.Errorf("can not persist the grant: %v", err)
+	}
+	for _, enforcer := range s.enforcers {
+		enforcer.addGrant(grant)
+	}
+	s.mu.Unlock()
+
+	log.Infof("%s granted %s access to %s/%s port %s until %s: %s", createdBy, grant.Subject, grant.Protocol,
+		grant.Destination, grant.Ports, grant.Expiry.Format(time.RFC3339), grant.Reason)
+	auditGrant(audit.GrantCreatedEvent, grant, grant.Reason, map[string]interface{}{"createdBy": createdBy})
+	return grant, nil
+}
+
+// Revoke removes a grant before it expires, it reports false if there's no such grant
+func (s *GrantStore) Revoke(id string, revokedBy string) bool {
+	grant, ok := s.delete(id)
+	if ok {
+		log.Infof("%s revoked grant %s of %s access to %s/%s", revokedBy, id, grant.Subject, grant.Protocol, grant.Destination)
+		auditGrant(audit.GrantRevokedEvent, grant, "revoked", map[string]interface{}{"revokedBy": revokedBy})
+	}
+	return ok
+}
+
+func (s *GrantStore) expire(id string) {
+	if grant, ok := s.delete(id); ok {
+		log.Infof("Grant %s of %s access to %s/%s expired", id, grant.Subject, grant.Protocol, grant.Destination)
+		auditGrant(audit.GrantExpiredEvent, grant, "expired", nil)
+	}
+}
+
+// delete removes a grant from the store and the enforcers, then closes the forwards it allowed
+func (s *GrantStore) delete(id string) (Grant, bool) {
+	s.mu.Lock()
+	grant, ok := s.grants[id]
+	if !ok {
+		s.mu.Unlock()
+		return Grant{}, false
+	}
+	s.remove(id)
+	if err := s.persist(); err != nil {
+		log.Errorf("can not persist the grants: %v", err)
+	}
+	// the rules other grants have too are kept in the enforcers
+	shared := map[string]bool{}
+	for _, other := range s.grants {
+		ip, domain := other.rules()
+		for _, rule := range append(ip, domain...) {
+			shared[fmt.Sprint(rule)] = true
+		}
+	}
+	unshared := func(rules [][]string) (kept [][]string) {
+		for _, rule := range rules {
+			if !shared[fmt.Sprint(rule)] {
+				kept = append(kept, rule)
+			}
+		}
+		return kept
+	}
+	ip, domain := grant.rules()
+	ip, domain = unshared(ip), unshared(domain)
+	enforcers := s.enforcers
+	for _, enforcer := range enforcers {
+		enforcer.removeGrantRules(ip, domain)
+	}
+	s.mu.Unlock()
+
+	for _, enforcer := range enforcers {
+		enforcer.forwards.Reauthorize(enforcer, enforcer.revokeGrace)
+	}
+	return grant, true
+}
+
+// add stores a grant and schedules its expiry, the caller holds the lock
+func (s *GrantStore) add(grant Grant) {
+	s.grants[grant.Id] = grant
+	id := grant.Id
+	s.timers[id] = time.AfterFunc(time.Until(grant.Expiry), func() {
+		s.expire(id)
+	})
+	metrics.SetAuthGrantsActive(len(s.grants))
+}
+
+// remove forgets a grant and stops its expiry, the caller holds the lock
+func (s *GrantStore) remove(id string) {
+	if timer, ok := s.timers[id]; ok {
+		timer.Stop()
+	}
+	delete(s.timers, id)
+	delete(s.grants, id)
+	metrics.SetAuthGrantsActive(len(s.grants))
+}
+
+// persist writes the grants to a temporary file renamed over the grants file, the caller holds the lock
+func (s *GrantStore) persist() error {
+	grants := make([]Grant, 0, len(s.grants))
+	for _, grant := range s.grants {
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Created.Before(grants[j].Created)
+	})
+	content, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(s.grantsPath+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.grantsPath+".tmp", s.grantsPath)
+}
+
+// reload loads the enforcer policy files again with the active grants, none expires meanwhile
+func (s *GrantStore) reload(enforcer *policyEnforcer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants := make([]Grant, 0, len(s.grants))
+	for _, grant := range s.grants {
+		grants = append(grants, grant)
+	}
+	enforcer.loadPolicy(grants)
+}
+
+func (s *GrantStore) validate(grant Grant) error {
+	if grant.Subject == "" {
+		return errors.New("missing subject")
+	}
+	switch kind, err := destinationKind(grant.Destination); {
+	case err != nil:
+		return err
+	case kind == "*":
+		return errors.New("grants need a specific destination")
+	case kind == "domain" && strings.ContainsAny(grant.Destination, "*?["):
+		return errors.New("domain grants need a host name to resolve, not a glob")
+	}
+	if grant.Ports == "" || grant.Ports == "*" {
+		return errors.New("grants need specific ports")
+	}
+	if err := validatePorts(grant.Ports); err != nil {
+		return err
+	}
+	if grant.Protocol != "tcp" && grant.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol %q, expected tcp or udp", grant.Protocol)
+	}
+	if !grant.Expiry.After(time.Now()) {
+		return errors.New("expiry must be in the future")
+	}
+	if s.maxDuration > 0 && time.Until(grant.Expiry) > s.maxDuration {
+		return fmt.Errorf("grants can't last longer than %s", s.maxDuration)
+	}
+	if grant.Reason == "" {
+		return errors.New("missing reason")
+	}
+	return nil
+}
+
+// resolveGrant resolves the domain of a grant, so its addresses can be granted on the IP policy
+func resolveGrant(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), grantResolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("can not resolve %s: %v", domain, err)
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.IP.String())
+	}
+	return addresses, nil
+}
+
+func auditGrant(eventType audit.EventType, grant Grant, reason string, fields map[string]interface{}) {
+	event := audit.Event{
+		Type:    eventType,
+		Subject: grant.Subject,
+		Reason:  reason,
+		Fields: map[string]interface{}{
+			"grant":       grant.Id,
+			"destination": grant.Destination,
+			"ports":       grant.Ports,
+			"network":     grant.Protocol,
+			"expiry":      grant.Expiry.Format(time.RFC3339),
+		},
+	}
+	for name, value := range fields {
+		event.Fields[name] = value
+	}
+	audit.Log(event)
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	// tokens signed by unknown keys trigger a refetch, at most once per interval
+	jwksMinRefetchInterval = 10 * time.Second
+)
+
+// jwksKeySet keeps the token verification keys published on a JWKS file or URL.
+// Keys are refreshed periodically, and when a token is signed by an unknown key id so rotations are picked up.
+type jwksKeySet struct {
+	source     string
+	httpClient *http.Client
+	mu         sync.RWMutex
+	refetchMu  sync.Mutex
+	keySet     jose.JSONWebKeySet
+	lastFetch  time.Time
+}
+
+func newJwksKeySet(ctx context.Context, source string, refresh time.Duration) (*jwksKeySet, error) {
+	k := &jwksKeySet{
+		source:     source,
+		httpClient: &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		go k.refreshLoop(ctx, refresh)
+	}
+	return k, nil
+}
+
+func (k *jwksKeySet) isURL() bool {
+	return strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://")
+}
+
+func (k *jwksKeySet) read() ([]byte, error) {
+	if !k.isURL() {
+		return ioutil.ReadFile(k.source)
+	}
+	resp, err := k.httpClient.Get(k.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k *jwksKeySet) load() error {
+	buf, err := k.read()
+	if err != nil {
+		return fmt.Errorf("error loading JWKS %s: %v", k.source, err)
+	}
+	var keySet jose.JSONWebKeySet
+	if err = json.Unmarshal(buf, &keySet); err != nil {
+		return fmt.Errorf("error parsing JWKS %s: %v", k.source, err)
+	}
+	var verificationKeys jose.JSONWebKeySet
+	for _, key := range keySet.Keys {
+		// jwt-svid is the use of keys on SPIFFE bundles
+		if key.Use != "" && key.Use != "sig" && key.Use != "jwt-svid" {
+			continue
+		}
+		verificationKeys.Keys = append(verificationKeys.Keys, key.Public())
+	}
+	if len(verificationKeys.Keys) == 0 {
+		return fmt.Errorf("no signing keys found in JWKS %s", k.source)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keySet = verificationKeys
+	k.lastFetch = time.Now()
+	log.Debugf("Loaded %d keys from JWKS %s", len(verificationKeys.Keys), k.source)
+	return nil
+}
+
+func (k *jwksKeySet) refreshLoop(ctx context.Context, refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// on failure the last known keys are kept
+			if err := k.load(); err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+}
+
+// Keys returns the keys that can verify a token signed with the key id, all keys if the token has no key id
+func (k *jwksKeySet) Keys(kid string) []interface{} {
+	keys, _ := k.lookup(kid)
+	if len(keys) > 0 {
+		return keys
+	}
+	// concurrent requests with unknown keys wait for a single refetch
+	k.refetchMu.Lock()
+	defer k.refetchMu.Unlock()
+	keys, lastFetch := k.lookup(kid)
+	if len(keys) == 0 && time.Since(lastFetch) > jwksMinRefetchInterval {
+		log.Debugf("Unknown key id %s, refreshing JWKS %s", kid, k.source)
+		if err := k.load(); err != nil {
+			log.Warn(err)
+		}
+		keys, _ = k.lookup(kid)
+	}
+	return keys
+}
+
+func (k *jwksKeySet) lookup(kid string) ([]interface{}, time.Time) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var keys []interface{}
+	for _, key := range k.keySet.Keys {
+		if kid == "" || key.KeyID == kid {
+			keys = append(keys, key.Key)
+		}
+	}
+	return keys, k.lastFetch
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"time"
+)
+
+// asymmetric algorithms only, HMAC would accept tokens signed with the public key
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// jwtValidator verifies tokens signed by the keys of a JWKS, and their time, issuer and audience claims
+type jwtValidator struct {
+	keySet    *jwksKeySet
+	parser    *jwt.Parser
+	issuer    string
+	audiences []string
+	leeway    time.Duration
+	now       func() time.Time
+}
+
+func newJwtValidator(ctx context.Context, jwks string, jwksRefresh time.Duration, issuer string, audiences []string, leeway time.Duration) (*jwtValidator, error) {
+	keySet, err := newJwksKeySet(ctx, jwks, jwksRefresh)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtValidator{
+		keySet: keySet,
+		parser: &jwt.Parser{
+			ValidMethods: jwtSigningMethods,
+			// time claims are validated with leeway by validateClaims
+			SkipClaimsValidation: true,
+		},
+		issuer:    issuer,
+		audiences: audiences,
+		leeway:    leeway,
+		now:       time.Now,
+	}, nil
+}
+
+// Validate returns the token claims when the signature and claims are valid
+func (v *jwtValidator) Validate(rawToken string) (jwt.MapClaims, error) {
+	unverified, _, err := v.parser.ParseUnverified(rawToken, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+	keys := v.keySet.Keys(kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	var claims jwt.MapClaims
+	for _, key := range keys {
+		claims = jwt.MapClaims{}
+		if _, err = v.parser.ParseWithClaims(rawToken, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		}); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwtValidator) validateClaims(claims jwt.MapClaims) error {
+	now := v.now()
+	exp, ok, err := claimTime(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return fmt.Errorf("token expired at %s", exp)
+	}
+	if nbf, ok, err := claimTime(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.leeway).Before(nbf) {
+		return fmt.Errorf("token not valid before %s", nbf)
+	}
+	if iat, ok, err := claimTime(claims, "iat"); err != nil {
+		return err
+	} else if ok && now.Add(v.leeway).Before(iat) {
+		return fmt.Errorf("token issued in the future %s", iat)
+	}
+
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("unexpected issuer %s", iss)
+		}
+	}
+	for _, aud := range claimStrings(claims["aud"]) {
+		for _, audience := range v.audiences {
+			if aud == audience {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token audience %v not accepted", claims["aud"])
+}
+
+// claimTime reads a NumericDate claim, the bool reports if the claim is present
+func claimTime(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim", name)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// claimStrings reads claims that can be a single string or an array of strings, like aud or groups
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func hasPeerCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
+
+// authenticatePeerCertificate validates the TLS client certificate against the trust bundle,
+// the key possession is already proven by the TLS handshake so no JWT is required.
+func (f *spireAuthorizer) authenticatePeerCertificate(r *http.Request) (bool, Subject) {
+	if !hasPeerCertificate(r) {
+		log.Debug("no TLS client certificate")
+		return false, nil
+	}
+	peerCertificates := r.TLS.PeerCertificates
+	validatedCert, err := f.verifySvid(peerCertificates[0], peerCertificates[1:], stapledOcspResponse(r))
+	if err != nil {
+		log.Debugf("error validating TLS client cert: %v", err)
+		return false, nil
+	}
+	return true, f.newSpiffeSubject(validatedCert, peerCertificates[1:])
+}
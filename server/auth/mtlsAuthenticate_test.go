@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"edgeproxy/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMtlsAuthenticator(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	// as configured by the server, with the certificate presented on the TLS handshake
+	authenticator := NewSpireAuthorizer(context.Background(), config.ServerAuthCaConfig{
+		Mode:             config.MtlsCertificateAuthMode,
+		TrustedRoot:      ca.pemPath,
+		SpireTrustDomain: "example.com",
+		Paths:            config.PathsConfig{Allowed: []string{"/users/.*"}, Denied: []string{"/users/bad-.*"}},
+	})
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, subject := authenticator.Authenticate(w, r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(subject.GetSubject()))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	request := func(cert *x509.Certificate, key interface{}) int {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(srv.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	goodCert, goodKey := ca.issueSvid(t, "spiffe://example.com/users/good-user", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusOK, request(goodCert, goodKey))
+
+	assert.Equal(t, http.StatusUnauthorized, request(nil, nil))
+
+	badCert, badKey := ca.issueSvid(t, "spiffe://example.com/users/bad-user", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusUnauthorized, request(badCert, badKey))
+
+	foreignCert, foreignKey := ca.issueSvid(t, "spiffe://other.com/users/good-user", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusUnauthorized, request(foreignCert, foreignKey))
+
+	untrustedCert, untrustedKey := otherCA.issueSvid(t, "spiffe://example.com/users/good-user", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusUnauthorized, request(untrustedCert, untrustedKey))
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"edgeproxy/client/clientauth"
+	"edgeproxy/config"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type oidcAuthenticator struct {
+	validator       *jwtValidator
+	subjectClaim    string
+	attributeClaims []string
+}
+
+// ClaimsSubject is a subject authenticated by a bearer token, the attributes are taken from the configured claims
+type ClaimsSubject struct {
+	subject    string
+	attributes map[string][]string
+	expiry     time.Time
+}
+
+func (s ClaimsSubject) GetSubject() string {
+	return s.subject
+}
+
+func (s ClaimsSubject) GetAttributes() map[string][]string {
+	return s.attributes
+}
+
+// CredentialExpiry is the token expiration
+func (s ClaimsSubject) CredentialExpiry() time.Time {
+	return s.expiry
+}
+
+// NewOidcAuthenticator validates OIDC ID tokens or JWT-SVIDs sent as bearer tokens
+func NewOidcAuthenticator(ctx context.Context, oidcConfig config.ServerAuthOidcConfig) (Authenticate, error) {
+	validator, err := newJwtValidator(ctx, oidcConfig.Jwks, oidcConfig.JwksRefresh, oidcConfig.Issuer, oidcConfig.Audiences, oidcConfig.Leeway)
+	if err != nil {
+		return nil, err
+	}
+	subjectClaim := oidcConfig.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+	return &oidcAuthenticator{
+		validator:       validator,
+		subjectClaim:    subjectClaim,
+		attributeClaims: oidcConfig.AttributeClaims,
+	}, nil
+}
+
+func (o *oidcAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, Subject) {
+	authorization := r.Header.Get(clientauth.HeaderAuthorization)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false, nil
+	}
+	subject, err := o.validateToken(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+	if err != nil {
+		log.Debugf("invalid bearer token: %v", err)
+		return false, nil
+	}
+	return true, subject
+}
+
+func (o *oidcAuthenticator) validateToken(rawToken string) (Subject, error) {
+	claims, err := o.validator.Validate(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims[o.subjectClaim].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("missing %s claim", o.subjectClaim)
+	}
+	attributes := map[string][]string{}
+	for _, name := range o.attributeClaims {
+		if values := claimStrings(claims[name]); len(values) > 0 {
+			attributes[name] = values
+		}
+	}
+	// tunnels are closed once the token is no longer accepted
+	expiry, _, _ := claimTime(claims, "exp")
+	expiry = expiry.Add(o.validator.leeway)
+	return ClaimsSubject{subject: subject, attributes: attributes, expiry: expiry}, nil
+}
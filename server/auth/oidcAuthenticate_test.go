@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"edgeproxy/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+type testJwks struct {
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}
+
+func newTestJwks(t *testing.T, kids ...string) *testJwks {
+	j := &testJwks{keys: map[string]*ecdsa.PrivateKey{}}
+	for _, kid := range kids {
+		j.addKey(t, kid)
+	}
+	return j
+}
+
+func (j *testJwks) addKey(t *testing.T, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys[kid] = key
+}
+
+func (j *testJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var keySet jose.JSONWebKeySet
+	for kid, key := range j.keys {
+		keySet.Keys = append(keySet.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "ES256", Use: "sig"})
+	}
+	json.NewEncoder(w).Encode(keySet)
+}
+
+func (j *testJwks) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	j.mu.Lock()
+	key := j.keys[kid]
+	j.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func authenticateBearer(authenticator Authenticate, token string) (bool, Subject) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return authenticator.Authenticate(httptest.NewRecorder(), req)
+}
+
+func TestOidcAuthenticator(t *testing.T) {
+	jwks := newTestJwks(t, "key-1")
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	authenticator, err := NewOidcAuthenticator(context.Background(), config.ServerAuthOidcConfig{
+		Jwks:            srv.URL,
+		Issuer:          "https://issuer.example.com",
+		Audiences:       []string{"edgeproxy"},
+		Leeway:          time.Minute,
+		AttributeClaims: []string{"email", "groups"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":    "https://issuer.example.com",
+			"aud":    []string{"other", "edgeproxy"},
+			"sub":    "alice",
+			"email":  "alice@example.com",
+			"groups": []string{"admins", "developers"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range overrides {
+			c[name] = value
+		}
+		return c
+	}
+
+	ok, subject := authenticateBearer(authenticator, jwks.sign(t, "key-1", claims(nil)))
+	if assert.True(t, ok) {
+		assert.Equal(t, "alice", subject.GetSubject())
+		assert.Equal(t, map[string][]string{"email": {"alice@example.com"}, "groups": {"admins", "developers"}}, SubjectAttributes(subject))
+	}
+
+	// Clock skew within leeway is tolerated
+	ok, _ = authenticateBearer(authenticator, jwks.sign(t, "key-1", claims(jwt.MapClaims{"exp": time.Now().Add(-30 * time.Second).Unix(), "nbf": time.Now().Add(30 * time.Second).Unix()})))
+	assert.True(t, ok)
+
+	for name, invalid := range map[string]jwt.MapClaims{
+		"expired":       {"exp": time.Now().Add(-2 * time.Minute).Unix()},
+		"not yet valid": {"nbf": time.Now().Add(2 * time.Minute).Unix()},
+		"wrong issuer":  {"iss": "https://evil.example.com"},
+		"wrong aud":     {"aud": "other"},
+		"no subject":    {"sub": ""},
+	} {
+		ok, _ = authenticateBearer(authenticator, jwks.sign(t, "key-1", claims(invalid)))
+		assert.False(t, ok, name)
+	}
+
+	// Symmetric algorithms are not accepted
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString([]byte("secret"))
+	ok, _ = authenticateBearer(authenticator, hmacToken)
+	assert.False(t, ok)
+
+	// Rotated keys are fetched when a token uses an unknown key id
+	jwks.addKey(t, "key-2")
+	authenticator.(*oidcAuthenticator).validator.keySet.lastFetch = time.Time{}
+	ok, _ = authenticateBearer(authenticator, jwks.sign(t, "key-2", claims(nil)))
+	assert.True(t, ok)
+}
@@ -2,21 +2,33 @@ package auth
 
 import (
 	"edgeproxy/config"
+	"fmt"
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
 	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"github.com/casbin/casbin/v2/util"
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type policyEnforcer struct {
+	// mu guards the enforcers, their policies change on reloads and grants while forwards are authorized
+	mu                  sync.RWMutex
 	IpEnforcer          *casbin.Enforcer
 	DomainEnforcer      *casbin.Enforcer
 	ipAclPolicyPath     string
 	domainAclPolicyPath string
+	groupsPath          string
+	yamlPolicyPath      string
+	revokeGrace         time.Duration
+	forwards            *forwardRegistry
+	// grants are the just-in-time grants added in memory on top of the policy files
+	grants *GrantStore
 }
 
 const edgeproxyIpFilteringCasbinModel = `[request_definition]
@@ -32,7 +44,7 @@ e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
 g = _, _
 
 [matchers]
-m = g(r.sub, p.sub) && ipMatch(r.ip, p.ip) && globMatch(r.port, p.port) && r.proto == p.proto
+m = g(r.sub, p.sub) && cidrMatch(r.ip, p.ip) && portMatch(r.port, p.port) && r.proto == p.proto
 `
 
 const edgeproxyDomainFilteringCasbinModel = `[request_definition]
@@ -48,51 +60,116 @@ e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
 g = _, _
 
 [matchers]
-m = g(r.sub, p.sub) && globMatch(r.domain, p.domain) && globMatch(r.port, p.port) && r.proto == p.proto
+m = g(r.sub, p.sub) && domainMatch(r.domain, p.domain) && portMatch(r.port, p.port) && r.proto == p.proto
 `
 
+// PolicyDecision explains an authorization, with the rules each principal of the forward matched
+type PolicyDecision struct {
+	Allowed bool
+	// Policy is the ip or domain policy the destination was checked against
+	Policy  string
+	Matches []PolicyMatch
+}
+
+// PolicyMatch is the rule a principal matched
+type PolicyMatch struct {
+	Principal string
+	Rule      []string
+}
+
+// PolicyChecker checks the policies offline
+type PolicyChecker interface {
+	Authorize
+	// Decide authorizes a forward, explaining the rules that allowed or denied it
+	Decide(forwardAction ForwardAction) PolicyDecision
+	// Lint reports the rules that never match
+	Lint() []string
+	// Rules returns the loaded ip and domain policy rules
+	Rules() (ip [][]string, domain [][]string)
+	// Summary describes the loaded policy
+	Summary() string
+}
+
 func NewPolicyEnforcer(aclPolicyPath config.AclCollection) *policyEnforcer {
+	pe, err := loadPolicyEnforcer(aclPolicyPath)
+	if err != nil {
+		log.Fatalf("cannot load casbin policy: %v", err)
+	}
+	go pe.watchForPolicyChanges()
+	return pe
+}
+
+// LoadPolicy loads the policies without watching them for changes, to check them offline
+func LoadPolicy(aclPolicyPath config.AclCollection) (PolicyChecker, error) {
+	if aclPolicyPath.RegoPath != "" {
+		return loadRegoAuthorizer(aclPolicyPath)
+	}
+	return loadPolicyEnforcer(aclPolicyPath)
+}
+
+func loadPolicyEnforcer(aclPolicyPath config.AclCollection) (*policyEnforcer, error) {
 	// IP ACL is mandatory, even if it's just 0.0.0.0/0 on all ports to everyone
-	ipAdapter := fileadapter.NewAdapter(aclPolicyPath.IpPath)
+	var ipAdapter, domainAdapter persist.Adapter
+	ipAdapter = groupsAdapter{Adapter: fileadapter.NewAdapter(aclPolicyPath.IpPath), groupsPath: aclPolicyPath.GroupsPath}
+	if aclPolicyPath.DomainPath != "" {
+		domainAdapter = groupsAdapter{Adapter: fileadapter.NewAdapter(aclPolicyPath.DomainPath), groupsPath: aclPolicyPath.GroupsPath}
+	}
+	// a YAML policy holds both the IP and domain rules
+	if aclPolicyPath.PolicyPath != "" {
+		ipAdapter = yamlPolicyAdapter{policyPath: aclPolicyPath.PolicyPath, groupsPath: aclPolicyPath.GroupsPath}
+		domainAdapter = yamlPolicyAdapter{policyPath: aclPolicyPath.PolicyPath, groupsPath: aclPolicyPath.GroupsPath, domain: true}
+	}
 	ipModel, _ := model.NewModelFromString(edgeproxyIpFilteringCasbinModel)
 
 	ipEnforcer, err := casbin.NewEnforcer(ipModel, ipAdapter)
 	if err != nil {
-		log.Fatalf("cannot load casbin ipModel: %v", err)
+		return nil, fmt.Errorf("cannot load casbin ipModel: %v", err)
 	}
 	ipEnforcer.SetAdapter(ipAdapter)
+	// grants are only added in memory, the policy files are never written
+	ipEnforcer.EnableAutoSave(false)
+	ipEnforcer.AddFunction("cidrMatch", matcherFunc("cidrMatch", cidrMatch))
+	ipEnforcer.AddFunction("portMatch", matcherFunc("portMatch", portMatch))
 	// allows adding users to a group by * matching
 	ipEnforcer.AddNamedMatchingFunc("g", "", util.KeyMatch)
 	ipEnforcer.BuildRoleLinks()
 
 	var domainEnforcer *casbin.Enforcer
-	var domainEnforcerErr error
 
 	// add a second enforcer for domain-name matching that can use globs
-	if aclPolicyPath.DomainPath != "" {
-		domainAdapter := fileadapter.NewAdapter(aclPolicyPath.DomainPath)
+	if domainAdapter != nil {
 		domainModel, _ := model.NewModelFromString(edgeproxyDomainFilteringCasbinModel)
 
-		domainEnforcer, domainEnforcerErr = casbin.NewEnforcer(domainModel, domainAdapter)
-		if domainEnforcerErr != nil {
-			log.Fatalf("cannot load casbin domainModel: %v", domainEnforcerErr)
+		if domainEnforcer, err = casbin.NewEnforcer(domainModel, domainAdapter); err != nil {
+			return nil, fmt.Errorf("cannot load casbin domainModel: %v", err)
 		}
 		domainEnforcer.SetAdapter(domainAdapter)
+		domainEnforcer.EnableAutoSave(false)
+		domainEnforcer.AddFunction("domainMatch", matcherFunc("domainMatch", domainMatch))
+		domainEnforcer.AddFunction("portMatch", matcherFunc("portMatch", portMatch))
 		// https://casbin.org/docs/en/rbac#use-pattern-matching-in-rbac
 		domainEnforcer.AddNamedMatchingFunc("g", "", util.KeyMatch)
 		domainEnforcer.BuildRoleLinks()
 	}
 
-	pe := &policyEnforcer{
+	return &policyEnforcer{
 		IpEnforcer:          ipEnforcer,
 		DomainEnforcer:      domainEnforcer,
 		ipAclPolicyPath:     aclPolicyPath.IpPath,
 		domainAclPolicyPath: aclPolicyPath.DomainPath,
-	}
-	go pe.watchForPolicyChanges()
-	return pe
+		groupsPath:          aclPolicyPath.GroupsPath,
+		yamlPolicyPath:      aclPolicyPath.PolicyPath,
+		revokeGrace:         aclPolicyPath.RevokeGrace,
+		forwards:            newForwardRegistry(),
+	}, nil
 }
+
 func (p *policyEnforcer) watchForPolicyChanges() error {
+	return watchPolicyFiles([]string{p.ipAclPolicyPath, p.domainAclPolicyPath, p.groupsPath, p.yamlPolicyPath}, p.reloadPolicy)
+}
+
+// watchPolicyFiles calls reload whenever one of the non-empty policy paths is written
+func watchPolicyFiles(policyPaths []string, reload func()) error {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -108,20 +185,7 @@ func (p *policyEnforcer) watchForPolicyChanges() error {
 				log.Debugf("event: %v", event)
 				if event.Op&fsnotify.Write == fsnotify.Write {
 					log.Debugf("Policy file change detected, reloading")
-					if err = p.IpEnforcer.LoadPolicy(); err != nil {
-						log.Error("Error reloading IpEnforcer policy")
-					} else {
-						log.Infof("IpEnforcer Policy Updated")
-						p.IpEnforcer.BuildRoleLinks()
-					}
-					if p.DomainEnforcer != nil {
-						if err = p.DomainEnforcer.LoadPolicy(); err != nil {
-							log.Error("Error reloading DomainEnforcer policy")
-						} else {
-							log.Infof("DomainEnforcer Policy Updated")
-							p.DomainEnforcer.BuildRoleLinks()
-						}
-					}
+					reload()
 				}
 			case err, ok := <-w.Errors:
 				if !ok {
@@ -132,41 +196,151 @@ func (p *policyEnforcer) watchForPolicyChanges() error {
 		}
 	}()
 
-	if err = w.Add(p.ipAclPolicyPath); err != nil {
-		return err
-	}
-	if p.domainAclPolicyPath != "" {
-		if err = w.Add(p.domainAclPolicyPath); err != nil {
+	for _, policyPath := range policyPaths {
+		if policyPath == "" {
+			continue
+		}
+		if err = w.Add(policyPath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
-func (p *policyEnforcer) AuthorizeForward(forwardAction ForwardAction) bool {
-	splitAddress := strings.Split(forwardAction.DestinationAddr, ":")
-	host := splitAddress[0]
 
-	var authorized bool
-	var authErr error
+// reloadPolicy loads the policy files again with the active grants, then closes the active forwards the new policy denies
+func (p *policyEnforcer) reloadPolicy() {
+	if p.grants != nil {
+		p.grants.reload(p)
+	} else {
+		p.loadPolicy(nil)
+	}
+	p.forwards.Reauthorize(p, p.revokeGrace)
+}
 
-	// determine if IP or hostname
-	addr := net.ParseIP(host)
-	if addr != nil {
-		authorized, authErr = p.IpEnforcer.Enforce(forwardAction.Subject, host, splitAddress[1], forwardAction.NetType)
+func (p *policyEnforcer) loadPolicy(grants []Grant) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.IpEnforcer.LoadPolicy(); err != nil {
+		log.Errorf("Error reloading IpEnforcer policy: %v", err)
 	} else {
-		authorized, authErr = p.DomainEnforcer.Enforce(forwardAction.Subject, host, splitAddress[1], forwardAction.NetType)
-		if authErr != nil && authorized {
-			// TODO: resolve the IP address, then additionally check it against the IpEnforcer
+		log.Infof("IpEnforcer Policy Updated")
+		p.IpEnforcer.BuildRoleLinks()
+	}
+	if p.DomainEnforcer != nil {
+		if err := p.DomainEnforcer.LoadPolicy(); err != nil {
+			log.Errorf("Error reloading DomainEnforcer policy: %v", err)
+		} else {
+			log.Infof("DomainEnforcer Policy Updated")
+			p.DomainEnforcer.BuildRoleLinks()
 		}
 	}
+	for _, grant := range grants {
+		p.addGrantRule(grant)
+	}
+}
+
+// holds reports if the enforcer can hold the grant, domain grants need a domain policy
+func (p *policyEnforcer) holds(grant Grant) bool {
+	_, domain := grant.rules()
+	return len(domain) == 0 || p.DomainEnforcer != nil
+}
+
+func (p *policyEnforcer) addGrant(grant Grant) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addGrantRule(grant)
+}
+
+// addGrantRule adds the allow rules of a grant, the caller holds the lock
+func (p *policyEnforcer) addGrantRule(grant Grant) {
+	if !p.holds(grant) {
+		log.Warnf("grant %s to %s ignored, there's no domain policy", grant.Id, grant.Destination)
+		return
+	}
+	ip, domain := grant.rules()
+	for _, rule := range ip {
+		if _, err := p.IpEnforcer.AddPolicy(rule); err != nil {
+			log.Errorf("can not add grant %s: %v", grant.Id, err)
+		}
+	}
+	for _, rule := range domain {
+		if _, err := p.DomainEnforcer.AddPolicy(rule); err != nil {
+			log.Errorf("can not add grant %s: %v", grant.Id, err)
+		}
+	}
+}
+
+// removeGrantRules removes the allow rules of a deleted grant
+func (p *policyEnforcer) removeGrantRules(ip [][]string, domain [][]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rule := range ip {
+		if _, err := p.IpEnforcer.RemovePolicy(rule); err != nil {
+			log.Errorf("can not remove grant rule %v: %v", rule, err)
+		}
+	}
+	if p.DomainEnforcer == nil {
+		return
+	}
+	for _, rule := range domain {
+		if _, err := p.DomainEnforcer.RemovePolicy(rule); err != nil {
+			log.Errorf("can not remove grant rule %v: %v", rule, err)
+		}
+	}
+}
+
+func (p *policyEnforcer) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	return p.forwards.TrackForward(forwardAction, closeForward)
+}
+
+func (p *policyEnforcer) AuthorizeForward(forwardAction ForwardAction) bool {
+	return p.Decide(forwardAction).Allowed
+}
+
+// AuthorizeResolved checks a resolved address of a domain forward against the IP policy
+func (p *policyEnforcer) AuthorizeResolved(forwardAction ForwardAction) bool {
+	return p.Decide(forwardAction).Allowed
+}
 
-	if authErr != nil {
-		log.Error(authErr)
-		return false
+// Decide authorizes a forward, explaining the rules that allowed or denied it
+func (p *policyEnforcer) Decide(forwardAction ForwardAction) PolicyDecision {
+	host, port, err := net.SplitHostPort(forwardAction.DestinationAddr)
+	if err != nil {
+		log.Errorf("invalid destination %s: %v", forwardAction.DestinationAddr, err)
+		return PolicyDecision{}
+	}
+
+	// determine if IP or hostname
+	decision := PolicyDecision{Policy: "domain"}
+	enforcer := p.DomainEnforcer
+	if addr := net.ParseIP(strings.SplitN(host, "%", 2)[0]); addr != nil {
+		decision.Policy = "ip"
+		enforcer = p.IpEnforcer
 	}
-	if !authorized {
-		return false
+	if enforcer == nil {
+		return decision
 	}
+	// domains are resolved by the router, which checks the resolved addresses against the IpEnforcer before dialing them
 
-	return true
+	// Any principal (subject or attribute) can grant access, but a deny on any of them wins
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var authorized, denied bool
+	for _, principal := range forwardAction.Principals() {
+		allowed, matched, err := enforcer.EnforceEx(principal, host, port, forwardAction.NetType)
+		if err != nil {
+			log.Error(err)
+			return PolicyDecision{Policy: decision.Policy, Matches: decision.Matches}
+		}
+		if len(matched) > 0 {
+			decision.Matches = append(decision.Matches, PolicyMatch{Principal: principal, Rule: matched})
+		}
+		if !allowed && len(matched) > 0 {
+			log.Debugf("%s denied by rule %v", principal, matched)
+			denied = true
+		}
+		authorized = authorized || allowed
+	}
+	decision.Allowed = authorized && !denied
+	return decision
 }
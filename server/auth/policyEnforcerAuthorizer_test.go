@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"edgeproxy/audit"
+	"edgeproxy/config"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyEnforcerSubjectAttributes(t *testing.T) {
+	ipPolicy := filepath.Join(t.TempDir(), "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, groups:admins, 10.0.0.1, 443, tcp, allow
+p, email:mallory@example.com, *, *, tcp, deny
+p, bob, 10.0.0.2, 443, tcp, allow
+`), 0600))
+	enforcer := NewPolicyEnforcer(config.AclCollection{IpPath: ipPolicy})
+
+	admin := ClaimsSubject{subject: "alice", attributes: map[string][]string{"groups": {"developers", "admins"}}}
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(admin, "10.0.0.1:443", "tcp")))
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(admin, "10.0.0.2:443", "tcp")))
+
+	bob := ClaimsSubject{subject: "bob"}
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(bob, "10.0.0.2:443", "tcp")))
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(bob, "10.0.0.1:443", "tcp")))
+
+	// An explicit deny on any attribute wins over the allowed ones
+	mallory := ClaimsSubject{subject: "mallory", attributes: map[string][]string{"groups": {"admins"}, "email": {"mallory@example.com"}}}
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(mallory, "10.0.0.1:443", "tcp")))
+
+	// Domains are denied without a domain policy
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(admin, "example.com:443", "tcp")))
+}
+
+func TestPolicyEnforcerIPv6(t *testing.T) {
+	ipPolicy := filepath.Join(t.TempDir(), "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, alice, 2001:db8::/32, 443, tcp, allow
+p, alice, 10.0.0.0/8, 22, tcp, allow
+p, alice, not-an-address, 22, tcp, allow
+`), 0600))
+	enforcer := NewPolicyEnforcer(config.AclCollection{IpPath: ipPolicy})
+	alice := ClaimsSubject{subject: "alice"}
+
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(alice, "[2001:db8::1]:443", "tcp")))
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(alice, "[2001:db8::1%eth0]:443", "tcp")))
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(alice, "[2001:db8::1]:22", "tcp")))
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(alice, "[2001:db9::1]:443", "tcp")))
+	// IPv4-mapped addresses match IPv4 networks, but IPv6 networks don't match IPv4 addresses
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(alice, "[::ffff:10.0.0.1]:22", "tcp")))
+	assert.False(t, cidrMatch("10.0.0.1", "::/0"))
+	// Malformed destinations are denied instead of panicking
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(alice, "2001:db8::1:443", "tcp")))
+	assert.False(t, enforcer.AuthorizeForward(NewForwardAction(alice, "10.0.0.1", "tcp")))
+}
+
+func TestPolicyPortRangesAndGroups(t *testing.T) {
+	dir := t.TempDir()
+	groups := filepath.Join(dir, "groups.yaml")
+	assert.NoError(t, ioutil.WriteFile(groups, []byte(`addresses:
+  office: [10.0.0.0/8, "2001:db8::/32"]
+  internal: ["*.internal.example.com"]
+services:
+  web: [tcp/80, tcp/443, tcp/8000-8100]
+  dns: [udp/53, tcp/53]
+`), 0600))
+	ipPolicy := filepath.Join(dir, "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, alice, 192.168.0.0/16, 1000-2000, tcp, allow
+p, alice, "172.16.0.1,172.16.0.2", "22,3000-3001", tcp, allow
+p, bob, @office, @web, *, allow
+p, bob, @office, @dns, udp, allow
+`), 0600))
+	domainPolicy := filepath.Join(dir, "domain_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(domainPolicy, []byte(`p, bob, @internal, @web, tcp, allow
+`), 0600))
+	enforcer := NewPolicyEnforcer(config.AclCollection{IpPath: ipPolicy, DomainPath: domainPolicy, GroupsPath: groups})
+	authorize := func(subject string, destination string, proto string) bool {
+		return enforcer.AuthorizeForward(NewForwardAction(ClaimsSubject{subject: subject}, destination, proto))
+	}
+
+	assert.True(t, authorize("alice", "192.168.1.1:1500", "tcp"))
+	assert.False(t, authorize("alice", "192.168.1.1:2001", "tcp"))
+	assert.True(t, authorize("alice", "172.16.0.2:3001", "tcp"))
+	assert.False(t, authorize("alice", "172.16.0.3:22", "tcp"))
+
+	assert.True(t, authorize("bob", "10.1.1.1:8050", "tcp"))
+	assert.True(t, authorize("bob", "[2001:db8::1]:443", "tcp"))
+	assert.False(t, authorize("bob", "10.1.1.1:22", "tcp"))
+	// The policy protocol filters the service group
+	assert.True(t, authorize("bob", "10.1.1.1:53", "udp"))
+	assert.False(t, authorize("bob", "10.1.1.1:53", "tcp"))
+	assert.True(t, authorize("bob", "git.internal.example.com:443", "tcp"))
+	assert.False(t, authorize("bob", "example.com:443", "tcp"))
+
+	// Policies referencing unknown groups are refused, the loaded policy is kept
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, bob, @unknown, @web, *, allow
+`), 0600))
+	enforcer.reloadPolicy()
+	assert.True(t, authorize("bob", "10.1.1.1:8050", "tcp"))
+
+	_, err := (&policyGroups{}).expand([]string{"alice", "10.0.0.1", "2000-1000", "tcp", "allow"})
+	assert.Error(t, err)
+}
+
+func TestPolicyDecisionLintAndRecording(t *testing.T) {
+	dir := t.TempDir()
+	ipPolicy := filepath.Join(dir, "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, groups:admins, 10.0.0.0/8, *, tcp, allow
+p, mallory, 10.0.0.1, *, tcp, deny
+p, bob, example.com, 22, tcp, allow
+p, bob, 10.0.0.2, 22, icmp, allow
+`), 0600))
+	checker, err := LoadPolicy(config.AclCollection{IpPath: ipPolicy})
+	assert.NoError(t, err)
+
+	mallory := ForwardAction{Subject: "mallory", Attributes: map[string][]string{"groups": {"admins"}}, DestinationAddr: "10.0.0.1:22", NetType: "tcp"}
+	decision := checker.Decide(mallory)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "ip", decision.Policy)
+	assert.Equal(t, []PolicyMatch{
+		{Principal: "mallory", Rule: []string{"mallory", "10.0.0.1", "*", "tcp", "deny"}},
+		{Principal: "groups:admins", Rule: []string{"groups:admins", "10.0.0.0/8", "*", "tcp", "allow"}},
+	}, decision.Matches)
+	assert.Len(t, checker.Lint(), 2)
+
+	// Recorded forwards are read back for policy diffs
+	records := filepath.Join(dir, "forwards.jsonl")
+	recorder, err := NewForwardRecorder(records)
+	assert.NoError(t, err)
+	authorizer := RecordForwards(checker, recorder)
+	assert.False(t, authorizer.AuthorizeForward(mallory))
+	_, tracked := authorizer.(ForwardTracker)
+	assert.True(t, tracked)
+	file, err := os.Open(records)
+	assert.NoError(t, err)
+	defer file.Close()
+	recorded, err := ReadForwardActions(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []ForwardAction{mallory}, recorded)
+}
+
+func TestPolicyReloadRevokesForwards(t *testing.T) {
+	ipPolicy := filepath.Join(t.TempDir(), "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, alice, 10.0.0.1, 443, tcp, allow
+p, bob, 10.0.0.1, 443, tcp, allow
+`), 0600))
+	enforcer := NewPolicyEnforcer(config.AclCollection{IpPath: ipPolicy})
+
+	closed := make(chan string, 2)
+	track := func(subject string) func() {
+		return enforcer.TrackForward(NewForwardAction(ClaimsSubject{subject: subject}, "10.0.0.1:443", "tcp"), func() { closed <- subject })
+	}
+	track("alice")
+	track("bob")
+	untrackFinished := track("carol")
+	untrackFinished()
+
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, alice, 10.0.0.1, 443, tcp, allow
+`), 0600))
+	enforcer.reloadPolicy()
+	select {
+	case subject := <-closed:
+		assert.Equal(t, "bob", subject)
+	default:
+		t.Fatal("denied forward not closed")
+	}
+	assert.Empty(t, closed)
+}
+
+func TestForwardRevokeGrace(t *testing.T) {
+	var allowed int32 = 0
+	authorizer := authorizeFunc(func(ForwardAction) bool { return atomic.LoadInt32(&allowed) == 1 })
+	registry := newForwardRegistry()
+	closed := make(chan struct{}, 1)
+	registry.TrackForward(ForwardAction{Subject: "alice"}, func() { closed <- struct{}{} })
+
+	// Allowed again before the grace period elapses, the forward is kept
+	registry.Reauthorize(authorizer, 50*time.Millisecond)
+	atomic.StoreInt32(&allowed, 1)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, closed)
+
+	atomic.StoreInt32(&allowed, 0)
+	registry.Reauthorize(authorizer, 50*time.Millisecond)
+	assert.Empty(t, closed)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("denied forward not closed after the grace period")
+	}
+}
+
+// auditEvents collects the audit events
+type auditEvents chan audit.Event
+
+func (e auditEvents) Write(event audit.Event) {
+	e <- event
+}
+
+func TestShadowAuthorizer(t *testing.T) {
+	events := make(auditEvents, 2)
+	audit.SetSink(events)
+	defer audit.SetSink(nil)
+
+	enforcing := authorizeFunc(func(forwardAction ForwardAction) bool { return forwardAction.Subject == "alice" })
+	shadow := authorizeFunc(func(forwardAction ForwardAction) bool { return forwardAction.NetType == "tcp" })
+	authorizer := NewShadowAuthorizer(enforcing, shadow)
+
+	// Only the enforcing policy decides
+	assert.True(t, authorizer.AuthorizeForward(ForwardAction{Subject: "alice", DestinationAddr: "10.0.0.1:22", NetType: "tcp"}))
+	assert.True(t, authorizer.AuthorizeForward(ForwardAction{Subject: "alice", DestinationAddr: "10.0.0.1:53", NetType: "udp"}))
+	assert.False(t, authorizer.AuthorizeForward(ForwardAction{Subject: "bob", DestinationAddr: "10.0.0.1:22", NetType: "tcp"}))
+
+	for _, expected := range []string{"allow_deny", "deny_allow"} {
+		select {
+		case event := <-events:
+			assert.Equal(t, audit.PolicyShadowDisagreementEvent, event.Type)
+			assert.Equal(t, expected, event.Reason)
+		default:
+			t.Fatal("disagreement not audited")
+		}
+	}
+	assert.Empty(t, events)
+}
+
+func TestGrantStore(t *testing.T) {
+	events := make(auditEvents, 10)
+	audit.SetSink(events)
+	defer audit.SetSink(nil)
+
+	dir := t.TempDir()
+	ipPolicy := filepath.Join(dir, "ip_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(ipPolicy, []byte(`p, alice, 10.0.0.1, 443, tcp, allow
+`), 0600))
+	enforcer, err := loadPolicyEnforcer(config.AclCollection{IpPath: ipPolicy})
+	if !assert.NoError(t, err) {
+		return
+	}
+	grantsPath := filepath.Join(dir, "grants.json")
+	grants, err := NewGrantStore(grantsPath, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	grants.Attach(enforcer)
+	bob := ForwardAction{Subject: "bob", DestinationAddr: "10.0.0.5:22", NetType: "tcp"}
+	assert.False(t, enforcer.AuthorizeForward(bob))
+
+	for _, invalid := range []Grant{
+		{Subject: "bob", Destination: "*", Ports: "22", Expiry: time.Now().Add(time.Minute), Reason: "incident"},
+		{Subject: "bob", Destination: "10.0.0.5", Ports: "22", Expiry: time.Now().Add(2 * time.Hour), Reason: "incident"},
+		{Subject: "bob", Destination: "10.0.0.5", Ports: "22", Expiry: time.Now().Add(time.Minute)},
+		{Subject: "bob", Destination: "*.example.com", Ports: "22", Expiry: time.Now().Add(time.Minute), Reason: "incident"},
+		// there's no domain policy to hold it
+		{Subject: "bob", Destination: "localhost", Ports: "22", Expiry: time.Now().Add(time.Minute), Reason: "incident"},
+	} {
+		_, err = grants.Create(invalid, "admin")
+		assert.Error(t, err)
+	}
+
+	grant, err := grants.Create(Grant{Subject: "bob", Destination: "10.0.0.0/24", Ports: "22", Expiry: time.Now().Add(time.Minute), Reason: "incident"}, "admin")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", grant.Protocol)
+	assert.True(t, enforcer.AuthorizeForward(bob))
+	// grants survive policy reloads and restarts
+	enforcer.reloadPolicy()
+	assert.True(t, enforcer.AuthorizeForward(bob))
+	restarted, err := NewGrantStore(grantsPath, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, roundTrip(t, []Grant{grant}), roundTrip(t, restarted.Grants()))
+
+	assert.True(t, grants.Revoke(grant.Id, "admin"))
+	assert.False(t, grants.Revoke(grant.Id, "admin"))
+	assert.False(t, enforcer.AuthorizeForward(bob))
+
+	// expired grants are removed and close the forwards they allowed
+	_, err = grants.Create(Grant{Subject: "bob", Destination: "10.0.0.5", Ports: "20-23", Expiry: time.Now().Add(100 * time.Millisecond), Reason: "incident"}, "admin")
+	assert.NoError(t, err)
+	assert.True(t, enforcer.AuthorizeForward(bob))
+	closed := make(chan struct{}, 1)
+	enforcer.TrackForward(bob, func() { closed <- struct{}{} })
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("forward not closed when its grant expired")
+	}
+	assert.False(t, enforcer.AuthorizeForward(bob))
+	assert.Empty(t, grants.Grants())
+
+	var audited []audit.EventType
+	for len(events) > 0 {
+		audited = append(audited, (<-events).Type)
+	}
+	assert.Equal(t, []audit.EventType{audit.GrantCreatedEvent, audit.GrantRevokedEvent, audit.GrantCreatedEvent,
+		audit.ForwardRevokedEvent, audit.GrantExpiredEvent}, audited)
+
+	// domain grants allow the addresses they resolve to on the IP policy, which checks the resolved forwards
+	domainPolicy := filepath.Join(dir, "domain_policy.csv")
+	assert.NoError(t, ioutil.WriteFile(domainPolicy, []byte(`p, alice, example.com, 443, tcp, allow
+`), 0600))
+	domainEnforcer, err := loadPolicyEnforcer(config.AclCollection{IpPath: ipPolicy, DomainPath: domainPolicy})
+	if !assert.NoError(t, err) {
+		return
+	}
+	grants.Attach(domainEnforcer)
+	grant, err = grants.Create(Grant{Subject: "bob", Destination: "localhost", Ports: "22", Expiry: time.Now().Add(time.Minute), Reason: "incident"}, "admin")
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, grant.Addresses) {
+		return
+	}
+	resolved := ForwardAction{Subject: "bob", DestinationAddr: net.JoinHostPort(grant.Addresses[0], "22"), NetType: "tcp"}
+	assert.True(t, domainEnforcer.AuthorizeForward(ForwardAction{Subject: "bob", DestinationAddr: "localhost:22", NetType: "tcp"}))
+	assert.True(t, domainEnforcer.AuthorizeForward(resolved))
+	assert.True(t, grants.Revoke(grant.Id, "admin"))
+	assert.False(t, domainEnforcer.AuthorizeForward(resolved))
+}
+
+// roundTrip encodes and decodes grants, as persisted times lose their monotonic clock and location
+func roundTrip(t *testing.T, grants []Grant) []Grant {
+	content, err := json.Marshal(grants)
+	assert.NoError(t, err)
+	var decoded []Grant
+	assert.NoError(t, json.Unmarshal(content, &decoded))
+	return decoded
+}
+
+type authorizeFunc func(ForwardAction) bool
+
+func (f authorizeFunc) AuthorizeForward(forwardAction ForwardAction) bool {
+	return f(forwardAction)
+}
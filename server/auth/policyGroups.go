@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"gopkg.in/yaml.v3"
+)
+
+// policyGroups are named groups referenced from the policies as @name, resolved when the policies are loaded.
+// Address groups are addresses, networks or domain globs, service groups are protocol/ports entries:
+//
+//	addresses:
+//	  office: [10.0.0.0/8, 2001:db8::/32]
+//	services:
+//	  web: [tcp/80, tcp/443, tcp/8000-8100]
+type policyGroups struct {
+	Addresses map[string][]string `yaml:"addresses"`
+	Services  map[string][]string `yaml:"services"`
+}
+
+// service is a service group entry, the ports of a protocol
+type service struct {
+	proto string
+	ports string
+}
+
+func loadPolicyGroups(groupsPath string) (*policyGroups, error) {
+	groups := &policyGroups{}
+	if groupsPath == "" {
+		return groups, nil
+	}
+	file, err := os.Open(groupsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(groups); err != nil {
+		return nil, fmt.Errorf("invalid policy groups %s: %v", groupsPath, err)
+	}
+	for name, addresses := range groups.Addresses {
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("address group %s is empty", name)
+		}
+	}
+	for name := range groups.Services {
+		if _, err = groups.service(name); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// merge returns the groups with the given ones added, names can't be defined twice
+func (g *policyGroups) merge(addresses map[string][]string, services map[string][]string) (*policyGroups, error) {
+	merged := &policyGroups{Addresses: map[string][]string{}, Services: map[string][]string{}}
+	for _, source := range []*policyGroups{g, {Addresses: addresses, Services: services}} {
+		for name, entries := range source.Addresses {
+			if _, ok := merged.Addresses[name]; ok {
+				return nil, fmt.Errorf("address group %s is defined twice", name)
+			}
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("address group %s is empty", name)
+			}
+			merged.Addresses[name] = entries
+		}
+		for name, entries := range source.Services {
+			if _, ok := merged.Services[name]; ok {
+				return nil, fmt.Errorf("service group %s is defined twice", name)
+			}
+			merged.Services[name] = entries
+			if _, err := merged.service(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return merged, nil
+}
+
+func (g *policyGroups) service(name string) ([]service, error) {
+	entries, ok := g.Services[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service group @%s", name)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("service group %s is empty", name)
+	}
+	var services []service
+	for _, entry := range entries {
+		split := strings.SplitN(entry, "/", 2)
+		if len(split) != 2 || (split[0] != "tcp" && split[0] != "udp") {
+			return nil, fmt.Errorf("invalid service %s in group %s, expected tcp/<ports> or udp/<ports>", entry, name)
+		}
+		if err := validatePorts(split[1]); err != nil {
+			return nil, fmt.Errorf("invalid service %s in group %s: %v", entry, name, err)
+		}
+		services = append(services, service{proto: split[0], ports: split[1]})
+	}
+	return services, nil
+}
+
+// expand resolves the group references of a sub, destination, port, proto, eft policy. Service groups
+// set the protocol, a policy on a service group gets a rule for every protocol unless it names one.
+func (g *policyGroups) expand(rule []string) ([][]string, error) {
+	if len(rule) < 4 {
+		return nil, fmt.Errorf("expected subject, destination, port, protocol and effect")
+	}
+	rule = append([]string{}, rule...)
+	if strings.HasPrefix(rule[1], "@") {
+		addresses, ok := g.Addresses[rule[1][1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown address group %s", rule[1])
+		}
+		rule[1] = strings.Join(addresses, ",")
+	}
+	if !strings.HasPrefix(rule[2], "@") {
+		if err := validatePorts(rule[2]); err != nil {
+			return nil, err
+		}
+		return [][]string{rule}, nil
+	}
+
+	services, err := g.service(rule[2][1:])
+	if err != nil {
+		return nil, err
+	}
+	var protos []string
+	ports := map[string][]string{}
+	for _, s := range services {
+		if rule[3] != "*" && rule[3] != s.proto {
+			continue
+		}
+		if _, ok := ports[s.proto]; !ok {
+			protos = append(protos, s.proto)
+		}
+		ports[s.proto] = append(ports[s.proto], s.ports)
+	}
+	if len(protos) == 0 {
+		return nil, fmt.Errorf("service group %s has no %s ports", rule[2], rule[3])
+	}
+	var rules [][]string
+	for _, proto := range protos {
+		expanded := append([]string{}, rule...)
+		expanded[2] = strings.Join(ports[proto], ",")
+		expanded[3] = proto
+		rules = append(rules, expanded)
+	}
+	return rules, nil
+}
+
+// groupsAdapter resolves the group references of the policies loaded by the wrapped adapter,
+// the groups file is read again on every load
+type groupsAdapter struct {
+	persist.Adapter
+	groupsPath string
+}
+
+func (a groupsAdapter) LoadPolicy(m model.Model) error {
+	groups, err := loadPolicyGroups(a.groupsPath)
+	if err != nil {
+		return err
+	}
+	if err = a.Adapter.LoadPolicy(m); err != nil {
+		return err
+	}
+	ast, ok := m["p"]["p"]
+	if !ok {
+		return nil
+	}
+	var rules [][]string
+	for _, rule := range ast.Policy {
+		expanded, err := groups.expand(rule)
+		if err != nil {
+			return fmt.Errorf("policy %s: %v", strings.Join(rule, ", "), err)
+		}
+		rules = append(rules, expanded...)
+	}
+	ast.Policy = rules
+	ast.PolicyMap = make(map[string]int, len(rules))
+	for i, rule := range rules {
+		ast.PolicyMap[strings.Join(rule, model.DefaultSep)] = i
+	}
+	return nil
+}
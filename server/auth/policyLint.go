@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rules returns the loaded ip and domain policy rules, with the group references resolved
+func (p *policyEnforcer) Rules() (ip [][]string, domain [][]string) {
+	ip = p.IpEnforcer.GetPolicy()
+	if p.DomainEnforcer != nil {
+		domain = p.DomainEnforcer.GetPolicy()
+	}
+	return ip, domain
+}
+
+// Summary describes the loaded policy
+func (p *policyEnforcer) Summary() string {
+	ip, domain := p.Rules()
+	return fmt.Sprintf("%d ip rules, %d domain rules", len(ip), len(domain))
+}
+
+// Lint reports the rules that never match: domains on the ip policy, addresses on the domain policy,
+// invalid ports, protocols or effects
+func (p *policyEnforcer) Lint() []string {
+	var problems []string
+	ip, domain := p.Rules()
+	for _, policy := range []struct {
+		name  string
+		kind  string
+		rules [][]string
+	}{{"ip", "ip", ip}, {"domain", "domain", domain}} {
+		for _, rule := range policy.rules {
+			if problem := lintRule(rule, policy.kind); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s policy rule %s: %s", policy.name, strings.Join(rule, ", "), problem))
+			}
+		}
+	}
+	return problems
+}
+
+func lintRule(rule []string, kind string) string {
+	if len(rule) != 5 {
+		return "expected subject, destination, port, protocol and effect"
+	}
+	for _, destination := range strings.Split(rule[1], ",") {
+		destination = strings.TrimSpace(destination)
+		destinationKind, err := destinationKind(destination)
+		if err != nil {
+			return err.Error()
+		}
+		if destinationKind != "*" && destinationKind != kind {
+			return fmt.Sprintf("%s never matches on the %s policy", destination, kind)
+		}
+	}
+	if err := validatePorts(rule[2]); err != nil {
+		return err.Error()
+	}
+	if rule[3] != "tcp" && rule[3] != "udp" {
+		return fmt.Sprintf("invalid protocol %q, expected tcp or udp", rule[3])
+	}
+	if rule[4] != "allow" && rule[4] != "deny" {
+		return fmt.Sprintf("invalid effect %q, expected allow or deny", rule[4])
+	}
+	return ""
+}
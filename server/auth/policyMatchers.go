@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Policy destinations and ports are lists separated by commas, quoted on the CSV files:
+// p, alice, "10.0.0.0/8,2001:db8::/32", "22,80,8000-8100", tcp, allow
+
+// matcherFunc adapts a matcher of a request value against a policy list to a casbin function
+func matcherFunc(name string, match func(value string, pattern string) bool) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return false, fmt.Errorf("%s: expected 2 arguments, got %d", name, len(args))
+		}
+		value, _ := args[0].(string)
+		patterns, _ := args[1].(string)
+		for _, pattern := range strings.Split(patterns, ",") {
+			if match(value, strings.TrimSpace(pattern)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// cidrMatch matches addresses against IPv4 and IPv6 networks or addresses. Unlike the casbin ipMatch
+// it doesn't panic on invalid values, IPv6 zones are ignored, IPv4-mapped IPv6 addresses match IPv4 networks
+// and * matches any address.
+func cidrMatch(ip string, network string) bool {
+	addr := net.ParseIP(strings.SplitN(ip, "%", 2)[0])
+	if addr == nil {
+		return false
+	}
+	if network == "*" {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(network); err == nil {
+		return cidr.Contains(addr)
+	}
+	other := net.ParseIP(network)
+	return other != nil && addr.Equal(other)
+}
+
+// domainMatch matches domains against * globs
+func domainMatch(domain string, pattern string) bool {
+	matched, err := path.Match(pattern, domain)
+	return err == nil && matched
+}
+
+// portMatch matches ports against a port, a range (1000-2000) or a * glob
+func portMatch(port string, pattern string) bool {
+	if low, high, ok := parsePortRange(pattern); ok {
+		p, err := strconv.Atoi(port)
+		return err == nil && p >= low && p <= high
+	}
+	matched, err := path.Match(pattern, port)
+	return err == nil && matched
+}
+
+func parsePortRange(pattern string) (low int, high int, ok bool) {
+	bounds := strings.SplitN(pattern, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	low, lowErr := strconv.Atoi(bounds[0])
+	high, highErr := strconv.Atoi(bounds[1])
+	return low, high, lowErr == nil && highErr == nil
+}
+
+// validatePorts checks a policy port list, ranges must be ordered and within 0-65535
+func validatePorts(ports string) error {
+	for _, pattern := range strings.Split(ports, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if low, high, ok := parsePortRange(pattern); ok {
+			if low < 0 || high > 65535 || low > high {
+				return fmt.Errorf("invalid port range %s", pattern)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid port %q", pattern)
+		}
+	}
+	return nil
+}
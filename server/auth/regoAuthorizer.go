@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRegoQuery must be true to allow a forward
+	defaultRegoQuery = "data.edgeproxy.allow"
+	regoEvalTimeout  = time.Second
+)
+
+// regoAuthorizer evaluates an OPA Rego module, the query must be true to allow a forward. The input is
+// built from the forward action:
+//
+//	{"subject": "spiffe://example.com/users/alice", "attributes": {"groups": ["sre"]},
+//	 "principals": ["spiffe://example.com/users/alice", "groups:sre"], "destination": "10.0.0.1:22",
+//	 "host": "10.0.0.1", "port": 22, "destinationType": "ip", "network": "tcp", "client": {"remoteIp": "203.0.113.7"}}
+type regoAuthorizer struct {
+	regoPath    string
+	query       string
+	revokeGrace time.Duration
+	forwards    *forwardRegistry
+	decisionLog *decisionLogger
+	mu          sync.RWMutex
+	prepared    rego.PreparedEvalQuery
+	module      *ast.Module
+	// revision is the sha256 of the module, recorded on the decision logs
+	revision string
+}
+
+// decisionLogEntry is a decision log line, in the OPA decision log format
+type decisionLogEntry struct {
+	DecisionId string                 `json:"decision_id"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Path       string                 `json:"path"`
+	Revision   string                 `json:"revision"`
+	Input      map[string]interface{} `json:"input"`
+	Result     interface{}            `json:"result,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// decisionLogger appends the Rego decisions to a JSON lines file
+type decisionLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewRegoAuthorizer loads the Rego policy of the acl, reloading it when the module changes
+func NewRegoAuthorizer(aclPolicyPath config.AclCollection) *regoAuthorizer {
+	r, err := loadRegoAuthorizer(aclPolicyPath)
+	if err != nil {
+		log.Fatalf("cannot load rego policy: %v", err)
+	}
+	if aclPolicyPath.DecisionLogPath != "" {
+		file, err := os.OpenFile(aclPolicyPath.DecisionLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("cannot open rego decision log: %v", err)
+		}
+		r.decisionLog = &decisionLogger{file: file}
+	}
+	go watchPolicyFiles([]string{r.regoPath}, r.reloadPolicy)
+	return r
+}
+
+func loadRegoAuthorizer(aclPolicyPath config.AclCollection) (*regoAuthorizer, error) {
+	r := &regoAuthorizer{
+		regoPath:    aclPolicyPath.RegoPath,
+		query:       aclPolicyPath.RegoQuery,
+		revokeGrace: aclPolicyPath.RevokeGrace,
+		forwards:    newForwardRegistry(),
+	}
+	if r.query == "" {
+		r.query = defaultRegoQuery
+	}
+	return r, r.load()
+}
+
+// load parses the module and prepares the query, the current module is kept on errors
+func (r *regoAuthorizer) load() error {
+	content, err := ioutil.ReadFile(r.regoPath)
+	if err != nil {
+		return err
+	}
+	module, err := ast.ParseModule(r.regoPath, string(content))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), regoEvalTimeout)
+	defer cancel()
+	prepared, err := rego.New(
+		rego.Query(r.query),
+		rego.ParsedModule(module),
+		rego.StrictBuiltinErrors(true),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return err
+	}
+	revision := sha256.Sum256(content)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prepared = prepared
+	r.module = module
+	r.revision = hex.EncodeToString(revision[:])
+	return nil
+}
+
+// reloadPolicy loads the module again, then closes the active forwards the new policy denies
+func (r *regoAuthorizer) reloadPolicy() {
+	if err := r.load(); err != nil {
+		log.Errorf("Error reloading Rego policy: %v", err)
+		return
+	}
+	log.Infof("Rego Policy Updated")
+	r.forwards.Reauthorize(r, r.revokeGrace)
+}
+
+func (r *regoAuthorizer) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	return r.forwards.TrackForward(forwardAction, closeForward)
+}
+
+func (r *regoAuthorizer) AuthorizeForward(forwardAction ForwardAction) bool {
+	return r.Decide(forwardAction).Allowed
+}
+
+// AuthorizeResolved evaluates the query for a resolved address of a domain forward, as an ip destination
+func (r *regoAuthorizer) AuthorizeResolved(forwardAction ForwardAction) bool {
+	return r.Decide(forwardAction).Allowed
+}
+
+// Decide evaluates the query, only a true result allows the forward
+func (r *regoAuthorizer) Decide(forwardAction ForwardAction) PolicyDecision {
+	input := regoInput(forwardAction)
+	r.mu.RLock()
+	prepared, revision := r.prepared, r.revision
+	r.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), regoEvalTimeout)
+	defer cancel()
+	results, err := prepared.Eval(ctx, rego.EvalInput(input))
+	decision := PolicyDecision{Policy: "rego"}
+	var result interface{}
+	switch {
+	case err != nil:
+		log.Errorf("Rego policy evaluation failed for %s access to %s/%s: %v", forwardAction.Subject,
+			forwardAction.NetType, forwardAction.DestinationAddr, err)
+		metrics.IncrementAuthRegoDecisions("error")
+	case len(results) > 0 && len(results[0].Expressions) > 0:
+		result = results[0].Expressions[0].Value
+		decision.Allowed = result == true
+		metrics.IncrementAuthRegoDecisions(decisionName(decision.Allowed))
+	default:
+		metrics.IncrementAuthRegoDecisions(decisionName(false))
+	}
+	if result != nil {
+		encoded, _ := json.Marshal(result)
+		decision.Matches = []PolicyMatch{{Principal: r.query, Rule: []string{string(encoded)}}}
+	}
+	if r.decisionLog != nil {
+		entry := decisionLogEntry{Timestamp: time.Now(), Path: r.query, Revision: revision, Input: input, Result: result}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		r.decisionLog.log(entry)
+	}
+	return decision
+}
+
+// Lint reports the problems found by the strict Rego compiler: unused variables, imports and arguments
+func (r *regoAuthorizer) Lint() []string {
+	r.mu.RLock()
+	module := r.module
+	r.mu.RUnlock()
+	compiler := ast.NewCompiler().WithStrict(true)
+	compiler.Compile(map[string]*ast.Module{r.regoPath: module})
+	var problems []string
+	for _, err := range compiler.Errors {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// Rules returns no casbin rules, the Rego module replaces them
+func (r *regoAuthorizer) Rules() (ip [][]string, domain [][]string) {
+	return nil, nil
+}
+
+// Summary describes the loaded policy
+func (r *regoAuthorizer) Summary() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return fmt.Sprintf("rego package %s, %d rules, query %s", strings.TrimPrefix(r.module.Package.Path.String(), "data."),
+		len(r.module.Rules), r.query)
+}
+
+// regoInput builds the query input of a forward action
+func regoInput(forwardAction ForwardAction) map[string]interface{} {
+	host, port, _ := net.SplitHostPort(forwardAction.DestinationAddr)
+	portNumber, _ := strconv.Atoi(port)
+	destinationType := "domain"
+	if net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		destinationType = "ip"
+	}
+	attributes := map[string]interface{}{}
+	for name, values := range forwardAction.Attributes {
+		attributes[name] = stringList(values)
+	}
+	client := map[string]interface{}{}
+	for name, value := range forwardAction.Client {
+		client[name] = value
+	}
+	return map[string]interface{}{
+		"subject":         forwardAction.Subject,
+		"attributes":      attributes,
+		"principals":      stringList(forwardAction.Principals()),
+		"destination":     forwardAction.DestinationAddr,
+		"host":            host,
+		"port":            portNumber,
+		"destinationType": destinationType,
+		"network":         forwardAction.NetType,
+		"client":          client,
+	}
+}
+
+func stringList(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
+}
+
+func (d *decisionLogger) log(entry decisionLogEntry) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	entry.DecisionId = hex.EncodeToString(id)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("can not log rego decision: %v", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err = d.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("can not log rego decision: %v", err)
+	}
+}
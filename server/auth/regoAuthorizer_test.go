@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"edgeproxy/config"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegoAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	regoPath := filepath.Join(dir, "policy.rego")
+	assert.NoError(t, ioutil.WriteFile(regoPath, []byte(`package edgeproxy
+
+default allow = false
+
+allow {
+	input.principals[_] == "groups:sre"
+	input.destinationType == "ip"
+	net.cidr_contains("10.0.0.0/8", input.host)
+	input.port == 22
+}
+
+allow {
+	input.subject == "alice"
+	endswith(input.host, ".internal.example.com")
+	input.client.tunnel == "/"
+}
+`), 0600))
+	decisionLog := filepath.Join(dir, "decisions.jsonl")
+	authorizer := NewRegoAuthorizer(config.AclCollection{RegoPath: regoPath, DecisionLogPath: decisionLog})
+
+	sre := ForwardAction{Subject: "bob", Attributes: map[string][]string{"groups": {"sre"}}, DestinationAddr: "10.1.2.3:22", NetType: "tcp"}
+	assert.True(t, authorizer.AuthorizeForward(sre))
+	sre.DestinationAddr = "10.1.2.3:443"
+	assert.False(t, authorizer.AuthorizeForward(sre))
+	alice := ForwardAction{Subject: "alice", DestinationAddr: "git.internal.example.com:443", NetType: "tcp", Client: map[string]string{"tunnel": "/"}}
+	assert.True(t, authorizer.AuthorizeForward(alice))
+	assert.Empty(t, authorizer.Lint())
+
+	content, err := ioutil.ReadFile(decisionLog)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(t, lines, 3) {
+		var entry decisionLogEntry
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+		assert.Equal(t, defaultRegoQuery, entry.Path)
+		assert.Equal(t, false, entry.Result)
+		assert.Equal(t, "10.1.2.3:443", entry.Input["destination"])
+		assert.NotEmpty(t, entry.DecisionId)
+		assert.NotEmpty(t, entry.Revision)
+	}
+
+	// reloads close the forwards the new module denies, invalid modules are ignored
+	closed := make(chan struct{}, 1)
+	authorizer.TrackForward(alice, func() { closed <- struct{}{} })
+	assert.NoError(t, ioutil.WriteFile(regoPath, []byte("package edgeproxy\n\nallow {\n"), 0600))
+	authorizer.reloadPolicy()
+	assert.Empty(t, closed)
+	assert.NoError(t, ioutil.WriteFile(regoPath, []byte("package edgeproxy\n\nallow {\n\tx := input.subject\n\tinput.port == 22\n}\n"), 0600))
+	authorizer.reloadPolicy()
+	assert.Len(t, closed, 1)
+	// the strict compiler reports the unused variable
+	assert.NotEmpty(t, authorizer.Lint())
+
+	_, err = LoadPolicy(config.AclCollection{RegoPath: filepath.Join(dir, "missing.rego")})
+	assert.Error(t, err)
+}
+
+func TestRegoExamplePolicy(t *testing.T) {
+	decisionLog := filepath.Join(t.TempDir(), "decisions.jsonl")
+	authorizer := NewRegoAuthorizer(config.AclCollection{RegoPath: "../../resources/example_policy.rego", DecisionLogPath: decisionLog})
+	giphy := func(destination string) bool {
+		return authorizer.AuthorizeForward(ForwardAction{Subject: "spiffe://example.com/users/good-user-123", DestinationAddr: destination, NetType: "tcp"})
+	}
+	assert.True(t, giphy("media.giphy.com:443"))
+	assert.True(t, giphy("34.117.59.81:80"))
+	// domains are denied without built-in errors
+	assert.False(t, giphy("evil.com:80"))
+
+	content, err := ioutil.ReadFile(decisionLog)
+	assert.NoError(t, err)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry decisionLogEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Empty(t, entry.Error)
+	}
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"edgeproxy/audit"
+	"edgeproxy/client/clientauth"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNonceCacheSize = 100000
+	defaultTokenMaxAge    = 10 * time.Minute
+	defaultTokenLeeway    = time.Minute
+	// expired ids are pruned at most once per interval, or when the cache is full
+	noncePruneInterval = time.Minute
+)
+
+// tokenRejectedError explains why a validly signed client token is refused
+type tokenRejectedError struct {
+	reason string
+	detail string
+}
+
+func (e *tokenRejectedError) Error() string {
+	return fmt.Sprintf("token rejected (%s): %s", e.reason, e.detail)
+}
+
+func rejectToken(reason, format string, args ...interface{}) error {
+	return &tokenRejectedError{reason: reason, detail: fmt.Sprintf(format, args...)}
+}
+
+// tokenReplayGuard rejects client tokens already used, too old, or bound to another endpoint or TLS certificate.
+// Used token ids are remembered until the token expires, the cache is bounded and refuses new tokens when full.
+type tokenReplayGuard struct {
+	mu              sync.Mutex
+	seen            map[string]time.Time
+	lastPrune       time.Time
+	maxEntries      int
+	maxAge          time.Duration
+	leeway          time.Duration
+	bindEndpoint    bool
+	bindCertificate bool
+	now             func() time.Time
+}
+
+func newTokenReplayGuard(tokenConfig config.ClientTokenConfig) *tokenReplayGuard {
+	g := &tokenReplayGuard{
+		seen:            map[string]time.Time{},
+		maxEntries:      tokenConfig.NonceCacheSize,
+		maxAge:          tokenConfig.MaxAge,
+		leeway:          tokenConfig.Leeway,
+		bindEndpoint:    tokenConfig.BindEndpoint,
+		bindCertificate: tokenConfig.BindCertificate,
+		now:             time.Now,
+	}
+	if g.maxEntries <= 0 {
+		g.maxEntries = defaultNonceCacheSize
+	}
+	if g.maxAge <= 0 {
+		g.maxAge = defaultTokenMaxAge
+	}
+	if g.leeway <= 0 {
+		g.leeway = defaultTokenLeeway
+	}
+	return g
+}
+
+// Check validates the claims of a token whose signature is already verified, and remembers its id
+func (g *tokenReplayGuard) Check(r *http.Request, subject string, claims *clientauth.ClientAuthorizationClaims) error {
+	err := g.check(r, subject, claims)
+	if rejected, ok := err.(*tokenRejectedError); ok {
+		metrics.IncrementAuthTokenRejected(rejected.reason)
+		audit.Log(audit.Event{
+			Type:       audit.TokenRejectedEvent,
+			Subject:    subject,
+			RemoteAddr: r.RemoteAddr,
+			Reason:     rejected.reason,
+			Fields:     map[string]interface{}{"jti": tokenID(claims)},
+		})
+	}
+	return err
+}
+
+func (g *tokenReplayGuard) check(r *http.Request, subject string, claims *clientauth.ClientAuthorizationClaims) error {
+	now := g.now()
+	if claims.ExpiresAt == 0 {
+		return rejectToken("missing_exp", "token has no expiration")
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	// the replay cache only needs to remember tokens for their lifetime, so long lived tokens are refused
+	if expiresAt.Sub(now) > g.maxAge+g.leeway {
+		return rejectToken("lifetime", "token expires at %s, more than %s", expiresAt, g.maxAge)
+	}
+	if claims.IssuedAt != 0 {
+		issuedAt := time.Unix(claims.IssuedAt, 0)
+		if issuedAt.After(now.Add(g.leeway)) {
+			return rejectToken("iat", "token issued in the future %s", issuedAt)
+		}
+		if now.Sub(issuedAt) > g.maxAge+g.leeway {
+			return rejectToken("iat", "token issued at %s, older than %s", issuedAt, g.maxAge)
+		}
+	}
+	if g.bindEndpoint && !endpointMatches(claims.Endpoint, r) {
+		return rejectToken("endpoint_binding", "token bound to %q used on %s%s", claims.Endpoint, r.Host, r.URL.Path)
+	}
+	if g.bindCertificate && !certificateMatches(claims.Confirmation, r) {
+		return rejectToken("certificate_binding", "token not bound to the TLS client certificate")
+	}
+
+	id := tokenID(claims)
+	if id == "" {
+		return rejectToken("missing_jti", "token has no jti nor nonce")
+	}
+	return g.remember(subject+"|"+id, expiresAt.Add(g.leeway), now)
+}
+
+func (g *tokenReplayGuard) remember(key string, expiresAt, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seenUntil, ok := g.seen[key]; ok && now.Before(seenUntil) {
+		return rejectToken("replay", "token already used")
+	}
+	if len(g.seen) >= g.maxEntries || now.Sub(g.lastPrune) > noncePruneInterval {
+		g.prune(now)
+	}
+	if len(g.seen) >= g.maxEntries {
+		return rejectToken("nonce_cache_full", "%d token ids remembered", len(g.seen))
+	}
+	g.seen[key] = expiresAt
+	metrics.SetAuthNonceCacheSize(len(g.seen))
+	return nil
+}
+
+func (g *tokenReplayGuard) prune(now time.Time) {
+	for key, expiresAt := range g.seen {
+		if !now.Before(expiresAt) {
+			delete(g.seen, key)
+		}
+	}
+	g.lastPrune = now
+}
+
+// tokenID returns the jti, or the nonce sent by older clients
+func tokenID(claims *clientauth.ClientAuthorizationClaims) string {
+	if claims.Id != "" {
+		return claims.Id
+	}
+	return claims.Nonce
+}
+
+// endpointMatches checks the htu claim against the host and path the request was sent to
+func endpointMatches(endpoint string, r *http.Request) bool {
+	if endpoint == "" {
+		return false
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.EqualFold(stripDefaultPort(u.Host), stripDefaultPort(r.Host)) && path == r.URL.Path
+}
+
+func stripDefaultPort(host string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(host, ":443"), ":80")
+}
+
+// certificateMatches checks the cnf claim against the certificate presented on the TLS handshake
+func certificateMatches(confirmation *clientauth.TokenConfirmation, r *http.Request) bool {
+	if confirmation == nil || confirmation.CertificateThumbprint == "" || !hasPeerCertificate(r) {
+		return false
+	}
+	return confirmation.CertificateThumbprint == clientauth.CertificateThumbprint(r.TLS.PeerCertificates[0].Raw)
+}
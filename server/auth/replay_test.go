@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"edgeproxy/client/clientauth"
+	"edgeproxy/config"
+	b64 "encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func signTestClientToken(t *testing.T, key *ecdsa.PrivateKey, claims *clientauth.ClientAuthorizationClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	assert.NoError(t, err)
+	return token
+}
+
+func testClientClaims(jti string, issuedAt time.Time) *clientauth.ClientAuthorizationClaims {
+	return &clientauth.ClientAuthorizationClaims{
+		StandardClaims: &jwt.StandardClaims{
+			Id:        jti,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(10 * time.Minute).Unix(),
+			Audience:  "edgeproxy",
+		},
+		Nonce: jti,
+	}
+}
+
+func TestClientTokenReplay(t *testing.T) {
+	ca := newTestCA(t)
+	authenticator := NewSpireAuthorizer(context.Background(), config.ServerAuthCaConfig{
+		TrustedRoot:      ca.pemPath,
+		SpireTrustDomain: "example.com",
+		Paths:            config.PathsConfig{Allowed: []string{"/users/.*"}},
+	})
+	cert, key := ca.issueSvid(t, "spiffe://example.com/users/alice", time.Now().Add(time.Hour))
+	certHeader := b64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	authenticate := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(clientauth.HeaderCertificate, certHeader)
+		req.Header.Set(clientauth.HeaderAuthorization, "Bearer "+token)
+		ok, _ := authenticator.Authenticate(httptest.NewRecorder(), req)
+		return ok
+	}
+
+	token := signTestClientToken(t, key, testClientClaims("token-1", time.Now()))
+	assert.True(t, authenticate(token))
+	assert.False(t, authenticate(token), "replayed token")
+	assert.True(t, authenticate(signTestClientToken(t, key, testClientClaims("token-2", time.Now()))))
+
+	// Issued slightly in the future is tolerated, more than the leeway is not
+	assert.True(t, authenticate(signTestClientToken(t, key, testClientClaims("token-3", time.Now().Add(30*time.Second)))))
+	assert.False(t, authenticate(signTestClientToken(t, key, testClientClaims("token-4", time.Now().Add(5*time.Minute)))))
+
+	expired := testClientClaims("token-5", time.Now().Add(-time.Hour))
+	assert.False(t, authenticate(signTestClientToken(t, key, expired)))
+	longLived := testClientClaims("token-6", time.Now())
+	longLived.ExpiresAt = time.Now().Add(24 * time.Hour).Unix()
+	assert.False(t, authenticate(signTestClientToken(t, key, longLived)))
+	assert.False(t, authenticate(signTestClientToken(t, key, testClientClaims("", time.Now()))))
+}
+
+func TestClientCertificateIntermediates(t *testing.T) {
+	ca := newTestCA(t)
+	intermediate := ca.newIntermediate(t)
+	authenticator := NewSpireAuthorizer(context.Background(), config.ServerAuthCaConfig{
+		TrustedRoot:      ca.pemPath,
+		SpireTrustDomain: "example.com",
+		Paths:            config.PathsConfig{Allowed: []string{"/users/.*"}},
+	})
+	cert, key := intermediate.issueSvid(t, "spiffe://example.com/users/alice", time.Now().Add(time.Hour))
+	authenticate := func(jti string, chain ...*x509.Certificate) bool {
+		var certsPem []byte
+		for _, cert := range chain {
+			certsPem = append(certsPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(clientauth.HeaderCertificate, b64.StdEncoding.EncodeToString(certsPem))
+		req.Header.Set(clientauth.HeaderAuthorization, "Bearer "+signTestClientToken(t, key, testClientClaims(jti, time.Now())))
+		ok, subject := authenticator.Authenticate(httptest.NewRecorder(), req)
+		return ok && subject.GetSubject() == "spiffe://example.com/users/alice"
+	}
+
+	// The SVID chains to the trust bundle through the intermediates sent after it
+	assert.False(t, authenticate("token-1", cert))
+	assert.True(t, authenticate("token-2", cert, intermediate.cert))
+}
+
+func TestTokenReplayGuardBindings(t *testing.T) {
+	guard := newTokenReplayGuard(config.ClientTokenConfig{BindEndpoint: true, BindCertificate: true})
+	peerCert := &x509.Certificate{Raw: []byte("peer certificate")}
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/tunnel", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peerCert}}
+		return req
+	}
+	claims := func(jti, endpoint, thumbprint string) *clientauth.ClientAuthorizationClaims {
+		c := testClientClaims(jti, time.Now())
+		c.Endpoint = endpoint
+		c.Confirmation = &clientauth.TokenConfirmation{CertificateThumbprint: thumbprint}
+		return c
+	}
+	thumbprint := clientauth.CertificateThumbprint(peerCert.Raw)
+
+	assert.NoError(t, guard.Check(request(), "alice", claims("1", "wss://proxy.example.com:443/tunnel", thumbprint)))
+	assert.Error(t, guard.Check(request(), "alice", claims("2", "wss://proxy.example.com/other", thumbprint)))
+	assert.Error(t, guard.Check(request(), "alice", claims("3", "wss://evil.example.com/tunnel", thumbprint)))
+	assert.Error(t, guard.Check(request(), "alice", claims("4", "", thumbprint)))
+	assert.Error(t, guard.Check(request(), "alice", claims("5", "wss://proxy.example.com/tunnel", "other")))
+	noTls := request()
+	noTls.TLS = nil
+	assert.Error(t, guard.Check(noTls, "alice", claims("6", "wss://proxy.example.com/tunnel", thumbprint)))
+}
+
+func TestTokenReplayGuardCacheBound(t *testing.T) {
+	now := time.Now()
+	guard := newTokenReplayGuard(config.ClientTokenConfig{NonceCacheSize: 2})
+	guard.now = func() time.Time { return now }
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	assert.NoError(t, guard.Check(req, "alice", testClientClaims("1", now)))
+	// ids are remembered per subject
+	assert.NoError(t, guard.Check(req, "bob", testClientClaims("1", now)))
+	err := guard.Check(req, "alice", testClientClaims("2", now))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "nonce_cache_full")
+	}
+
+	// expired ids are evicted to make room
+	now = now.Add(12 * time.Minute)
+	assert.NoError(t, guard.Check(req, "alice", testClientClaims("2", now)))
+	assert.Len(t, guard.seen, 1)
+}
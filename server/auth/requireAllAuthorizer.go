@@ -0,0 +1,55 @@
+package auth
+
+// requireAllAuthorizer allows a forward only if every authorizer allows it, in order so later ones
+// (e.g. a webhook) are only asked for forwards the earlier ones allow
+type requireAllAuthorizer []Authorize
+
+// NewRequireAllAuthorizer combines authorizers, all of them must allow a forward
+func NewRequireAllAuthorizer(authorizers ...Authorize) Authorize {
+	return requireAllAuthorizer(authorizers)
+}
+
+func (r requireAllAuthorizer) AuthorizeForward(forwardAction ForwardAction) bool {
+	return r.Decide(forwardAction).Allowed
+}
+
+// Decide returns the first denial, or the decision of the first authorizer if all of them allow the forward
+func (r requireAllAuthorizer) Decide(forwardAction ForwardAction) PolicyDecision {
+	var allowed PolicyDecision
+	for i, authorizer := range r {
+		decision := Decide(authorizer, forwardAction)
+		if !decision.Allowed {
+			return decision
+		}
+		if i == 0 {
+			allowed = decision
+		}
+	}
+	allowed.Allowed = true
+	return allowed
+}
+
+// AuthorizeResolved requires every authorizer with an IP policy to allow the resolved address
+func (r requireAllAuthorizer) AuthorizeResolved(forwardAction ForwardAction) bool {
+	for _, authorizer := range r {
+		if !AuthorizeResolved(authorizer, forwardAction) {
+			return false
+		}
+	}
+	return true
+}
+
+// TrackForward tracks the forward on every authorizer whose policy can change, so any of them can close it
+func (r requireAllAuthorizer) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	var untracks []func()
+	for _, authorizer := range r {
+		if tracker, ok := authorizer.(ForwardTracker); ok {
+			untracks = append(untracks, tracker.TrackForward(forwardAction, closeForward))
+		}
+	}
+	return func() {
+		for _, untrack := range untracks {
+			untrack()
+		}
+	}
+}
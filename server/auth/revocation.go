@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"edgeproxy/client/clientauth"
+	"edgeproxy/config"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOcspCacheTtl      = time.Hour
+	defaultCrlRefresh        = 5 * time.Minute
+	defaultRevocationTimeout = 10 * time.Second
+	// CRLs and OCSP responses bigger than this are refused
+	maxRevocationResponseSize = 10 << 20
+)
+
+// revocationChecker checks client certificates against the CRLs and OCSP responders they point to.
+// Inspired by https://github.com/cloudflare/cfssl/blob/master/revoke/revoke.go, CRLs are kept current in background
+// before their NextUpdate and OCSP responses are cached until their NextUpdate.
+type revocationChecker struct {
+	hardFail     bool
+	ocspEnabled  bool
+	ocspCacheTtl time.Duration
+	crlRefresh   time.Duration
+	client       *http.Client
+	now          func() time.Time
+
+	mu            sync.Mutex
+	crls          map[string]*cachedCrl
+	ocspResponses map[string]*cachedOcsp
+}
+
+type cachedCrl struct {
+	crl    *pkix.CertificateList
+	issuer *x509.Certificate
+}
+
+type cachedOcsp struct {
+	status  int
+	expires time.Time
+}
+
+func newRevocationChecker(ctx context.Context, revocationConfig config.RevocationConfig) *revocationChecker {
+	c := &revocationChecker{
+		hardFail:      revocationConfig.HardFail,
+		ocspEnabled:   revocationConfig.Ocsp,
+		ocspCacheTtl:  revocationConfig.OcspCacheTtl,
+		crlRefresh:    revocationConfig.CrlRefresh,
+		client:        &http.Client{Timeout: revocationConfig.Timeout},
+		now:           time.Now,
+		crls:          map[string]*cachedCrl{},
+		ocspResponses: map[string]*cachedOcsp{},
+	}
+	if c.ocspCacheTtl <= 0 {
+		c.ocspCacheTtl = defaultOcspCacheTtl
+	}
+	if c.crlRefresh <= 0 {
+		c.crlRefresh = defaultCrlRefresh
+	}
+	if c.client.Timeout <= 0 {
+		c.client.Timeout = defaultRevocationTimeout
+	}
+	go c.refreshLoop(ctx)
+	return c
+}
+
+// stapledOcspResponse returns the OCSP response sent along the client certificate, if any
+func stapledOcspResponse(r *http.Request) []byte {
+	stapled := r.Header.Get(clientauth.HeaderCertificateOcsp)
+	if stapled == "" {
+		return nil
+	}
+	response, err := b64.StdEncoding.DecodeString(stapled)
+	if err != nil {
+		log.Debugf("invalid stapled OCSP response encoding: %v", err)
+		return nil
+	}
+	return response
+}
+
+// Check returns an error if the certificate is revoked, or its status can't be determined and failures are hard
+func (c *revocationChecker) Check(cert, issuer *x509.Certificate, stapledOcsp []byte) error {
+	revoked, err := c.revoked(cert, issuer, stapledOcsp)
+	if revoked {
+		log.Infof("certificate %s of %s is revoked", cert.SerialNumber, cert.Subject)
+		return fmt.Errorf("certificate has been revoked for %s", cert.Subject)
+	}
+	if err != nil {
+		if c.hardFail {
+			return fmt.Errorf("unable to check revocation for %s: %v", cert.Subject, err)
+		}
+		log.Warnf("unable to check revocation for %s, accepting it: %v", cert.Subject, err)
+	}
+	return nil
+}
+
+// revoked checks the stapled OCSP response first, then CRLs and the OCSP responders.
+// The status is known when at least one of them answered.
+func (c *revocationChecker) revoked(cert, issuer *x509.Certificate, stapledOcsp []byte) (bool, error) {
+	if len(stapledOcsp) > 0 {
+		status, _, err := c.parseOcsp(stapledOcsp, cert, issuer)
+		if err == nil {
+			return status == ocsp.Revoked, nil
+		}
+		log.Debugf("ignoring stapled OCSP response: %v", err)
+	}
+
+	var checkErr error
+	checked := false
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := c.crl(url, issuer)
+		if err != nil {
+			checkErr = err
+			continue
+		}
+		checked = true
+		if crlRevokes(crl, cert) {
+			return true, nil
+		}
+	}
+	if c.ocspEnabled && len(cert.OCSPServer) > 0 {
+		revoked, err := c.ocspRevoked(cert, issuer)
+		if err == nil {
+			return revoked, nil
+		}
+		checkErr = err
+	}
+	if checked {
+		return false, nil
+	}
+	return false, checkErr
+}
+
+func crlRevokes(crl *pkix.CertificateList, cert *x509.Certificate) bool {
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if cert.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// crl returns the cached CRL, fetching it when missing or expired
+func (c *revocationChecker) crl(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	c.mu.Lock()
+	cached, ok := c.crls[url]
+	c.mu.Unlock()
+	if ok && !cached.crl.HasExpired(c.now()) {
+		return cached.crl, nil
+	}
+	crl, err := c.fetchCrl(url, issuer)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.crls[url] = &cachedCrl{crl: crl, issuer: issuer}
+	c.mu.Unlock()
+	return crl, nil
+}
+
+// fetchCrl fetches and parses a CRL, verifying it is signed by the certificate issuer
+func (c *revocationChecker) fetchCrl(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	body, err := c.fetch(http.MethodGet, url, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch CRL %s: %v", url, err)
+	}
+	crl, err := x509.ParseCRL(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL %s: %v", url, err)
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("failed to verify CRL %s: %v", url, err)
+	}
+	if crl.HasExpired(c.now()) {
+		return nil, fmt.Errorf("CRL %s expired at %s", url, crl.TBSCertList.NextUpdate)
+	}
+	return crl, nil
+}
+
+// ocspRevoked asks the certificate OCSP responders, caching their answer
+func (c *revocationChecker) ocspRevoked(cert, issuer *x509.Certificate) (bool, error) {
+	key := ocspCacheKey(cert)
+	c.mu.Lock()
+	cached, ok := c.ocspResponses[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		return cached.status == ocsp.Revoked, nil
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+	var ocspErr error
+	for _, server := range cert.OCSPServer {
+		body, err := c.fetch(http.MethodPost, server, "application/ocsp-request", request)
+		if err != nil {
+			ocspErr = fmt.Errorf("OCSP request to %s failed: %v", server, err)
+			continue
+		}
+		status, expires, err := c.parseOcsp(body, cert, issuer)
+		if err != nil {
+			ocspErr = fmt.Errorf("invalid OCSP response from %s: %v", server, err)
+			continue
+		}
+		c.mu.Lock()
+		c.ocspResponses[key] = &cachedOcsp{status: status, expires: expires}
+		c.mu.Unlock()
+		return status == ocsp.Revoked, nil
+	}
+	return false, ocspErr
+}
+
+// parseOcsp verifies the OCSP response is for the certificate, signed by its issuer and current.
+// It returns the status and until when it can be cached.
+func (c *revocationChecker) parseOcsp(raw []byte, cert, issuer *x509.Certificate) (int, time.Time, error) {
+	response, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	now := c.now()
+	if response.ThisUpdate.After(now.Add(time.Minute)) {
+		return 0, time.Time{}, fmt.Errorf("OCSP response produced in the future %s", response.ThisUpdate)
+	}
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return 0, time.Time{}, fmt.Errorf("stale OCSP response, next update was %s", response.NextUpdate)
+	}
+	// responses without a next update are only trusted for the cache TTL, so an old stapled one can't hide a revocation
+	if response.NextUpdate.IsZero() && now.After(response.ThisUpdate.Add(c.ocspCacheTtl)) {
+		return 0, time.Time{}, fmt.Errorf("stale OCSP response, produced %s", response.ThisUpdate)
+	}
+	if response.Status == ocsp.Unknown {
+		return 0, time.Time{}, errors.New("OCSP responder doesn't know the certificate")
+	}
+	expires := now.Add(c.ocspCacheTtl)
+	if response.NextUpdate.IsZero() {
+		expires = response.ThisUpdate.Add(c.ocspCacheTtl)
+	} else if response.NextUpdate.Before(expires) {
+		expires = response.NextUpdate
+	}
+	return response.Status, expires, nil
+}
+
+func ocspCacheKey(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *revocationChecker) fetch(method, url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+}
+
+// refreshLoop refetches the CRLs before their NextUpdate, so clients are not delayed fetching them.
+// CRLs that can't be refreshed are kept until they expire.
+func (c *revocationChecker) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.crlRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+func (c *revocationChecker) refresh() {
+	now := c.now()
+	stale := map[string]*cachedCrl{}
+	c.mu.Lock()
+	for url, cached := range c.crls {
+		// refresh what would expire before the next refresh
+		if cached.crl.HasExpired(now.Add(c.crlRefresh)) {
+			stale[url] = cached
+		}
+	}
+	for key, cached := range c.ocspResponses {
+		if !now.Before(cached.expires) {
+			delete(c.ocspResponses, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for url, cached := range stale {
+		crl, err := c.fetchCrl(url, cached.issuer)
+		if err != nil {
+			log.Warnf("error refreshing CRL: %v", err)
+			continue
+		}
+		log.Debugf("refreshed CRL %s, next update %s", url, crl.TBSCertList.NextUpdate)
+		c.mu.Lock()
+		c.crls[url] = &cachedCrl{crl: crl, issuer: cached.issuer}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"edgeproxy/config"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testResponder stands in for the CA CRL distribution point and OCSP responder
+type testResponder struct {
+	ca          *testCA
+	mu          sync.Mutex
+	revoked     map[int64]bool
+	crlLifetime time.Duration
+	crlFetches  int32
+	ocspQueries int32
+}
+
+func newTestResponder(ca *testCA) *testResponder {
+	return &testResponder{ca: ca, revoked: map[int64]bool{}, crlLifetime: time.Hour}
+}
+
+func (r *testResponder) revoke(cert *x509.Certificate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked[cert.SerialNumber.Int64()] = true
+}
+
+func (r *testResponder) ocspResponse(t *testing.T, cert *x509.Certificate) []byte {
+	r.mu.Lock()
+	status := ocsp.Good
+	if r.revoked[cert.SerialNumber.Int64()] {
+		status = ocsp.Revoked
+	}
+	r.mu.Unlock()
+	response, err := ocsp.CreateResponse(r.ca.cert, r.ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+		RevokedAt:    time.Now().Add(-time.Minute),
+	}, r.ca.key)
+	assert.NoError(t, err)
+	return response
+}
+
+func (r *testResponder) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/crl", func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.crlFetches, 1)
+		r.mu.Lock()
+		var revoked []pkix.RevokedCertificate
+		for serial := range r.revoked {
+			revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		r.mu.Unlock()
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:              big.NewInt(time.Now().UnixNano()),
+			ThisUpdate:          time.Now().Add(-time.Minute),
+			NextUpdate:          time.Now().Add(r.crlLifetime),
+			RevokedCertificates: revoked,
+		}, r.ca.cert, r.ca.key)
+		assert.NoError(t, err)
+		w.Write(crl)
+	})
+	mux.HandleFunc("/ocsp", func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&r.ocspQueries, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		ocspReq, err := ocsp.ParseRequest(body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(r.ocspResponse(t, &x509.Certificate{SerialNumber: ocspReq.SerialNumber}))
+	})
+	return mux
+}
+
+func TestRevocationCrl(t *testing.T) {
+	ca := newTestCA(t)
+	responder := newTestResponder(ca)
+	srv := httptest.NewServer(responder.handler(t))
+	defer srv.Close()
+	ca.crlURL = srv.URL + "/crl"
+
+	good, _ := ca.issueSvid(t, "spiffe://example.com/users/good", time.Now().Add(time.Hour))
+	bad, _ := ca.issueSvid(t, "spiffe://example.com/users/bad", time.Now().Add(time.Hour))
+	responder.revoke(bad)
+
+	checker := newRevocationChecker(context.Background(), config.RevocationConfig{CrlRefresh: time.Hour})
+	assert.NoError(t, checker.Check(good, ca.cert, nil))
+	assert.Error(t, checker.Check(bad, ca.cert, nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&responder.crlFetches), "CRL is cached")
+
+	// CRLs about to expire are refreshed in background, picking up new revocations
+	responder.revoke(good)
+	checker.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	checker.refresh()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&responder.crlFetches))
+	assert.Error(t, checker.Check(good, ca.cert, nil))
+}
+
+func TestRevocationOcsp(t *testing.T) {
+	ca := newTestCA(t)
+	responder := newTestResponder(ca)
+	srv := httptest.NewServer(responder.handler(t))
+	defer srv.Close()
+	ca.ocspURL = srv.URL + "/ocsp"
+
+	good, _ := ca.issueSvid(t, "spiffe://example.com/users/good", time.Now().Add(time.Hour))
+	bad, _ := ca.issueSvid(t, "spiffe://example.com/users/bad", time.Now().Add(time.Hour))
+	responder.revoke(bad)
+
+	checker := newRevocationChecker(context.Background(), config.RevocationConfig{Ocsp: true})
+	assert.NoError(t, checker.Check(good, ca.cert, nil))
+	assert.NoError(t, checker.Check(good, ca.cert, nil))
+	assert.Error(t, checker.Check(bad, ca.cert, nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&responder.ocspQueries), "OCSP responses are cached")
+
+	// A stapled response is used instead of querying the responder
+	other, _ := ca.issueSvid(t, "spiffe://example.com/users/other", time.Now().Add(time.Hour))
+	responder.revoke(other)
+	assert.Error(t, checker.Check(other, ca.cert, responder.ocspResponse(t, other)))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&responder.ocspQueries))
+	// Stapled responses for another certificate are ignored
+	assert.Error(t, checker.Check(other, ca.cert, responder.ocspResponse(t, good)))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&responder.ocspQueries))
+
+	// Stapled responses without a next update are trusted for the cache TTL from when they were produced
+	stapled := func(cert *x509.Certificate, produced time.Time) []byte {
+		response, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: cert.SerialNumber,
+			ThisUpdate:   produced,
+		}, ca.key)
+		assert.NoError(t, err)
+		return response
+	}
+	revoked, _ := ca.issueSvid(t, "spiffe://example.com/users/revoked", time.Now().Add(time.Hour))
+	assert.NoError(t, checker.Check(revoked, ca.cert, stapled(revoked, time.Now().Add(-time.Minute))))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&responder.ocspQueries))
+	responder.revoke(revoked)
+	assert.Error(t, checker.Check(revoked, ca.cert, stapled(revoked, time.Now().Add(-2*defaultOcspCacheTtl))))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&responder.ocspQueries))
+}
+
+func TestRevocationHardFail(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	ca.crlURL = srv.URL + "/crl"
+	ca.ocspURL = srv.URL + "/ocsp"
+	cert, _ := ca.issueSvid(t, "spiffe://example.com/users/good", time.Now().Add(time.Hour))
+
+	softFail := newRevocationChecker(context.Background(), config.RevocationConfig{Ocsp: true})
+	assert.NoError(t, softFail.Check(cert, ca.cert, nil))
+	hardFail := newRevocationChecker(context.Background(), config.RevocationConfig{Ocsp: true, HardFail: true})
+	assert.Error(t, hardFail.Check(cert, ca.cert, nil))
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"edgeproxy/audit"
+	"edgeproxy/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// shadowAuthorizer evaluates a candidate policy next to the enforcing one, disagreements are logged,
+// counted and audited but only the enforcing policy decides
+type shadowAuthorizer struct {
+	Authorize
+	shadow Authorize
+}
+
+// NewShadowAuthorizer authorizes with enforcing, dry running shadow on every authorization
+func NewShadowAuthorizer(enforcing Authorize, shadow Authorize) Authorize {
+	return shadowAuthorizer{Authorize: enforcing, shadow: shadow}
+}
+
+func (s shadowAuthorizer) AuthorizeForward(forwardAction ForwardAction) bool {
+	return s.Decide(forwardAction).Allowed
+}
+
+// Decide is the decision of the enforcing policy
+func (s shadowAuthorizer) Decide(forwardAction ForwardAction) PolicyDecision {
+	decision := Decide(s.Authorize, forwardAction)
+	allowed := decision.Allowed
+	shadowAllowed := s.shadow.AuthorizeForward(forwardAction)
+	if allowed == shadowAllowed {
+		return decision
+	}
+	enforced, shadow := decisionName(allowed), decisionName(shadowAllowed)
+	log.Warnf("Shadow policy would %s %s access to %s/%s, enforced %s", shadow, forwardAction.Subject,
+		forwardAction.NetType, forwardAction.DestinationAddr, enforced)
+	metrics.IncrementAuthPolicyShadowDisagreements(enforced, shadow)
+	audit.Log(audit.Event{
+		Type:    audit.PolicyShadowDisagreementEvent,
+		Subject: forwardAction.Subject,
+		Reason:  enforced + "_" + shadow,
+		Fields: map[string]interface{}{
+			"destination": forwardAction.DestinationAddr,
+			"network":     forwardAction.NetType,
+			"enforced":    enforced,
+			"shadow":      shadow,
+		},
+	})
+	return decision
+}
+
+// AuthorizeResolved only asks the enforcing policy, the shadow one was compared on the domain forward
+func (s shadowAuthorizer) AuthorizeResolved(forwardAction ForwardAction) bool {
+	return AuthorizeResolved(s.Authorize, forwardAction)
+}
+
+func (s shadowAuthorizer) TrackForward(forwardAction ForwardAction, closeForward func()) func() {
+	if tracker, ok := s.Authorize.(ForwardTracker); ok {
+		return tracker.TrackForward(forwardAction, closeForward)
+	}
+	return func() {}
+}
+
+func decisionName(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
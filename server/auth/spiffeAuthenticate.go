@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"edgeproxy/client/clientauth"
 	"edgeproxy/config"
 	b64 "encoding/base64"
@@ -17,7 +16,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -27,24 +25,14 @@ type spireAuthorizer struct {
 	roots       *x509.CertPool
 	trustDomain string
 	pathConfig  config.PathsConfig
+	mode        config.CertificateAuthMode
+	tokenGuard  *tokenReplayGuard
+	revocation  *revocationChecker
 }
 
-// HardFail determines whether the failure to check the revocation
-// status of a certificate (i.e. due to network failure) causes
-// verification to fail (a hard failure).
-var HardFail = false
-
-var HTTPClient = http.DefaultClient
-var crlRead = ioutil.ReadAll
-var remoteRead = ioutil.ReadAll
-
-// CRLSet associates a PKIX certificate list with the URL the CRL is
-// fetched from.
-var CRLSet = map[string]*pkix.CertificateList{}
-var crlLock = new(sync.Mutex)
-
 type SpiffeSubject struct {
-	cert *x509.Certificate
+	cert       *x509.Certificate
+	revalidate func() error
 }
 
 func (s SpiffeSubject) GetSubject() string {
@@ -52,12 +40,32 @@ func (s SpiffeSubject) GetSubject() string {
 	return s.cert.URIs[0].String()
 }
 
+// CredentialExpiry is the certificate expiration
+func (s SpiffeSubject) CredentialExpiry() time.Time {
+	return s.cert.NotAfter
+}
+
+// Revalidate verifies the certificate again, failing once it is revoked
+func (s SpiffeSubject) Revalidate() error {
+	if s.revalidate == nil {
+		return nil
+	}
+	return s.revalidate()
+}
+
 func NewSpireAuthorizer(ctx context.Context, caConfig config.ServerAuthCaConfig) Authenticate {
+	mode := caConfig.Mode
+	if mode == "" {
+		mode = config.HeaderCertificateAuthMode
+	}
 	authorizer := &spireAuthorizer{
 		ctx:         ctx,
 		rootPath:    caConfig.TrustedRoot,
 		trustDomain: caConfig.SpireTrustDomain,
 		pathConfig:  caConfig.Paths,
+		mode:        mode,
+		tokenGuard:  newTokenReplayGuard(caConfig.Token),
+		revocation:  newRevocationChecker(ctx, caConfig.Revocation),
 	}
 
 	buf, err := ioutil.ReadFile(caConfig.TrustedRoot)
@@ -76,36 +84,61 @@ func NewSpireAuthorizer(ctx context.Context, caConfig config.ServerAuthCaConfig)
 }
 
 func IsValidToken(token string, pub interface{}) bool {
+	_, err := parseClientToken(token, pub)
+	if err != nil {
+		log.Debugf("error validating authentication client: %v", err)
+		return false
+	}
+	return true
+}
+
+// parseClientToken verifies the bearer token is signed by the client certificate key, not expired and for edgeproxy
+func parseClientToken(token string, pub interface{}) (*clientauth.ClientAuthorizationClaims, error) {
 	var extractToken = regexp.MustCompile(`^Bearer (.*)$`)
 
 	bearerMatch := extractToken.FindStringSubmatch(token)
 	if len(bearerMatch) != 2 {
 		//not in bearer token format
-		log.Debugf("bad clientauth header %s", token)
-		return false
+		return nil, fmt.Errorf("bad clientauth header %s", token)
 	}
 
 	bearerToken := strings.TrimSpace(bearerMatch[1])
 
+	claims := &clientauth.ClientAuthorizationClaims{StandardClaims: &jwt.StandardClaims{}}
+	// iat and nbf are checked with leeway by the replay guard
+	parser := &jwt.Parser{SkipClaimsValidation: true}
 	// TODO: allow more than one signing key
-	parsedToken, err := jwt.ParseWithClaims(bearerToken, &clientauth.ClientAuthorizationClaims{}, func(token *jwt.Token) (interface{}, error) {
+	_, err := parser.ParseWithClaims(bearerToken, claims, func(token *jwt.Token) (interface{}, error) {
 		return pub, nil
 	})
 	if err != nil {
-		log.Debugf("error validting authentication client: %v", err)
-		return false
+		return nil, err
 	}
-	claims := parsedToken.Claims.(*clientauth.ClientAuthorizationClaims)
-	// didn't blow up, meaning it's signed by the right key and not expired
-	if claims.StandardClaims.VerifyAudience("edgeproxy", true) {
-		return true
-	} else {
-		log.Debugf("bad audience: %s", claims.StandardClaims.Audience)
-		return false
+	// didn't blow up, meaning it's signed by the right key
+	if !claims.StandardClaims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token expired or without expiration")
+	}
+	if !claims.StandardClaims.VerifyAudience("edgeproxy", true) {
+		return nil, fmt.Errorf("bad audience: %s", claims.StandardClaims.Audience)
 	}
+	return claims, nil
 }
 
 func (f *spireAuthorizer) Authenticate(w http.ResponseWriter, r *http.Request) (bool, Subject) {
+	switch f.mode {
+	case config.MtlsCertificateAuthMode:
+		return f.authenticatePeerCertificate(r)
+	case config.AnyCertificateAuthMode:
+		if hasPeerCertificate(r) {
+			return f.authenticatePeerCertificate(r)
+		}
+	}
+	return f.authenticateHeaders(r)
+}
+
+// authenticateHeaders validates the client certificate sent on the X-Client-Certificate header,
+// used when TLS is terminated before reaching the server (WAF, load balancer...), plus a JWT proving the key possession.
+func (f *spireAuthorizer) authenticateHeaders(r *http.Request) (bool, Subject) {
 	//var port int
 	//var err error
 	token := r.Header.Get(clientauth.HeaderAuthorization)
@@ -119,20 +152,25 @@ func (f *spireAuthorizer) Authenticate(w http.ResponseWriter, r *http.Request) (
 		return false, nil
 	}
 
-	validatedCert, certErr := f.validateClientCertificate(cert)
+	validatedCert, intermediates, certErr := f.validateClientCertificate(cert, stapledOcspResponse(r))
 	if certErr != nil {
 		log.Debugf("error validating cert: %v", certErr)
 		return false, nil
 	}
 
 	// make sure jwt is signed by same key as cert
-	validToken := IsValidToken(token, validatedCert.PublicKey)
-	if !validToken {
-		log.Debug("invalid token")
+	claims, err := parseClientToken(token, validatedCert.PublicKey)
+	if err != nil {
+		log.Debugf("invalid token: %v", err)
 		return false, nil
 	}
 
-	subj := NewSpiffeSubject(validatedCert)
+	subj := f.newSpiffeSubject(validatedCert, intermediates)
+	// a valid token is only accepted once
+	if err := f.tokenGuard.Check(r, subj.GetSubject(), claims); err != nil {
+		log.Debugf("invalid token for %s: %v", subj.GetSubject(), err)
+		return false, nil
+	}
 	return true, subj
 }
 
@@ -143,103 +181,15 @@ func NewSpiffeSubject(cert *x509.Certificate) Subject {
 	return subj
 }
 
-// shamelessly stolen from https://github.com/cloudflare/cfssl/blob/master/revoke/revoke.go
-// revCheck should check the certificate for any revocations. It
-// returns a pair of booleans: the first indicates whether the certificate
-// is revoked, the second indicates whether the revocations were
-// successfully checked.. This leads to the following combinations:
-//
-//  false, false: an error was encountered while checking revocations.
-//
-//  false, true:  the certificate was checked successfully and
-//                  it is not revoked.
-//
-//  true, true:   the certificate was checked successfully and
-//                  it is revoked.
-//
-//  true, false:  failure to check revocation status causes
-//                  verification to fail
-func revCheck(cert *x509.Certificate) (revoked, ok bool, err error) {
-	for _, url := range cert.CRLDistributionPoints {
-		if revoked, ok, err := certIsRevokedCRL(cert, url); !ok {
-			log.Warning("error checking revocation via CRL")
-			if HardFail {
-				return true, false, err
-			}
-			return false, false, err
-		} else if revoked {
-			log.Info("certificate is revoked via CRL")
-			return true, true, err
-		}
-	}
-
-	// TODO: OCSP support
-	//if revoked, ok, err := certIsRevokedOCSP(cert, HardFail); !ok {
-	//	log.Warning("error checking revocation via OCSP")
-	//	if HardFail {
-	//		return true, false, err
-	//	}
-	//	return false, false, err
-	//} else if revoked {
-	//	log.Info("certificate is revoked via OCSP")
-	//	return true, true, err
-	//}
-
-	return false, true, nil
-}
-
-// fetchCRL fetches and parses a CRL.
-func fetchCRL(url string) (*pkix.CertificateList, error) {
-	resp, err := HTTPClient.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 300 {
-		return nil, errors.New("failed to retrieve CRL")
-	}
-
-	body, err := crlRead(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	return x509.ParseCRL(body)
-}
-
-func getIssuer(cert *x509.Certificate) *x509.Certificate {
-	var issuer *x509.Certificate
-	var err error
-	for _, issuingCert := range cert.IssuingCertificateURL {
-		issuer, err = fetchRemote(issuingCert)
-		if err != nil {
-			continue
-		}
-		break
-	}
-
-	return issuer
-
-}
-
-func fetchRemote(url string) (*x509.Certificate, error) {
-	resp, err := HTTPClient.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	in, err := remoteRead(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	p, _ := pem.Decode(in)
-	if p != nil {
-		return ParseCertificatePEM(in)
+// newSpiffeSubject creates the subject of a verified certificate, revalidated against the trust bundle and revocations
+func (f *spireAuthorizer) newSpiffeSubject(cert *x509.Certificate, intermediates []*x509.Certificate) Subject {
+	return SpiffeSubject{
+		cert: cert,
+		revalidate: func() error {
+			_, err := f.verifySvid(cert, intermediates, nil)
+			return err
+		},
 	}
-
-	return x509.ParseCertificate(in)
 }
 
 func ParseCertificatePEM(certPEM []byte) (*x509.Certificate, error) {
@@ -296,74 +246,34 @@ func ParseOneCertificateFromPEM(certsPEM []byte) ([]*x509.Certificate, []byte, e
 	return certs, rest, nil
 }
 
-func certIsRevokedCRL(cert *x509.Certificate, url string) (revoked, ok bool, err error) {
-	crlLock.Lock()
-	crl, ok := CRLSet[url]
-	if ok && crl == nil {
-		ok = false
-		delete(CRLSet, url)
-	}
-	crlLock.Unlock()
-
-	var shouldFetchCRL = true
-	if ok {
-		if !crl.HasExpired(time.Now()) {
-			shouldFetchCRL = false
-		}
+// validateClientCertificate verifies the client certificate of the header, the PEM blocks after it are the intermediates
+// chaining it to the trust bundle. It returns the certificate with its intermediates.
+func (f *spireAuthorizer) validateClientCertificate(certificate string, stapledOcsp []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	sDec, err := b64.StdEncoding.DecodeString(certificate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client certificate encoding: %v", err)
 	}
-
-	issuer := getIssuer(cert)
-
-	if shouldFetchCRL {
-		var err error
-		crl, err = fetchCRL(url)
-		if err != nil {
-			log.Warningf("failed to fetch CRL: %v", err)
-			return false, false, err
-		}
-
-		// check CRL signature
-		if issuer != nil {
-			err = issuer.CheckCRLSignature(crl)
-			if err != nil {
-				log.Warningf("failed to verify CRL: %v", err)
-				return false, false, err
-			}
-		}
-
-		crlLock.Lock()
-		CRLSet[url] = crl
-		crlLock.Unlock()
+	certs, err := ParseCertificatesPEM(sDec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing client certificate: %v", err)
 	}
-
-	for _, revoked := range crl.TBSCertList.RevokedCertificates {
-		if cert.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
-			log.Info("Serial number match: intermediate is revoked.")
-			return true, true, err
-		}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("failed to parse PEM block containing the client certificate")
 	}
-
-	return false, true, err
+	cert, err := f.verifySvid(certs[0], certs[1:], stapledOcsp)
+	return cert, certs[1:], err
 }
 
-func (f *spireAuthorizer) validateClientCertificate(certificate string) (*x509.Certificate, error) {
-	sDec, _ := b64.StdEncoding.DecodeString(certificate)
-	block, _ := pem.Decode([]byte(sDec))
-	if block == nil {
-		panic("failed to parse PEM block containing the public key")
-	}
-
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		log.Fatalf("error loading private key: %v", err)
-		return nil, err
-	}
-
-	// TODO: think about intermediates in verify
-
+// verifySvid verifies the certificate chains to the trust bundle, is not revoked and is a SVID allowed by the path configuration.
+// The stapled OCSP response, if any, is used instead of querying the OCSP responder.
+func (f *spireAuthorizer) verifySvid(cert *x509.Certificate, intermediates []*x509.Certificate, stapledOcsp []byte) (*x509.Certificate, error) {
 	opts := x509.VerifyOptions{
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		Roots:     f.roots,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Roots:         f.roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, intermediate := range intermediates {
+		opts.Intermediates.AddCert(intermediate)
 	}
 	validationChain, err := cert.Verify(opts)
 	if err != nil {
@@ -380,16 +290,12 @@ func (f *spireAuthorizer) validateClientCertificate(certificate string) (*x509.C
 		return nil, fmt.Errorf(msg)
 	}
 
-	revoked, ok, revCheckErr := revCheck(cert)
-	if revoked {
-		return nil, errors.New(fmt.Sprintf("certificate has been revoked for %s, %v", cert.Subject, revCheckErr))
+	issuer := cert
+	if len(validationChain[0]) > 1 {
+		issuer = validationChain[0][1]
 	}
-	if !ok {
-		// TODO: decide how strict we wanna be if we can't check CRL
-		log.Info("error reading CRL")
-	}
-	if revCheckErr != nil {
-		log.Errorf("Error with CRL: %s", revCheckErr)
+	if err := f.revocation.Check(cert, issuer, stapledOcsp); err != nil {
+		return nil, err
 	}
 
 	validatedClientCert := validationChain[0][0]
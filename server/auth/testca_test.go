@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	pemPath string
+	serial  int64
+	// revocation endpoints added to the issued certificates
+	crlURL  string
+	ocspURL string
+}
+
+// newTestCA creates a self signed CA and writes it as PEM bundle to a temp file
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tml := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "edgeproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, tml, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "edgeproxy-ca-*.pem")
+	assert.NoError(t, err)
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return &testCA{cert: cert, key: key, pemPath: f.Name(), serial: 1}
+}
+
+// newIntermediate creates an intermediate CA issued by ca, as SPIRE with an upstream authority
+func (ca *testCA) newIntermediate(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca.serial++
+	tml := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "edgeproxy test intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issueSvid issues a client certificate with the SPIFFE ID as URI SAN
+func (ca *testCA) issueSvid(t *testing.T, spiffeID string, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	uri, err := url.Parse(spiffeID)
+	assert.NoError(t, err)
+	ca.serial++
+	tml := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "workload"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ca.crlURL != "" {
+		tml.CRLDistributionPoints = []string{ca.crlURL}
+	}
+	if ca.ocspURL != "" {
+		tml.OCSPServer = []string{ca.ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tml, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
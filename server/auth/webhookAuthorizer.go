@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// decisions cached at most, expired ones are dropped when full
+	webhookCacheSize = 10000
+	// webhook responses read at most
+	webhookMaxResponse = 64 * 1024
+)
+
+// webhookDecision is the webhook response to a forward action, a 403 status without body denies too
+type webhookDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+type cachedDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// webhookAuthorizer asks an external service to authorize forwards, posting them as JSON
+type webhookAuthorizer struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+	cacheTtl   time.Duration
+	failOpen   bool
+	mu         sync.Mutex
+	cache      map[string]cachedDecision
+}
+
+// NewWebhookAuthorizer authorizes forwards with the webhook, through its unix socket if set
+func NewWebhookAuthorizer(webhookConfig config.WebhookConfig) Authorize {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if webhookConfig.Socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", webhookConfig.Socket)
+		}
+	}
+	return &webhookAuthorizer{
+		url:        webhookConfig.Url,
+		headers:    webhookConfig.Headers,
+		httpClient: &http.Client{Transport: transport, Timeout: webhookConfig.Timeout},
+		cacheTtl:   webhookConfig.CacheTtl,
+		failOpen:   webhookConfig.FailOpen,
+		cache:      map[string]cachedDecision{},
+	}
+}
+
+func (w *webhookAuthorizer) AuthorizeForward(forwardAction ForwardAction) bool {
+	body, err := json.Marshal(forwardAction)
+	if err != nil {
+		log.Errorf("can not encode forward of %s: %v", forwardAction.Subject, err)
+		return w.failOpen
+	}
+	// the request body identifies the forward, client metadata included
+	key := string(body)
+	if allowed, ok := w.cached(key); ok {
+		metrics.IncrementAuthWebhookDecisions(decisionName(allowed), "cache")
+		return allowed
+	}
+	decision, err := w.request(body)
+	if err != nil {
+		log.Warnf("Authorization webhook failed for %s access to %s/%s, %s: %v", forwardAction.Subject,
+			forwardAction.NetType, forwardAction.DestinationAddr, failName(w.failOpen), err)
+		metrics.IncrementAuthWebhookDecisions(decisionName(w.failOpen), "failure")
+		return w.failOpen
+	}
+	if !decision.Allowed {
+		log.Debugf("Authorization webhook denied %s access to %s/%s: %s", forwardAction.Subject,
+			forwardAction.NetType, forwardAction.DestinationAddr, decision.Reason)
+	}
+	w.store(key, decision.Allowed)
+	metrics.IncrementAuthWebhookDecisions(decisionName(decision.Allowed), "webhook")
+	return decision.Allowed
+}
+
+// Decide names the webhook as the policy deciding the forward
+func (w *webhookAuthorizer) Decide(forwardAction ForwardAction) PolicyDecision {
+	return PolicyDecision{Allowed: w.AuthorizeForward(forwardAction), Policy: "webhook"}
+}
+
+func (w *webhookAuthorizer) request(body []byte) (webhookDecision, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return webhookDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return webhookDecision{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var decision webhookDecision
+		if err = json.NewDecoder(io.LimitReader(resp.Body, webhookMaxResponse)).Decode(&decision); err != nil {
+			return webhookDecision{}, fmt.Errorf("invalid response: %v", err)
+		}
+		return decision, nil
+	case http.StatusForbidden:
+		return webhookDecision{}, nil
+	default:
+		return webhookDecision{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func (w *webhookAuthorizer) cached(key string) (bool, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	decision, ok := w.cache[key]
+	if !ok || time.Now().After(decision.expires) {
+		return false, false
+	}
+	return decision.allowed, true
+}
+
+func (w *webhookAuthorizer) store(key string, allowed bool) {
+	if w.cacheTtl <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if len(w.cache) >= webhookCacheSize {
+		for cachedKey, decision := range w.cache {
+			if now.After(decision.expires) {
+				delete(w.cache, cachedKey)
+			}
+		}
+		if len(w.cache) >= webhookCacheSize {
+			w.cache = map[string]cachedDecision{}
+		}
+	}
+	w.cache[key] = cachedDecision{allowed: allowed, expires: now.Add(w.cacheTtl)}
+}
+
+func failName(failOpen bool) string {
+	if failOpen {
+		return "failing open"
+	}
+	return "failing closed"
+}
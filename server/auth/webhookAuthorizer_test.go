@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"edgeproxy/config"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookAuthorizer(t *testing.T) {
+	var requests int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var forwardAction ForwardAction
+		if err := json.NewDecoder(r.Body).Decode(&forwardAction); err != nil || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch forwardAction.Subject {
+		case "alice":
+			json.NewEncoder(w).Encode(webhookDecision{Allowed: forwardAction.Client["tunnel"] == "/"})
+		case "bob":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer webhook.Close()
+
+	webhookConfig := config.WebhookConfig{
+		Url:      webhook.URL,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		Timeout:  time.Second,
+		CacheTtl: time.Minute,
+	}
+	authorizer := NewWebhookAuthorizer(webhookConfig)
+	forward := func(subject string) ForwardAction {
+		return ForwardAction{Subject: subject, DestinationAddr: "10.0.0.1:22", NetType: "tcp", Client: map[string]string{"tunnel": "/"}}
+	}
+	assert.True(t, authorizer.AuthorizeForward(forward("alice")))
+	assert.False(t, authorizer.AuthorizeForward(forward("bob")))
+	// decisions are cached, failures aren't
+	assert.True(t, authorizer.AuthorizeForward(forward("alice")))
+	assert.False(t, authorizer.AuthorizeForward(forward("carol")))
+	assert.False(t, authorizer.AuthorizeForward(forward("carol")))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+	webhookConfig.FailOpen = true
+	assert.True(t, NewWebhookAuthorizer(webhookConfig).AuthorizeForward(forward("carol")))
+
+	// both the policy and the webhook must allow
+	policy := authorizeFunc(func(forwardAction ForwardAction) bool { return forwardAction.NetType == "tcp" })
+	combined := NewRequireAllAuthorizer(policy, authorizer)
+	assert.True(t, combined.AuthorizeForward(forward("alice")))
+	assert.False(t, combined.AuthorizeForward(forward("bob")))
+	udp := forward("alice")
+	udp.NetType = "udp"
+	assert.False(t, combined.AuthorizeForward(udp))
+}
+
+func TestWebhookAuthorizerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "authz.sock")
+	listener, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	webhook := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(webhookDecision{Allowed: r.URL.Path == "/v1/authorize"})
+	}))
+	webhook.Listener = listener
+	webhook.Start()
+	defer webhook.Close()
+
+	authorizer := NewWebhookAuthorizer(config.WebhookConfig{Url: "http://authz/v1/authorize", Socket: socket, Timeout: time.Second})
+	assert.True(t, authorizer.AuthorizeForward(ForwardAction{Subject: "alice", DestinationAddr: "10.0.0.1:22", NetType: "tcp"}))
+}
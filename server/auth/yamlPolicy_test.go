@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"edgeproxy/config"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testYamlPolicy = `addresses:
+  office: [10.0.0.0/8, "*.office.example.com"]
+services:
+  dns: [udp/53, tcp/53]
+roles:
+  developers:
+    members: [spiffe://example.com/users/dev-*, "groups:developers"]
+    rules:
+      - effect: allow
+        destinations: ["@office", "2001:db8::/32"]
+        ports: [22, 8000-8100]
+      - effect: allow
+        destinations: [10.0.0.53]
+        services: [dns]
+      - effect: deny
+        destinations: [10.0.0.1, db.office.example.com]
+        ports: ["*"]
+`
+
+func TestYamlPolicy(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, ioutil.WriteFile(policy, []byte(testYamlPolicy), 0600))
+	enforcer := NewPolicyEnforcer(config.AclCollection{PolicyPath: policy})
+	authorize := func(subject string, destination string, proto string) bool {
+		return enforcer.AuthorizeForward(NewForwardAction(ClaimsSubject{subject: subject}, destination, proto))
+	}
+
+	assert.True(t, authorize("spiffe://example.com/users/dev-alice", "10.1.1.1:22", "tcp"))
+	assert.True(t, authorize("spiffe://example.com/users/dev-alice", "[2001:db8::1]:8080", "tcp"))
+	assert.True(t, authorize("spiffe://example.com/users/dev-alice", "git.office.example.com:8000", "tcp"))
+	assert.True(t, authorize("spiffe://example.com/users/dev-alice", "10.0.0.53:53", "udp"))
+	assert.False(t, authorize("spiffe://example.com/users/dev-alice", "10.1.1.1:22", "udp"))
+	assert.False(t, authorize("spiffe://example.com/users/dev-alice", "10.0.0.1:22", "tcp"))
+	assert.False(t, authorize("spiffe://example.com/users/dev-alice", "db.office.example.com:22", "tcp"))
+	assert.False(t, authorize("spiffe://example.com/users/ops-bob", "10.1.1.1:22", "tcp"))
+	mallory := ClaimsSubject{subject: "mallory", attributes: map[string][]string{"groups": {"developers"}}}
+	assert.True(t, enforcer.AuthorizeForward(NewForwardAction(mallory, "10.1.1.1:22", "tcp")))
+
+	// Invalid policies are refused with the line, the loaded policy is kept
+	assert.NoError(t, ioutil.WriteFile(policy, []byte(`roles:
+  developers:
+    members: [alice]
+    rules:
+      - effect: alow
+        destinations: [10.0.0.1]
+        ports: [22]
+`), 0600))
+	enforcer.reloadPolicy()
+	assert.True(t, authorize("spiffe://example.com/users/dev-alice", "10.1.1.1:22", "tcp"))
+}
+
+func TestYamlPolicyValidation(t *testing.T) {
+	for policy, expected := range map[string]string{
+		"roles:\n  dev:\n    member: [alice]\n": "line 3: unknown field member",
+		"roles:\n  dev:\n    members: [alice]\n    rules:\n      - effect: allow\n        destinations: [10.0.0.0/33]\n        ports: [22]\n":                      "line 5: role dev: invalid network 10.0.0.0/33",
+		"roles:\n  dev:\n    members: [alice]\n    rules:\n      - effect: allow\n        destinations: [10.0.0.1]\n":                                              "line 5: role dev: no ports or services",
+		"roles:\n  dev:\n    members: [alice]\n    rules:\n      - effect: allow\n        destinations: [\"@lab\"]\n        ports: [22]\n":                         "line 5: role dev: unknown address group @lab",
+		"roles:\n  dev:\n    members: [alice]\n    rules:\n      - effect: allow\n        destinations: [10.0.0.1]\n        ports: [22]\n        protocol: icmp\n": "line 5: role dev: invalid protocol",
+		"rolez: {}\n": "line 1: field rolez not found",
+	} {
+		path := filepath.Join(t.TempDir(), "policy.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(policy), 0600))
+		_, err := loadYamlPolicy(path, "")
+		if assert.Error(t, err, policy) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
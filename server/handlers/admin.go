@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"edgeproxy/server/auth"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type adminHandler struct {
+	authenticate auth.Authenticate
+	admins       []string
+	grants       *auth.GrantStore
+}
+
+// grantRequest creates a grant lasting until Expiry or for Duration (2h, 30m...)
+type grantRequest struct {
+	Subject     string    `json:"subject"`
+	Destination string    `json:"destination"`
+	Ports       string    `json:"ports"`
+	Protocol    string    `json:"protocol"`
+	Expiry      time.Time `json:"expiry"`
+	Duration    string    `json:"duration"`
+	Reason      string    `json:"reason"`
+}
+
+// NewAdminHandler serves the admin API to the admins authenticated by authenticate: GET /admin/grants lists
+// the active grants, POST /admin/grants creates one and DELETE /admin/grants/{id} revokes it
+func NewAdminHandler(authenticate auth.Authenticate, admins []string, grants *auth.GrantStore) http.Handler {
+	a := &adminHandler{authenticate: authenticate, admins: admins, grants: grants}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/grants", a.admin(a.listGrants)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/grants", a.admin(a.createGrant)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/grants/{id}", a.admin(a.revokeGrant)).Methods(http.MethodDelete)
+	return router
+}
+
+// admin authenticates the request and checks the subject is an admin
+func (a *adminHandler) admin(handler func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorized, subject := a.authenticate.Authenticate(w, r)
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !auth.SubjectMatches(subject, a.admins) {
+			log.Warnf("%s is not an admin, refused %s %s", subject.GetSubject(), r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, r, subject.GetSubject())
+	}
+}
+
+func (a *adminHandler) listGrants(w http.ResponseWriter, _ *http.Request, _ string) {
+	sendJson(w, http.StatusOK, a.grants.Grants())
+}
+
+func (a *adminHandler) createGrant(w http.ResponseWriter, r *http.Request, admin string) {
+	var request grantRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+	switch {
+	case request.Duration != "" && !request.Expiry.IsZero():
+		invalidRequest(w, errors.New("expiry and duration can't be combined"))
+		return
+	case request.Duration != "":
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			invalidRequest(w, err)
+			return
+		}
+		request.Expiry = time.Now().Add(duration)
+	}
+	grant, err := a.grants.Create(auth.Grant{
+		Subject:     request.Subject,
+		Destination: request.Destination,
+		Ports:       request.Ports,
+		Protocol:    request.Protocol,
+		Expiry:      request.Expiry,
+		Reason:      request.Reason,
+	}, admin)
+	if err != nil {
+		invalidRequest(w, err)
+		return
+	}
+	sendJson(w, http.StatusCreated, grant)
+}
+
+func (a *adminHandler) revokeGrant(w http.ResponseWriter, r *http.Request, admin string) {
+	if !a.grants.Revoke(mux.Vars(r)["id"], admin) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendJson(w http.ResponseWriter, statusCode int, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Errorf("Could not encode response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -2,15 +2,20 @@ package handlers
 
 import (
 	"context"
+	"edgeproxy/audit"
 	"edgeproxy/server/auth"
 	"edgeproxy/stream"
 	"edgeproxy/transport"
+	"errors"
 	"fmt"
 	h2conn "github.com/segator/h2conn"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -20,18 +25,27 @@ var (
 type httpHandlerFunc func(http.ResponseWriter, *http.Request)
 
 type tunnelHandler struct {
+	dnsResolver  string
+	destinations *transport.DestinationPolicy
+	quotas       *transport.Quotas
 }
 
-func NewTunnelHandlder(ctx context.Context) *tunnelHandler {
-	return &tunnelHandler{}
+func NewTunnelHandlder(ctx context.Context, dnsResolver string, destinations *transport.DestinationPolicy, quotas *transport.Quotas) *tunnelHandler {
+	return &tunnelHandler{
+		dnsResolver:  dnsResolver,
+		destinations: destinations,
+		quotas:       quotas,
+	}
 }
 
-func (t *tunnelHandler) TunnelHandler(authenticate auth.Authenticate, authorizer auth.Authorize) httpHandlerFunc {
+// TunnelHandler serves tunnels authenticated by authenticate, their credentials are revalidated every revalidateInterval
+func (t *tunnelHandler) TunnelHandler(authenticate auth.Authenticate, authorizer auth.Authorize, revalidateInterval time.Duration) httpHandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var serverConn io.ReadWriteCloser
 		var err error
 
 		authorized, subject := authenticate.Authenticate(res, req)
+		auditAuthentication(req, subject, authorized)
 		if !authorized {
 			res.WriteHeader(http.StatusUnauthorized)
 			return
@@ -47,13 +61,23 @@ func (t *tunnelHandler) TunnelHandler(authenticate auth.Authenticate, authorizer
 			invalidRequest(res, err)
 			return
 		}
+		release, err := t.acquireQuota(muxerType, req, subject)
+		if err != nil {
+			quotaExceeded(res, err)
+			return
+		}
+		defer release()
+		if muxerType == transport.YamuxMuxer && req.Header.Get(transport.HeaderForwardStatus) != "" {
+			res.Header().Set(transport.HeaderForwardStatus, "1")
+		}
 		serverConn, err = t.tunnelConnector(res, req)
 		if err != nil {
 			invalidRequest(res, err)
 			return
 		}
-		router := transport.NewRouter(authorizer)
-		err = muxer.ExecuteServerRouter(router, serverConn, subject.GetSubject())
+		router := transport.NewRouter(authorizer, t.dnsResolver, t.destinations)
+		session := transport.NewTunnelSession(req, authenticate, subject, revalidateInterval, t.quotas)
+		err = muxer.ExecuteServerRouter(router, serverConn, session)
 		if err != nil {
 			log.Debug(err)
 			//invalidRequest(res, err)
@@ -61,6 +85,39 @@ func (t *tunnelHandler) TunnelHandler(authenticate auth.Authenticate, authorizer
 	}
 }
 
+// auditAuthentication records the tunnel requests, with the subject when its credentials were accepted
+func auditAuthentication(req *http.Request, subject auth.Subject, authorized bool) {
+	event := audit.Event{
+		Type:       audit.SessionAuthenticatedEvent,
+		RemoteAddr: req.RemoteAddr,
+		Fields: map[string]interface{}{
+			"tunnel":    req.URL.Path,
+			"muxer":     req.Header.Get(transport.HeaderMuxerType),
+			"userAgent": req.UserAgent(),
+		},
+	}
+	if authorized {
+		event.Subject = subject.GetSubject()
+		event.Fields["expiry"] = auth.SubjectCredentialExpiry(subject)
+	} else {
+		event.Reason = "invalid_credentials"
+	}
+	audit.Log(event)
+}
+
+// acquireQuota counts a multiplexed tunnel as a session of the subject, a tunnel without muxer is a single forwarded
+// or DNS stream
+func (t *tunnelHandler) acquireQuota(muxerType transport.MuxerType, req *http.Request, subject auth.Subject) (func(), error) {
+	if muxerType == transport.YamuxMuxer {
+		return t.quotas.AcquireSession(subject)
+	}
+	switch req.Header.Get(transport.HeaderRouterAction) {
+	case transport.ConnectionForwardRouterAction.String(), transport.DnsResolveRouterAction.String():
+		return t.quotas.AcquireStream(subject)
+	}
+	return func() {}, nil
+}
+
 //This functions translates res and req to io.ReadWriteCloser based on the Client Requested Protocol(HTTP/2 Push,HTTP1.1 Websocket)
 func (t *tunnelHandler) tunnelConnector(res http.ResponseWriter, req *http.Request) (serverConn io.ReadWriteCloser, err error) {
 	//Check for HTTP2 tunnel
@@ -81,6 +138,16 @@ func (t *tunnelHandler) tunnelConnector(res http.ResponseWriter, req *http.Reque
 	return serverConn, nil
 }
 
+// quotaExceeded answers 429 with the quota error, and when to retry if it's known
+func quotaExceeded(w http.ResponseWriter, err error) {
+	var quotaErr *transport.QuotaExceededError
+	if errors.As(err, &quotaErr) && quotaErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(err.Error()))
+}
+
 func invalidRequest(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusBadRequest)
 	w.Write([]byte(err.Error()))
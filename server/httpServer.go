@@ -5,18 +5,22 @@ import (
 	"crypto/rand"
 
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"edgeproxy/config"
 	"edgeproxy/server/auth"
 	"edgeproxy/server/handlers"
+	"edgeproxy/stream"
+	"edgeproxy/transport"
 	"encoding/pem"
-	"fmt"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/http2"
 	"io/ioutil"
 	"math/big"
 	mrand "math/rand"
+	"net"
 	"sync/atomic"
 	"time"
 
@@ -32,22 +36,34 @@ type httpServer struct {
 	srvCertPath  string
 	srvKeyPath   string
 	IsReady      *atomic.Value
-	authenticate auth.Authenticate
-	authorize    auth.Authorize
+	tunnelRoutes []TunnelRoute
 	http2Srv     *http2.Server
+	router       *mux.Router
 }
 
-func NewHttpServer(ctx context.Context, authorizers auth.Authenticate, authorize auth.Authorize, httpPort, httpsPort int) httpServer {
-	return NewHttpServerWithTLS(ctx, authorizers, authorize, httpPort, httpsPort, "", "")
+// TunnelRoute serves tunnels on a path with its own authenticator chain and policy.
+// Credentials of open tunnels are revalidated every RevalidateInterval, zero disables it.
+type TunnelRoute struct {
+	Path               string
+	Authenticate       auth.Authenticate
+	Authorize          auth.Authorize
+	RevalidateInterval time.Duration
 }
 
-func NewHttpServerWithTLS(ctx context.Context, authenticate auth.Authenticate, authorize auth.Authorize, httpPort, httpsPort int, srvCertPath string, srvKeyPath string) httpServer {
+func NewHttpServer(ctx context.Context, tunnelRoutes []TunnelRoute, httpAddr, httpsAddr string, dnsResolver string, destinations *transport.DestinationPolicy, quotas *transport.Quotas) httpServer {
+	return NewHttpServerWithTLS(ctx, tunnelRoutes, httpAddr, httpsAddr, "", "", dnsResolver, destinations, quotas)
+}
+
+func NewHttpServerWithTLS(ctx context.Context, tunnelRoutes []TunnelRoute, httpAddr, httpsAddr string, srvCertPath string, srvKeyPath string, dnsResolver string, destinations *transport.DestinationPolicy, quotas *transport.Quotas) httpServer {
 	muxRouter := mux.NewRouter()
 	isReady := &atomic.Value{}
 	//TODO this probably should not be defined here
-	tunnelHandler := handlers.NewTunnelHandlder(ctx)
+	tunnelHandler := handlers.NewTunnelHandlder(ctx, dnsResolver, destinations, quotas)
 	isReady.Store(false)
-	muxRouter.HandleFunc("/", tunnelHandler.TunnelHandler(authenticate, authorize))
+	for _, route := range tunnelRoutes {
+		log.Infof("Serving tunnels on %s", route.Path)
+		muxRouter.HandleFunc(route.Path, tunnelHandler.TunnelHandler(route.Authenticate, route.Authorize, route.RevalidateInterval))
+	}
 
 	muxRouter.HandleFunc("/version", handlers.VersionHandler)
 	muxRouter.HandleFunc("/healthz", handlers.Healthz)
@@ -55,13 +71,17 @@ func NewHttpServerWithTLS(ctx context.Context, authenticate auth.Authenticate, a
 	muxRouter.Handle("/metrics", promhttp.Handler())
 
 	noTLS := &http.Server{
-		Addr:    fmt.Sprintf(":%d", httpPort),
+		Addr:    httpAddr,
 		Handler: muxRouter,
 	}
 
-	tls := &http.Server{
-		Addr:    fmt.Sprintf(":%d", httpsPort),
+	tlsSrv := &http.Server{
+		Addr:    httpsAddr,
 		Handler: muxRouter,
+		// Client certificates are requested but verified by the mTLS authenticator, so clients without certificate still connect
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequestClientCert,
+		},
 	}
 
 	if srvKeyPath == "" && srvCertPath == "" {
@@ -74,15 +94,21 @@ func NewHttpServerWithTLS(ctx context.Context, authenticate auth.Authenticate, a
 	return httpServer{
 		ctx:          ctx,
 		noTLSServer:  noTLS,
-		tlsServer:    tls,
-		authenticate: authenticate,
-		authorize:    authorize,
+		tlsServer:    tlsSrv,
+		tunnelRoutes: tunnelRoutes,
 		IsReady:      isReady,
 		srvCertPath:  srvCertPath,
 		srvKeyPath:   srvKeyPath,
+		router:       muxRouter,
 	}
 }
 
+// HandleAdmin serves the admin API under /admin/, it must be called before Start
+func (w *httpServer) HandleAdmin(handler http.Handler) {
+	log.Infof("Serving the admin API on /admin/")
+	w.router.PathPrefix("/admin/").Handler(handler)
+}
+
 func generateRandomCert() (privateKey string, certificate string) {
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -126,6 +152,9 @@ func generateRandomCert() (privateKey string, certificate string) {
 	if err != nil {
 		log.Fatal("Certificate cannot be created.", err.Error())
 	}
+	if parsedCert, err := x509.ParseCertificate(cert); err == nil {
+		log.Infof("Random certificate SPKI pin sha256/%s, clients can trust it with --insecure-skip-verify --tls-pin", stream.SPKIPin(parsedCert))
+	}
 
 	// Generate a pem block with the certificate
 	err = pem.Encode(tempCrt, &pem.Block{
@@ -142,14 +171,22 @@ func (w *httpServer) Start() {
 
 	go func() {
 		log.Infof("Starting HTTP TLS Web Server at Addr %s", w.tlsServer.Addr)
-		err := w.tlsServer.ListenAndServeTLS(w.srvCertPath, w.srvKeyPath)
+		listener, err := net.Listen(config.ListenNetwork("tcp", w.tlsServer.Addr), w.tlsServer.Addr)
+		if err != nil {
+			log.Fatalf("http server TLS Listen failure: %v", err)
+		}
+		err = w.tlsServer.ServeTLS(listener, w.srvCertPath, w.srvKeyPath)
 		if err != http.ErrServerClosed {
 			log.Fatalf("http server TLS Listen failure: %v", err)
 		}
 	}()
 	go func() {
 		log.Infof("Starting HTTP  Web Server at Addr %s", w.noTLSServer.Addr)
-		err := w.noTLSServer.ListenAndServe()
+		listener, err := net.Listen(config.ListenNetwork("tcp", w.noTLSServer.Addr), w.noTLSServer.Addr)
+		if err != nil {
+			log.Fatalf("http server  Listen failure: %v", err)
+		}
+		err = w.noTLSServer.Serve(listener)
 		if err != http.ErrServerClosed {
 			log.Fatalf("http server  Listen failure: %v", err)
 		}
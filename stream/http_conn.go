@@ -3,21 +3,66 @@ package stream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	h2conn "github.com/segator/h2conn"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
-func NewHttpBiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header) (net.Conn, error) {
+// maxStatusMessage bounds the response body read as the error message of a rejected tunnel
+const maxStatusMessage = 1024
+
+// StatusError is a tunnel request the server answered with an error status, Message is the response body
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bad status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("bad status code: %d: %s", e.StatusCode, e.Message)
+}
+
+// ResponseHeaderConn is a tunnel connection exposing the headers of the server response to the tunnel request
+type ResponseHeaderConn interface {
+	ResponseHeader() http.Header
+}
+
+type http2Conn struct {
+	*h2conn.Conn
+	header http.Header
+}
+
+func (c *http2Conn) ResponseHeader() http.Header {
+	return c.header
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxStatusMessage))
+	return &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+func NewHttpBiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header, options *DialOptions) (net.Conn, error) {
 	var conn net.Conn
-	conn, err := NewHttp2BiStreamConnFromEndpoint(ctx, endpoint, headers)
+	conn, err := NewHttp2BiStreamConnFromEndpoint(ctx, endpoint, headers, options)
+	// the server answered, so websocket would be rejected too
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return nil, err
+	}
 	if err != nil {
 		log.Debugf("Can not connect to %s via HTTP2, trying over Websocket", endpoint.String())
-		conn, err = NewWebsocketConnFromEndpoint(ctx, endpoint, headers)
+		conn, err = NewWebsocketConnFromEndpoint(ctx, endpoint, headers, options)
 		if err != nil {
 			return nil, err
 		}
@@ -25,7 +70,7 @@ func NewHttpBiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, hea
 	return conn, nil
 }
 
-func NewHttp2BiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header) (net.Conn, error) {
+func NewHttp2BiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header, options *DialOptions) (net.Conn, error) {
 	switch endpoint.Scheme {
 	case "wss":
 		endpoint.Scheme = "https"
@@ -38,7 +83,19 @@ func NewHttp2BiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, he
 		Header: headers,
 		Client: &http.Client{
 			Transport: &http2.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				TLSClientConfig: options.tlsConfig(),
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					conn, err := options.dialContext(ctx, endpoint, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					tlsConn := tls.Client(conn, cfg)
+					if err = tlsConn.HandshakeContext(ctx); err != nil {
+						conn.Close()
+						return nil, err
+					}
+					return tlsConn, nil
+				},
 			},
 		},
 	}
@@ -49,8 +106,10 @@ func NewHttp2BiStreamConnFromEndpoint(ctx context.Context, endpoint *url.URL, he
 	}
 	// Check server status code
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+		statusErr := newStatusError(resp)
+		conn.Close()
+		return nil, statusErr
 	}
 
-	return conn, nil
+	return &http2Conn{Conn: conn, header: resp.Header}, nil
 }
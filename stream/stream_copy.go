@@ -6,6 +6,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"runtime/debug"
+	"sync/atomic"
 )
 
 type copyDirection uint
@@ -16,18 +17,31 @@ const (
 )
 
 type BidirectionalStream struct {
-	doneChan     chan struct{}
+	doneChan     chan string
 	readBytes    *int64
 	writtenBytes *int64
 	conn1        io.ReadWriter
 	conn2        io.ReadWriter
 	conn1Name    string
 	conn2Name    string
+	closeReason  string
+}
+
+// countingWriter adds the bytes written to count, so they can be read while the copy is running
+type countingWriter struct {
+	io.Writer
+	count *int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	written, err := w.Writer.Write(b)
+	atomic.AddInt64(w.count, int64(written))
+	return written, err
 }
 
 func NewBidirectionalStream(conn1, conn2 io.ReadWriter, conn1Name, conn2Name string) *BidirectionalStream {
 	return &BidirectionalStream{
-		doneChan:     make(chan struct{}, 2),
+		doneChan:     make(chan string, 2),
 		readBytes:    new(int64),
 		writtenBytes: new(int64),
 		conn1:        conn1,
@@ -40,37 +54,46 @@ func NewBidirectionalStream(conn1, conn2 io.ReadWriter, conn1Name, conn2Name str
 func (b *BidirectionalStream) Stream() (readBytes int64, writtenBytes int64) {
 	go b.copyData(b.conn1, b.conn2, fmt.Sprintf("%s->%s", b.conn1Name, b.conn2Name), readDirection)
 	go b.copyData(b.conn2, b.conn1, fmt.Sprintf("%s->%s", b.conn2Name, b.conn1Name), writeDirection)
-	b.waitAnyDone()
+	b.closeReason = b.waitAnyDone()
+
+	readBytes, writtenBytes = atomic.LoadInt64(b.readBytes), atomic.LoadInt64(b.writtenBytes)
+	log.Debugf("Connection terminated, sent: %d bytes received:%d bytes", readBytes, writtenBytes)
+	metrics.IncrementRouterReadBytes(readBytes)
+	metrics.IncrementRouterWrittenBytes(writtenBytes)
+	return readBytes, writtenBytes
+}
 
-	log.Debugf("Connection terminated, sent: %d bytes received:%d bytes", *b.readBytes, *b.writtenBytes)
-	metrics.IncrementRouterReadBytes(*b.readBytes)
-	metrics.IncrementRouterWrittenBytes(*b.writtenBytes)
-	return *b.readBytes, *b.writtenBytes
+// CloseReason tells which side ended the stream, once Stream returned
+func (b *BidirectionalStream) CloseReason() string {
+	return b.closeReason
 }
 
-func (b *BidirectionalStream) markUniStreamDone() {
-	b.doneChan <- struct{}{}
+func (b *BidirectionalStream) markUniStreamDone(reason string) {
+	b.doneChan <- reason
 }
 
-func (b *BidirectionalStream) waitAnyDone() {
-	<-b.doneChan
+func (b *BidirectionalStream) waitAnyDone() string {
+	return <-b.doneChan
 }
 
 func (b *BidirectionalStream) copyData(dst, src io.ReadWriter, dir string, direction copyDirection) {
+	srcName, count := b.conn2Name, b.readBytes
+	if direction == writeDirection {
+		srcName, count = b.conn1Name, b.writtenBytes
+	}
+	reason := srcName + " closed"
 	defer func() {
 		if r := recover(); r != nil {
 			log.Debugf("Gracefully handled error %v in Streaming for %s, error %s", r, dir, debug.Stack())
 		}
 	}()
-	bytesTransfered, err := io.Copy(dst, src)
+	defer func() {
+		b.markUniStreamDone(reason)
+	}()
+	_, err := io.Copy(countingWriter{Writer: dst, count: count}, src)
 	if err != nil {
 		log.Debugf("%s copy: %v", dir, err)
+		reason = fmt.Sprintf("%s copy: %v", dir, err)
 	}
-	if direction == readDirection {
-		*b.readBytes = bytesTransfered
-	} else {
-		*b.writtenBytes = bytesTransfered
-	}
-	b.markUniStreamDone()
 
 }
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"edgeproxy/config"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const spkiPinPrefix = "sha256/"
+
+var ErrCertificatePinMismatch = errors.New("server certificate does not match any pin")
+
+// NewClientTLSConfig builds the TLS configuration used to reach the tunnel endpoint.
+// Server certificates are verified against the system roots, or the CA bundle if configured,
+// verification can only be disabled with the explicit insecure option.
+func NewClientTLSConfig(tlsConfig config.ClientTLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if tlsConfig.MinVersion != "" {
+		minVersion, err := parseTLSVersion(tlsConfig.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		cfg.MinVersion = minVersion
+	}
+
+	if tlsConfig.CaBundle != "" {
+		buf, err := ioutil.ReadFile(tlsConfig.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CA bundle %s: %v", tlsConfig.CaBundle, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", tlsConfig.CaBundle)
+		}
+	}
+
+	if tlsConfig.Certificate != "" {
+		clientCert, err := tls.LoadX509KeyPair(tlsConfig.Certificate, tlsConfig.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if len(tlsConfig.Pins) > 0 {
+		pins := make(map[string]bool, len(tlsConfig.Pins))
+		for _, pin := range tlsConfig.Pins {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+			if decoded, err := b64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %s, expected base64 encoded sha256", pin)
+			}
+			pins[pin] = true
+		}
+		insecure := tlsConfig.Insecure
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state, pins, insecure)
+		}
+	}
+	return cfg, nil
+}
+
+// verifyPins checks if any certificate of the verified chain matches a pin.
+// Without verification the chain can not be trusted, so only the leaf certificate is checked.
+func verifyPins(state tls.ConnectionState, pins map[string]bool, insecure bool) error {
+	var candidates []*x509.Certificate
+	if insecure {
+		if len(state.PeerCertificates) > 0 {
+			candidates = state.PeerCertificates[:1]
+		}
+	} else {
+		for _, chain := range state.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+	}
+	for _, cert := range candidates {
+		if pins[SPKIPin(cert)] {
+			return nil
+		}
+	}
+	return ErrCertificatePinMismatch
+}
+
+// SPKIPin returns the base64 sha256 of the certificate Subject Public Key Info
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return b64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", version)
+}
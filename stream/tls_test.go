@@ -0,0 +1,59 @@
+package stream
+
+import (
+	"crypto/tls"
+	"edgeproxy/config"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dialTLS(t *testing.T, srv *httptest.Server, tlsConfig config.ClientTLSConfig) error {
+	cfg, err := NewClientTLSConfig(tlsConfig)
+	assert.NoError(t, err)
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(srv.URL, "https://"), cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	serverCert := srv.Certificate()
+
+	caBundle, err := ioutil.TempFile("", "edgeproxy-ca-*.pem")
+	assert.NoError(t, err)
+	defer os.Remove(caBundle.Name())
+	assert.NoError(t, pem.Encode(caBundle, &pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Raw}))
+	caBundle.Close()
+
+	// Self signed server certificate is not trusted by default
+	assert.Error(t, dialTLS(t, srv, config.ClientTLSConfig{}))
+
+	// httptest certificate is issued for example.com
+	assert.NoError(t, dialTLS(t, srv, config.ClientTLSConfig{CaBundle: caBundle.Name(), ServerName: "example.com"}))
+	assert.NoError(t, dialTLS(t, srv, config.ClientTLSConfig{CaBundle: caBundle.Name(), ServerName: "example.com", Pins: []string{spkiPinPrefix + SPKIPin(serverCert)}}))
+
+	wrongPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	assert.ErrorIs(t, dialTLS(t, srv, config.ClientTLSConfig{CaBundle: caBundle.Name(), ServerName: "example.com", Pins: []string{wrongPin}}), ErrCertificatePinMismatch)
+
+	// Pins are still enforced on insecure mode
+	assert.NoError(t, dialTLS(t, srv, config.ClientTLSConfig{Insecure: true}))
+	assert.ErrorIs(t, dialTLS(t, srv, config.ClientTLSConfig{Insecure: true, Pins: []string{wrongPin}}), ErrCertificatePinMismatch)
+	assert.NoError(t, dialTLS(t, srv, config.ClientTLSConfig{Insecure: true, Pins: []string{SPKIPin(serverCert)}}))
+}
+
+func TestInvalidClientTLSConfig(t *testing.T) {
+	_, err := NewClientTLSConfig(config.ClientTLSConfig{MinVersion: "2.0"})
+	assert.Error(t, err)
+	_, err = NewClientTLSConfig(config.ClientTLSConfig{Pins: []string{"not-a-pin"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"edgeproxy/config"
+	b64 "encoding/base64"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const upstreamProxyDialTimeout = 30 * time.Second
+
+// DialOptions configures how the tunnel connections reach the server endpoint,
+// the same options are used by the HTTP2 and the Websocket streams.
+type DialOptions struct {
+	// Proxy returns the upstream proxy URL used to reach the endpoint, nil means direct connection
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSConfig used on the TLS handshake with the endpoint
+	TLSConfig *tls.Config
+}
+
+// NewDialOptions builds the tunnel dial options from the client configuration
+func NewDialOptions(upstreamProxy config.UpstreamProxyConfig, tlsConfig config.ClientTLSConfig) (*DialOptions, error) {
+	var err error
+	options := &DialOptions{}
+	options.TLSConfig, err = NewClientTLSConfig(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case upstreamProxy.Url != "":
+		proxyUrl, err := url.Parse(upstreamProxy.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy %s: %v", upstreamProxy.Url, err)
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("upstream proxy scheme %s not supported", proxyUrl.Scheme)
+		}
+		options.Proxy = http.ProxyURL(proxyUrl)
+	case upstreamProxy.FromEnvironment:
+		options.Proxy = http.ProxyFromEnvironment
+	}
+	return options, nil
+}
+
+// tlsConfig returns a copy of the endpoint TLS configuration, safe to be modified by the transports
+func (o *DialOptions) tlsConfig() *tls.Config {
+	if o == nil || o.TLSConfig == nil {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return o.TLSConfig.Clone()
+}
+
+// dialContext connects to addr, through the upstream proxy if one applies to the endpoint
+func (o *DialOptions) dialContext(ctx context.Context, endpoint *url.URL, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: upstreamProxyDialTimeout}
+	if o == nil || o.Proxy == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	// ProxyFromEnvironment selects the proxy with the request scheme, websocket schemes are mapped to http ones
+	proxyReq := &http.Request{URL: &url.URL{Scheme: httpScheme(endpoint.Scheme), Host: addr}}
+	proxyUrl, err := o.Proxy(proxyReq)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting upstream proxy: %v", err)
+	}
+	if proxyUrl == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	log.Debugf("Connecting to %s through upstream proxy %s", addr, proxyUrl.Redacted())
+
+	switch proxyUrl.Scheme {
+	case "socks5", "socks5h":
+		socksDialer, err := proxy.FromURL(proxyUrl, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socksDialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http", "https":
+		return dialHttpConnect(ctx, dialer, proxyUrl, addr)
+	}
+	return nil, fmt.Errorf("upstream proxy scheme %s not supported", proxyUrl.Scheme)
+}
+
+// dialHttpConnect opens a tunnel to addr with the HTTP CONNECT method, using Basic auth if the proxy URL has credentials
+func dialHttpConnect(ctx context.Context, dialer *net.Dialer, proxyUrl *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		port := "80"
+		if proxyUrl.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), port)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to upstream proxy %s: %v", proxyAddr, err)
+	}
+	if proxyUrl.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error on TLS handshake with upstream proxy %s: %v", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := b64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(upstreamProxyDialTimeout))
+	}
+	if err = connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending CONNECT to upstream proxy %s: %v", proxyAddr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from upstream proxy %s: %v", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s refused CONNECT to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps the bytes the proxy sent right after the CONNECT response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func httpScheme(scheme string) string {
+	switch scheme {
+	case "wss":
+		return "https"
+	case "ws":
+		return "http"
+	}
+	return scheme
+}
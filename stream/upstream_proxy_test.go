@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"edgeproxy/config"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startConnectProxy runs a minimal HTTP CONNECT proxy requiring the given Proxy-Authorization
+func startConnectProxy(t *testing.T, expectedAuth string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != expectedAuth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				dst, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer dst.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				NewBidirectionalStream(conn, dst, "client", "destination").Stream()
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDialThroughHttpConnectProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	// user:secret
+	proxyListener := startConnectProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+	defer proxyListener.Close()
+
+	options, err := NewDialOptions(config.UpstreamProxyConfig{Url: "http://user:secret@" + proxyListener.Addr().String()}, config.ClientTLSConfig{})
+	assert.NoError(t, err)
+	endpoint, _ := url.Parse("wss://" + echo.Addr().String())
+	conn, err := options.dialContext(context.Background(), endpoint, "tcp", echo.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	badOptions, err := NewDialOptions(config.UpstreamProxyConfig{Url: "http://user:wrong@" + proxyListener.Addr().String()}, config.ClientTLSConfig{})
+	assert.NoError(t, err)
+	_, err = badOptions.dialContext(context.Background(), endpoint, "tcp", echo.Addr().String())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "407")
+	}
+}
+
+func TestInvalidUpstreamProxy(t *testing.T) {
+	_, err := NewDialOptions(config.UpstreamProxyConfig{Url: "ftp://proxy:21"}, config.ClientTLSConfig{})
+	assert.Error(t, err)
+}
@@ -19,9 +19,10 @@ type websocketReadWriter struct {
 	ctx context.Context
 	*websocket.Conn
 	readBuf bytes.Buffer
+	header  http.Header
 }
 
-func NewWebsocketConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header) (*websocketReadWriter, error) {
+func NewWebsocketConnFromEndpoint(ctx context.Context, endpoint *url.URL, headers http.Header, options *DialOptions) (*websocketReadWriter, error) {
 	switch endpoint.Scheme {
 	case "https":
 		endpoint.Scheme = "wss"
@@ -33,14 +34,22 @@ func NewWebsocketConnFromEndpoint(ctx context.Context, endpoint *url.URL, header
 		HandshakeTimeout: 45 * time.Second,
 		ReadBufferSize:   32768,
 		WriteBufferSize:  32768,
+		TLSClientConfig:  options.tlsConfig(),
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return options.dialContext(ctx, endpoint, network, addr)
+		},
+	}
+	wssCon, resp, err := wssDialer.DialContext(ctx, endpoint.String(), headers)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, newStatusError(resp)
 	}
-	wssCon, _, err := wssDialer.DialContext(ctx, endpoint.String(), headers)
 	if err != nil {
 		return nil, fmt.Errorf("error when dialing Websocket tunnel %s: %v", endpoint, err)
 	}
 	return &websocketReadWriter{
-		ctx:  ctx,
-		Conn: wssCon,
+		ctx:    ctx,
+		Conn:   wssCon,
+		header: resp.Header,
 	}, nil
 }
 
@@ -49,7 +58,7 @@ func NewWebSocketConnectFromServer(ctx context.Context, res http.ResponseWriter,
 		ReadBufferSize:  32768,
 		WriteBufferSize: 32768,
 	}
-	wsConn, err := upgrader.Upgrade(res, req, nil)
+	wsConn, err := upgrader.Upgrade(res, req, res.Header())
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +68,10 @@ func NewWebSocketConnectFromServer(ctx context.Context, res http.ResponseWriter,
 	}, nil
 }
 
+func (a *websocketReadWriter) ResponseHeader() http.Header {
+	return a.header
+}
+
 func (a *websocketReadWriter) Read(b []byte) (int, error) {
 	if a.readBuf.Len() > 0 {
 		return a.readBuf.Read(b)
@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"edgeproxy/config"
+	"fmt"
+	"net"
+	"time"
+)
+
+const defaultResolveTimeout = 5 * time.Second
+
+// deniedNetworks are never reachable through the tunnel unless allowed explicitly:
+// loopback, unspecified, link-local (cloud metadata endpoints), multicast and broadcast
+var deniedNetworks = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"100.100.100.200/32",
+	"::/128",
+	"::1/128",
+	"fe80::/10",
+	"ff00::/8",
+	"fd00:ec2::254/128",
+}
+
+// privateNetworks are denied with ForwardConfig.DenyPrivateNetworks, RFC1918, shared address space and unique local
+var privateNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+}
+
+// DestinationPolicy protects the server network from forwards: host names are resolved on the server,
+// and only addresses outside the denied networks are dialed.
+type DestinationPolicy struct {
+	denied         []*net.IPNet
+	allowed        []*net.IPNet
+	resolver       *net.Resolver
+	resolveTimeout time.Duration
+}
+
+func NewDestinationPolicy(forwardConfig config.ForwardConfig) (*DestinationPolicy, error) {
+	d := &DestinationPolicy{
+		resolver:       net.DefaultResolver,
+		resolveTimeout: forwardConfig.ResolveTimeout,
+	}
+	if d.resolveTimeout <= 0 {
+		d.resolveTimeout = defaultResolveTimeout
+	}
+	denied := append([]string{}, deniedNetworks...)
+	if forwardConfig.DenyPrivateNetworks {
+		denied = append(denied, privateNetworks...)
+	}
+	var err error
+	if d.denied, err = parseNetworks(append(denied, forwardConfig.DeniedNetworks...)); err != nil {
+		return nil, err
+	}
+	if d.allowed, err = parseNetworks(forwardConfig.AllowedNetworks); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Allowed reports if the address can be dialed, allowed networks take precedence over the denied ones
+func (d *DestinationPolicy) Allowed(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range d.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range d.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve looks up the host addresses on the server
+func (d *DestinationPolicy) Resolve(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.resolveTimeout)
+	defer cancel()
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/server/auth"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationPolicyAllowed(t *testing.T) {
+	destinations, err := NewDestinationPolicy(config.ForwardConfig{})
+	assert.NoError(t, err)
+	for _, denied := range []string{"127.0.0.1", "169.254.169.254", "0.0.0.0", "::1", "::ffff:127.0.0.1", "fe80::1", "fd00:ec2::254", "224.0.0.1"} {
+		assert.False(t, destinations.Allowed(net.ParseIP(denied)), denied)
+	}
+	for _, allowed := range []string{"8.8.8.8", "10.0.0.1", "192.168.1.1", "2001:4860:4860::8888"} {
+		assert.True(t, destinations.Allowed(net.ParseIP(allowed)), allowed)
+	}
+
+	destinations, err = NewDestinationPolicy(config.ForwardConfig{
+		DenyPrivateNetworks: true,
+		DeniedNetworks:      []string{"203.0.113.0/24"},
+		AllowedNetworks:     []string{"10.1.0.0/16"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, destinations.Allowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, destinations.Allowed(net.ParseIP("fd12::1")))
+	assert.False(t, destinations.Allowed(net.ParseIP("203.0.113.10")))
+	assert.True(t, destinations.Allowed(net.ParseIP("10.1.2.3")))
+
+	_, err = NewDestinationPolicy(config.ForwardConfig{AllowedNetworks: []string{"not a network"}})
+	assert.Error(t, err)
+}
+
+// ipDenyingAuthorizer allows domains but no IP address
+type ipDenyingAuthorizer struct{}
+
+func (ipDenyingAuthorizer) AuthorizeForward(forwardAction auth.ForwardAction) bool {
+	host, _, _ := net.SplitHostPort(forwardAction.DestinationAddr)
+	return net.ParseIP(host) == nil
+}
+
+func (a ipDenyingAuthorizer) AuthorizeResolved(forwardAction auth.ForwardAction) bool {
+	return a.AuthorizeForward(forwardAction)
+}
+
+func TestRouterVetsResolvedAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	forward := func(router *Router, host string) error {
+		source, tunnel := net.Pipe()
+		defer source.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- router.ConnectionForward(tunnel, auth.ForwardAction{Subject: "alice", DestinationAddr: net.JoinHostPort(host, port), NetType: "tcp"}, func() {})
+		}()
+		go func() {
+			source.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(source, buf); err == nil {
+				source.Close()
+			}
+		}()
+		return <-done
+	}
+
+	// Loopback can't be reached, neither by address nor by a name resolving to it
+	router := NewRouter(auth.NoopAuthorizer(), "", nil)
+	assert.Error(t, forward(router, "127.0.0.1"))
+	err = forward(router, "localhost")
+	if assert.Error(t, err) {
+		// the client isn't told the addresses the server resolved
+		assert.NotContains(t, err.Error(), "127.0.0.1")
+	}
+
+	loopbackAllowed, err := NewDestinationPolicy(config.ForwardConfig{AllowedNetworks: []string{"127.0.0.0/8", "::1/128"}})
+	assert.NoError(t, err)
+	assert.NoError(t, forward(NewRouter(auth.NoopAuthorizer(), "", loopbackAllowed), "localhost"))
+	// The resolved addresses must be allowed by the IP policy too
+	assert.Error(t, forward(NewRouter(ipDenyingAuthorizer{}, "", loopbackAllowed), "localhost"))
+}
+
+func TestRouterAuthorizesDnsForwards(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	newForward := func(destinationAddr, netType string) auth.ForwardAction {
+		return auth.ForwardAction{Subject: "alice", DestinationAddr: destinationAddr, NetType: netType}
+	}
+	forward := func(router *Router) error {
+		source, tunnel := net.Pipe()
+		defer source.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- router.DnsForward(tunnel, newForward, func() {})
+		}()
+		go func() {
+			source.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(source, buf); err == nil {
+				source.Close()
+			}
+		}()
+		return <-done
+	}
+
+	assert.NoError(t, forward(NewRouter(auth.NoopAuthorizer(), listener.Addr().String(), nil)))
+	// The resolver is a forward destination of the subject, the policies must allow it
+	assert.Error(t, forward(NewRouter(ipDenyingAuthorizer{}, listener.Addr().String(), nil)))
+}
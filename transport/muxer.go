@@ -20,7 +20,8 @@ type Dialer interface {
 }
 
 type Muxer interface {
-	ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, subject string) error
+	// ExecuteServerRouter routes the tunnel streams until the tunnel is closed, or the session credentials are no longer valid
+	ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, session *TunnelSession) error
 }
 type MuxerType string
 
@@ -1,7 +1,6 @@
 package transport
 
 import (
-	"edgeproxy/server/auth"
 	"fmt"
 	"io"
 	"net/http"
@@ -20,11 +19,13 @@ func NewHttpNoMuxer(req *http.Request) (*httpNoMuxer, error) {
 	if err != nil {
 		return nil, err
 	}
-	if netType == "" {
-		return nil, fmt.Errorf("invalid Net Type")
-	}
-	if dstAddr == "" {
-		return nil, fmt.Errorf("invalid dst Addr")
+	if routerAction == ConnectionForwardRouterAction {
+		if netType == "" {
+			return nil, fmt.Errorf("invalid Net Type")
+		}
+		if dstAddr == "" {
+			return nil, fmt.Errorf("invalid dst Addr")
+		}
 	}
 
 	directRouter := &httpNoMuxer{
@@ -36,12 +37,17 @@ func NewHttpNoMuxer(req *http.Request) (*httpNoMuxer, error) {
 	return directRouter, nil
 }
 
-func (h *httpNoMuxer) ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, subject string) error {
+func (h *httpNoMuxer) ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, session *TunnelSession) error {
 	defer tunnelConn.Close()
+	stopSupervision := session.supervise(tunnelConn.Close)
+	defer stopSupervision()
 	var err error
 	switch h.routerAction {
 	case ConnectionForwardRouterAction:
-		err = router.ConnectionForward(tunnelConn, auth.NewForwardAction(subject, h.dstAddr, h.netType))
+		// the stream quota of the forwards is acquired by the tunnel handler, a rejection is answered with the HTTP status
+		err = router.ConnectionForward(tunnelConn, session.ForwardAction(h.dstAddr, h.netType), func() {})
+	case DnsResolveRouterAction:
+		err = router.DnsForward(tunnelConn, session.ForwardAction, func() {})
 	}
 	if err != nil {
 		return err
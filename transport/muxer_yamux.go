@@ -1,7 +1,6 @@
 package transport
 
 import (
-	"edgeproxy/server/auth"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"time"
@@ -31,12 +30,14 @@ func NewYamuxMuxer() (*yamuxMuxer, error) {
 	return m, nil
 }
 
-func (h *yamuxMuxer) ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, subject string) error {
+func (h *yamuxMuxer) ExecuteServerRouter(router *Router, tunnelConn io.ReadWriteCloser, tunnelSession *TunnelSession) error {
 	session, err := yamux.Server(tunnelConn, h.yamuxConfig)
 	if err != nil {
 		return err
 	}
 	defer session.Close()
+	stopSupervision := tunnelSession.supervise(session.Close)
+	defer stopSupervision()
 
 	for {
 		originConn, err := session.Accept()
@@ -44,25 +45,57 @@ func (h *yamuxMuxer) ExecuteServerRouter(router *Router, tunnelConn io.ReadWrite
 		if err != nil {
 			return err
 		}
-		go h.acceptConnection(originConn, router, subject)
+		go h.acceptConnection(originConn, router, tunnelSession)
 	}
 
 }
 
-func (h *yamuxMuxer) acceptConnection(originConn io.ReadWriteCloser, router *Router, subject string) {
+func (h *yamuxMuxer) acceptConnection(originConn io.ReadWriteCloser, router *Router, tunnelSession *TunnelSession) {
 	defer originConn.Close()
 	frame, actionFrame, err := readFrame(originConn)
 	if err != nil {
 		log.Warnf("error reading frame incoming connection: %v", err)
+		return
 	}
 
+	subject := tunnelSession.Subject()
 	switch frame.RouterAction() {
 	case ConnectionForwardRouterAction:
 		fwFrame, _ := actionFrame.(ForwardFrame)
-		forwardAction := auth.NewForwardAction(subject, fwFrame.DstAddr(), fwFrame.NetType().String())
-		err = router.ConnectionForward(originConn, forwardAction)
+		forwardAction := tunnelSession.ForwardAction(fwFrame.DstAddr(), fwFrame.NetType().String())
+		release, err := tunnelSession.AcquireStream()
+		if err == nil {
+			defer release()
+			err = router.ConnectionForward(originConn, forwardAction, func() {
+				tunnelSession.writeForwardStatus(originConn, nil)
+			})
+		}
 		if err != nil {
+			tunnelSession.writeForwardStatus(originConn, err)
 			log.Warnf("error on Connection Forward: %v", err)
 		}
+	case DnsResolveRouterAction:
+		// DNS forwards hold a resolver connection, they count as streams too
+		release, err := tunnelSession.AcquireStream()
+		if err == nil {
+			defer release()
+			err = router.DnsForward(originConn, tunnelSession.ForwardAction, func() {
+				tunnelSession.writeForwardStatus(originConn, nil)
+			})
+		}
+		if err != nil {
+			tunnelSession.writeForwardStatus(originConn, err)
+			log.Warnf("error on DNS Forward: %v", err)
+		}
+	case ReauthenticateRouterAction:
+		reauthFrame, _ := actionFrame.(ReauthenticateFrame)
+		headers, err := reauthFrame.Headers()
+		if err == nil {
+			err = tunnelSession.Reauthenticate(headers)
+		}
+		if err != nil {
+			log.Warnf("rejected re-authentication of %s: %v", subject.GetSubject(), err)
+		}
+		writeReauthenticateStatus(originConn, err == nil)
 	}
 }
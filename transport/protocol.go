@@ -1,14 +1,21 @@
 package transport
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
 )
 
 const (
 	ConnectionForwardRouterAction RouterAction = 0
+	DnsResolveRouterAction        RouterAction = 1
+	ReauthenticateRouterAction    RouterAction = 2
 	TcpNetType                    NetType      = 0
 	UdpNetType                    NetType      = 1
 	protoVersion                  uint8        = 0
@@ -16,17 +23,37 @@ const (
 	HeaderNetworkType                          = "X-EDGEPROXY-NETWORK"
 	HeaderRouterAction                         = "X-EDGEPROXY-ACTION"
 	HeaderDstAddress                           = "X-EDGEPROXY-DST"
+	HeaderForwardStatus                        = "X-EDGEPROXY-FORWARD-STATUS"
 	versionSize                                = 1
 	routerAction                               = 1
 	payload                                    = 4
 	frameSize                                  = versionSize + routerAction + payload
 )
 
+const (
+	// maxReauthenticateFrameSize bounds the credential headers sent on a re-authentication
+	maxReauthenticateFrameSize       = 64 * 1024
+	reauthenticateAccepted     uint8 = 0
+	reauthenticateRejected     uint8 = 1
+)
+
+const (
+	ForwardEstablished   ForwardStatus = 0
+	ForwardDenied        ForwardStatus = 1
+	ForwardQuotaExceeded ForwardStatus = 2
+	ForwardFailed        ForwardStatus = 3
+	// maxForwardStatusMessage bounds the error message sent with a forward status
+	maxForwardStatusMessage = 1024
+)
+
 var ErrInvalidFrame = errors.New("invalid Frame")
 
 type Frame []byte
 type ForwardFrame []byte
 
+// ReauthenticateFrame carries the credential headers, in HTTP wire format, refreshing the tunnel authentication
+type ReauthenticateFrame []byte
+
 func (h Frame) Version() uint8 {
 	return h[0]
 }
@@ -45,6 +72,16 @@ func (h ForwardFrame) DstAddr() string {
 	return string(h[1:])
 }
 
+func (h ReauthenticateFrame) Headers() (http.Header, error) {
+	// the header block ends with an empty line
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(h), strings.NewReader("\r\n"))))
+	headers, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Reauthenticate frame: %v", err)
+	}
+	return http.Header(headers), nil
+}
+
 func (h ForwardFrame) encode(addr string, netType NetType) {
 	h[0] = uint8(netType)
 	b := []byte(addr)
@@ -62,10 +99,40 @@ func (h Frame) encode(routerAction RouterAction, payloadSize int) {
 type RouterAction uint8
 type NetType uint8
 
+// ForwardStatus tells the client if the server established a forward, or why it didn't. Clients reading it
+// send the HeaderForwardStatus header on the tunnel request, servers writing it send it back on the response.
+type ForwardStatus uint8
+
+func (s ForwardStatus) String() string {
+	switch s {
+	case ForwardEstablished:
+		return "established"
+	case ForwardDenied:
+		return "denied"
+	case ForwardQuotaExceeded:
+		return "quota exceeded"
+	case ForwardFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("status %d", s)
+}
+
+// ForwardError is a forward the server didn't establish, Message is the server error
+type ForwardError struct {
+	Status  ForwardStatus
+	Message string
+}
+
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("forward %s: %s", e.Status, e.Message)
+}
+
 func RouterActionFromString(routerAction string) (RouterAction, error) {
 	switch routerAction {
 	case "forward":
 		return ConnectionForwardRouterAction, nil
+	case "dns":
+		return DnsResolveRouterAction, nil
 	}
 	return 0, fmt.Errorf("router Action %s not available", routerAction)
 }
@@ -73,6 +140,10 @@ func (r RouterAction) String() string {
 	switch r {
 	case ConnectionForwardRouterAction:
 		return "forward"
+	case DnsResolveRouterAction:
+		return "dns"
+	case ReauthenticateRouterAction:
+		return "reauthenticate"
 	}
 	return ""
 }
@@ -80,10 +151,8 @@ func NetTypeFromStr(netType string) (NetType, error) {
 	switch netType {
 	case "tcp":
 		return TcpNetType, nil
-		break
 	case "udp":
 		return UdpNetType, nil
-		break
 	}
 	return 0, fmt.Errorf("netType %s not available", netType)
 }
@@ -122,8 +191,17 @@ func readFrame(r io.Reader) (Frame, interface{}, error) {
 		}
 
 		return frame, fwdFrame, nil
-		break
-
+	case DnsResolveRouterAction:
+		return frame, nil, nil
+	case ReauthenticateRouterAction:
+		if frame.PayloadSize() > maxReauthenticateFrameSize {
+			return nil, nil, fmt.Errorf("reauthenticate frame Size %d bigger than %d: %v", frame.PayloadSize(), maxReauthenticateFrameSize, ErrInvalidFrame)
+		}
+		reauthFrame := ReauthenticateFrame(make([]byte, frame.PayloadSize()))
+		if _, err := io.ReadFull(r, reauthFrame); err != nil {
+			return nil, nil, err
+		}
+		return frame, reauthFrame, nil
 	}
 	return nil, nil, fmt.Errorf("invalid Router Action Frame %d", frame.RouterAction())
 }
@@ -135,8 +213,97 @@ func NewForwardFrame(dstAddr string, netType NetType) (Frame, ForwardFrame) {
 	return frame, fwdFrame
 }
 
+// NewDnsFrame creates the frame that asks the server to pipe the stream to its DNS resolver.
+// The stream carries DNS messages using TCP framing (2 bytes length prefix).
+func NewDnsFrame() Frame {
+	return newActionFrame(DnsResolveRouterAction, 0)
+}
+
 func newFrame(payloadSize int) Frame {
+	return newActionFrame(ConnectionForwardRouterAction, payloadSize)
+}
+
+func newActionFrame(routerAction RouterAction, payloadSize int) Frame {
 	frame := Frame(make([]byte, frameSize))
-	frame.encode(ConnectionForwardRouterAction, payloadSize)
+	frame.encode(routerAction, payloadSize)
 	return frame
 }
+
+// NewReauthenticateFrame creates the frame refreshing the tunnel credentials without reconnecting,
+// the server answers with a status byte.
+func NewReauthenticateFrame(headers http.Header) (Frame, ReauthenticateFrame) {
+	var buf bytes.Buffer
+	headers.Write(&buf)
+	reauthFrame := ReauthenticateFrame(buf.Bytes())
+	return newActionFrame(ReauthenticateRouterAction, len(reauthFrame)), reauthFrame
+}
+
+// ReadReauthenticateStatus reads the server answer to a re-authentication
+func ReadReauthenticateStatus(r io.Reader) error {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return fmt.Errorf("no re-authentication status: %v", err)
+	}
+	if status[0] != reauthenticateAccepted {
+		return errors.New("re-authentication rejected")
+	}
+	return nil
+}
+
+func writeReauthenticateStatus(w io.Writer, accepted bool) error {
+	status := reauthenticateRejected
+	if accepted {
+		status = reauthenticateAccepted
+	}
+	_, err := w.Write([]byte{status})
+	return err
+}
+
+// ReadForwardStatus reads the server answer to a forward, a status byte followed by the error message size and message.
+// A *ForwardError is returned if the forward was not established.
+func ReadForwardStatus(r io.Reader) error {
+	status := make([]byte, 3)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return fmt.Errorf("no forward status: %v", err)
+	}
+	if ForwardStatus(status[0]) == ForwardEstablished {
+		return nil
+	}
+	size := binary.BigEndian.Uint16(status[1:])
+	if size > maxForwardStatusMessage {
+		return fmt.Errorf("forward status message Size %d bigger than %d: %v", size, maxForwardStatusMessage, ErrInvalidFrame)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return fmt.Errorf("no forward status message: %v", err)
+	}
+	return &ForwardError{Status: ForwardStatus(status[0]), Message: string(message)}
+}
+
+// writeForwardStatus answers a forward, established if err is nil
+func writeForwardStatus(w io.Writer, err error) error {
+	status, message := ForwardEstablished, ""
+	var quotaErr *QuotaExceededError
+	var deniedErr deniedError
+	switch {
+	case err == nil:
+	case errors.As(err, &quotaErr):
+		status = ForwardQuotaExceeded
+	case errors.As(err, &deniedErr):
+		status = ForwardDenied
+	default:
+		status = ForwardFailed
+	}
+	if err != nil {
+		message = err.Error()
+	}
+	if len(message) > maxForwardStatusMessage {
+		message = message[:maxForwardStatusMessage]
+	}
+	frame := make([]byte, 3+len(message))
+	frame[0] = uint8(status)
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(message)))
+	copy(frame[3:], message)
+	_, err = w.Write(frame)
+	return err
+}
@@ -2,7 +2,9 @@ package transport
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net/http"
 	"testing"
 )
 import "github.com/stretchr/testify/assert"
@@ -42,3 +44,59 @@ func TestReadFrame(t *testing.T) {
 	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
 
 }
+
+func TestReadDnsFrame(t *testing.T) {
+	frame, actionFrame, err := readFrame(bytes.NewReader(NewDnsFrame()))
+	assert.NoError(t, err)
+	assert.Equal(t, DnsResolveRouterAction, frame.RouterAction())
+	assert.Nil(t, actionFrame)
+
+	routerAction, err := RouterActionFromString(DnsResolveRouterAction.String())
+	assert.NoError(t, err)
+	assert.Equal(t, DnsResolveRouterAction, routerAction)
+}
+
+func TestReadReauthenticateFrame(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer token")
+	headers.Set("X-Client-Certificate", "cert")
+	frame, reauth := NewReauthenticateFrame(headers)
+	readed, actionFrame, err := readFrame(bytes.NewReader(append(frame, reauth...)))
+	assert.NoError(t, err)
+	assert.Equal(t, ReauthenticateRouterAction, readed.RouterAction())
+	decoded, err := actionFrame.(ReauthenticateFrame).Headers()
+	assert.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+
+	// Oversized credentials are refused before reading them
+	_, _, err = readFrame(bytes.NewReader(newActionFrame(ReauthenticateRouterAction, maxReauthenticateFrameSize+1)))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ErrInvalidFrame.Error())
+	}
+
+	var status bytes.Buffer
+	writeReauthenticateStatus(&status, false)
+	assert.Error(t, ReadReauthenticateStatus(&status))
+	writeReauthenticateStatus(&status, true)
+	assert.NoError(t, ReadReauthenticateStatus(&status))
+}
+
+func TestReadForwardStatus(t *testing.T) {
+	var status bytes.Buffer
+	writeForwardStatus(&status, nil)
+	assert.NoError(t, ReadForwardStatus(&status))
+
+	for err, expected := range map[error]ForwardStatus{
+		denied("denied alice access to tcp/10.0.0.1:22"):                    ForwardDenied,
+		&QuotaExceededError{Limit: StreamsQuota, Subject: "alice", Max: 10}: ForwardQuotaExceeded,
+		errors.New("can not connect to 10.0.0.1:22"):                        ForwardFailed,
+	} {
+		writeForwardStatus(&status, err)
+		var forwardErr *ForwardError
+		if assert.ErrorAs(t, ReadForwardStatus(&status), &forwardErr) {
+			assert.Equal(t, expected, forwardErr.Status)
+			assert.Equal(t, err.Error(), forwardErr.Message)
+		}
+	}
+	assert.Zero(t, status.Len())
+}
@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/metrics"
+	"edgeproxy/server/auth"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SessionsQuota = "sessions"
+	StreamsQuota  = "streams"
+	RateQuota     = "rate"
+	// defaultQuotaRole labels the rejections of subjects not matching any quota role
+	defaultQuotaRole = "default"
+)
+
+// QuotaExceededError is a session or stream rejected because the subject reached one of its limits,
+// RetryAfter is set when it's known when the limit allows it again.
+type QuotaExceededError struct {
+	Limit      string
+	Subject    string
+	Max        float64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	message := fmt.Sprintf("%s quota exceeded for %s, limit %g", e.Limit, e.Subject, e.Max)
+	if e.Limit == RateQuota {
+		message += " per second"
+	}
+	if e.RetryAfter > 0 {
+		message += fmt.Sprintf(", retry in %s", e.RetryAfter.Round(time.Millisecond))
+	}
+	return message
+}
+
+// Quotas limits the concurrent sessions, the concurrent forwarded streams and the new streams per second of each subject.
+// The limits of the first quota role matching the subject replace the default ones. A nil Quotas has no limits.
+type Quotas struct {
+	config config.QuotaConfig
+	mu     sync.Mutex
+	usages map[string]*quotaUsage
+}
+
+// quotaUsage is what a subject holds, tokens is the connection rate bucket refilled since updated.
+// pruning is set while a prune of the subject is pending.
+type quotaUsage struct {
+	sessions int
+	streams  int
+	tokens   float64
+	updated  time.Time
+	pruning  bool
+}
+
+// NewQuotas returns the quotas of the configuration, nil if no limit is set
+func NewQuotas(quotaConfig config.QuotaConfig) *Quotas {
+	if quotaConfig.QuotaLimits == (config.QuotaLimits{}) && len(quotaConfig.Roles) == 0 {
+		return nil
+	}
+	return &Quotas{
+		config: quotaConfig,
+		usages: map[string]*quotaUsage{},
+	}
+}
+
+// AcquireSession counts a tunnel session of the subject, also taking a token of its connection rate.
+// release must be called when it's closed.
+func (q *Quotas) AcquireSession(subject auth.Subject) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	role, limits := q.limits(subject)
+	name := subject.GetSubject()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.usage(name, limits)
+	if limits.Sessions > 0 && usage.sessions >= limits.Sessions {
+		q.pruneLater(name, limits)
+		return nil, q.reject(role, &QuotaExceededError{Limit: SessionsQuota, Subject: name, Max: float64(limits.Sessions)})
+	}
+	if err := q.takeToken(role, name, limits, usage); err != nil {
+		return nil, err
+	}
+	usage.sessions++
+	return q.releaser(name, limits, func(usage *quotaUsage) { usage.sessions-- }), nil
+}
+
+// AcquireStream counts a forwarded stream of the subject, also taking a token of its connection rate.
+// release must be called when the stream is closed.
+func (q *Quotas) AcquireStream(subject auth.Subject) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	role, limits := q.limits(subject)
+	name := subject.GetSubject()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := q.usage(name, limits)
+	if limits.Streams > 0 && usage.streams >= limits.Streams {
+		q.pruneLater(name, limits)
+		return nil, q.reject(role, &QuotaExceededError{Limit: StreamsQuota, Subject: name, Max: float64(limits.Streams)})
+	}
+	if err := q.takeToken(role, name, limits, usage); err != nil {
+		return nil, err
+	}
+	usage.streams++
+	return q.releaser(name, limits, func(usage *quotaUsage) { usage.streams-- }), nil
+}
+
+// takeToken takes a token of the connection rate bucket of the subject, the caller holds the lock
+func (q *Quotas) takeToken(role string, name string, limits config.QuotaLimits, usage *quotaUsage) error {
+	if limits.ConnectionRate <= 0 {
+		return nil
+	}
+	if usage.tokens < 1 {
+		retryAfter := time.Duration((1 - usage.tokens) / limits.ConnectionRate * float64(time.Second))
+		q.pruneLater(name, limits)
+		return q.reject(role, &QuotaExceededError{Limit: RateQuota, Subject: name, Max: limits.ConnectionRate, RetryAfter: retryAfter})
+	}
+	usage.tokens--
+	return nil
+}
+
+// limits returns the quota role of the subject and its limits
+func (q *Quotas) limits(subject auth.Subject) (string, config.QuotaLimits) {
+	for _, role := range q.config.Roles {
+		if auth.SubjectMatches(subject, role.Members) {
+			return role.Name, role.QuotaLimits
+		}
+	}
+	return defaultQuotaRole, q.config.QuotaLimits
+}
+
+// usage returns the usage of the subject with its rate bucket refilled, the caller holds the lock
+func (q *Quotas) usage(name string, limits config.QuotaLimits) *quotaUsage {
+	now := time.Now()
+	usage, ok := q.usages[name]
+	if !ok {
+		usage = &quotaUsage{tokens: burst(limits), updated: now}
+		q.usages[name] = usage
+	}
+	usage.tokens = math.Min(burst(limits), usage.tokens+now.Sub(usage.updated).Seconds()*limits.ConnectionRate)
+	usage.updated = now
+	return usage
+}
+
+// releaser returns the release of an acquired session or stream, later calls do nothing
+func (q *Quotas) releaser(name string, limits config.QuotaLimits, release func(usage *quotaUsage)) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			release(q.usage(name, limits))
+			q.pruneLater(name, limits)
+		})
+	}
+}
+
+// pruneLater forgets an idle subject once its rate bucket is full again, the caller holds the lock.
+// A subject has a single pending prune, rescheduled while the bucket isn't full.
+func (q *Quotas) pruneLater(name string, limits config.QuotaLimits) {
+	usage := q.usages[name]
+	if usage.pruning || usage.sessions > 0 || usage.streams > 0 {
+		return
+	}
+	usage.pruning = true
+	var refill time.Duration
+	if limits.ConnectionRate > 0 {
+		refill = time.Duration((burst(limits) - usage.tokens) / limits.ConnectionRate * float64(time.Second))
+	}
+	time.AfterFunc(refill, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		usage, ok := q.usages[name]
+		if !ok {
+			return
+		}
+		usage.pruning = false
+		if usage.sessions == 0 && usage.streams == 0 && q.usage(name, limits).tokens >= burst(limits) {
+			delete(q.usages, name)
+			return
+		}
+		q.pruneLater(name, limits)
+	})
+}
+
+func (q *Quotas) reject(role string, err *QuotaExceededError) error {
+	log.Warnf("Rejected by quota role %s: %v", role, err)
+	metrics.IncrementQuotaRejected(err.Limit, role)
+	return err
+}
+
+// burst is the size of the rate bucket, the rate rounded up if not set
+func burst(limits config.QuotaLimits) float64 {
+	if limits.ConnectionBurst > 0 {
+		return float64(limits.ConnectionBurst)
+	}
+	return math.Max(1, math.Ceil(limits.ConnectionRate))
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"edgeproxy/config"
+	"edgeproxy/server/auth"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotas(t *testing.T) {
+	quotas := NewQuotas(config.QuotaConfig{
+		QuotaLimits: config.QuotaLimits{Sessions: 1, Streams: 2, ConnectionRate: 1, ConnectionBurst: 5},
+		Roles: []config.QuotaRole{{
+			Name:        "ci",
+			Members:     []string{"ci/*"},
+			QuotaLimits: config.QuotaLimits{Sessions: 2},
+		}},
+	})
+	alice, bob, ci := testSubject{name: "alice"}, testSubject{name: "bob"}, testSubject{name: "ci/build"}
+	quotaLimit := func(err error) string {
+		var quotaErr *QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			return quotaErr.Limit
+		}
+		return ""
+	}
+
+	// Sessions are counted per subject until released
+	release, err := quotas.AcquireSession(alice)
+	assert.NoError(t, err)
+	_, err = quotas.AcquireSession(alice)
+	assert.Equal(t, SessionsQuota, quotaLimit(err))
+	_, err = quotas.AcquireSession(bob)
+	assert.NoError(t, err)
+	release()
+	release()
+	_, err = quotas.AcquireSession(alice)
+	assert.NoError(t, err)
+
+	// Streams and the connection rate
+	releaseStream, err := quotas.AcquireStream(alice)
+	assert.NoError(t, err)
+	_, err = quotas.AcquireStream(alice)
+	assert.NoError(t, err)
+	_, err = quotas.AcquireStream(alice)
+	assert.Equal(t, StreamsQuota, quotaLimit(err))
+	releaseStream()
+	_, err = quotas.AcquireStream(alice)
+	assert.NoError(t, err)
+	releaseStream, _ = quotas.AcquireStream(bob)
+	releaseStream()
+	_, err = quotas.AcquireStream(alice)
+	assert.Equal(t, StreamsQuota, quotaLimit(err))
+
+	// The burst is spent, the next token comes in a second
+	for i := 0; i < 3; i++ {
+		releaseStream, err = quotas.AcquireStream(bob)
+		assert.NoError(t, err)
+		releaseStream()
+	}
+	_, err = quotas.AcquireStream(bob)
+	assert.Equal(t, RateQuota, quotaLimit(err))
+	var quotaErr *QuotaExceededError
+	if assert.ErrorAs(t, err, &quotaErr) {
+		assert.InDelta(t, time.Second, quotaErr.RetryAfter, float64(100*time.Millisecond))
+		assert.Contains(t, err.Error(), "rate quota exceeded for bob")
+	}
+	// Sessions take a token too
+	carol := testSubject{name: "carol"}
+	for i := 0; i < 5; i++ {
+		release, err = quotas.AcquireSession(carol)
+		assert.NoError(t, err)
+		release()
+	}
+	_, err = quotas.AcquireSession(carol)
+	assert.Equal(t, RateQuota, quotaLimit(err))
+
+	// Role limits replace the default ones, zero is unlimited
+	for i := 0; i < 2; i++ {
+		_, err = quotas.AcquireSession(ci)
+		assert.NoError(t, err)
+	}
+	_, err = quotas.AcquireSession(ci)
+	assert.Equal(t, SessionsQuota, quotaLimit(err))
+	for i := 0; i < 10; i++ {
+		_, err = quotas.AcquireStream(ci)
+		assert.NoError(t, err)
+	}
+
+	// No limits
+	unlimited := NewQuotas(config.QuotaConfig{})
+	assert.Nil(t, unlimited)
+	release, err = unlimited.AcquireStream(alice)
+	assert.NoError(t, err)
+	release()
+}
+
+func TestDnsForwardQuota(t *testing.T) {
+	resolver, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resolver.Close()
+	go func() {
+		for {
+			conn, err := resolver.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderForwardStatus, "1")
+	quotas := NewQuotas(config.QuotaConfig{QuotaLimits: config.QuotaLimits{Streams: 1}})
+	session := NewTunnelSession(req, testAuthenticator{}, testSubject{name: "alice"}, 0, quotas)
+	serverConn, clientConn := net.Pipe()
+	muxer, err := NewYamuxMuxer()
+	assert.NoError(t, err)
+	go muxer.ExecuteServerRouter(NewRouter(auth.NoopAuthorizer(), resolver.Addr().String(), nil), serverConn, session)
+	client, err := yamux.Client(clientConn, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	dialDns := func() (net.Conn, error) {
+		conn, err := client.Open()
+		if err != nil {
+			return nil, err
+		}
+		conn.Write(NewDnsFrame())
+		return conn, ReadForwardStatus(conn)
+	}
+
+	// DNS forwards hold a resolver connection, they count against the streams quota
+	conn, err := dialDns()
+	assert.NoError(t, err)
+	_, err = dialDns()
+	var forwardErr *ForwardError
+	if assert.ErrorAs(t, err, &forwardErr) {
+		assert.Equal(t, ForwardQuotaExceeded, forwardErr.Status)
+	}
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		conn, err := dialDns()
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+}
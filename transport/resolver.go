@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// SystemNameserver returns the first nameserver configured on the host as host:port
+func SystemNameserver() (string, error) {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// Strip IPv6 zone, the resolver must be reachable without it
+		host := strings.SplitN(fields[1], "%", 2)[0]
+		if net.ParseIP(host) == nil {
+			continue
+		}
+		return net.JoinHostPort(host, "53"), nil
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no nameserver found in %s", resolvConfPath)
+}
@@ -1,36 +1,258 @@
 package transport
 
 import (
+	"crypto/rand"
+	"edgeproxy/audit"
+	"edgeproxy/config"
 	"edgeproxy/metrics"
 	"edgeproxy/server/auth"
 	"edgeproxy/stream"
+	"encoding/hex"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// dnsIdleTimeout closes the DNS forwards the resolver sent nothing on for a while
+const dnsIdleTimeout = 30 * time.Second
+
 type Router struct {
-	authorizer auth.Authorize
+	authorizer   auth.Authorize
+	dnsResolver  string
+	destinations *DestinationPolicy
 }
 
-func NewRouter(authorizer auth.Authorize) *Router {
+// NewRouter routes the tunnel streams, forwards only reach the addresses allowed by destinations,
+// or outside the always denied networks if nil.
+func NewRouter(authorizer auth.Authorize, dnsResolver string, destinations *DestinationPolicy) *Router {
+	if destinations == nil {
+		destinations, _ = NewDestinationPolicy(config.ForwardConfig{})
+	}
 	return &Router{
-		authorizer: authorizer,
+		authorizer:   authorizer,
+		dnsResolver:  dnsResolver,
+		destinations: destinations,
+	}
+}
+
+// deniedError is a forward refused by the policies, the client is told it was denied
+type deniedError string
+
+func (e deniedError) Error() string {
+	return string(e)
+}
+
+func denied(format string, args ...interface{}) error {
+	return deniedError(fmt.Sprintf(format, args...))
+}
+
+// ConnectionForward pipes the stream to the forward destination, established is called once it's connected.
+// The decision and the end of the connection are audited.
+func (r *Router) ConnectionForward(sourceConn io.ReadWriteCloser, forward auth.ForwardAction, established func()) error {
+	forwardId := newForwardId()
+	decision := auth.Decide(r.authorizer, forward)
+	if !decision.Allowed {
+		err := denied("denied %s access to %s/%s", forward.Subject, forward.NetType, forward.DestinationAddr)
+		auditDecision(forwardId, forward, decision, nil, err)
+		return err
+	}
+	dialForwards, resolved, err := r.vetDestination(forward)
+	if err != nil {
+		decision.Allowed = false
+		auditDecision(forwardId, forward, decision, resolved, err)
+		return err
+	}
+	auditDecision(forwardId, forward, decision, resolved, nil)
+	metrics.IncrementRouterForwardAcceptedConnections()
+	// the vetted address is dialed, so the name can't resolve to another one meanwhile
+	var dstConn net.Conn
+	var dialForward auth.ForwardAction
+	for _, dialForward = range dialForwards {
+		if dstConn, err = net.Dial(forward.NetType, dialForward.DestinationAddr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can not connect to %s: %v", forward.DestinationAddr, err)
+	}
+	defer dstConn.Close()
+	established()
+	// the forward is closed if a policy reload denies it
+	var revoked int32
+	if tracker, ok := r.authorizer.(auth.ForwardTracker); ok {
+		closeForward := func() {
+			atomic.StoreInt32(&revoked, 1)
+			sourceConn.Close()
+			dstConn.Close()
+		}
+		defer tracker.TrackForward(forward, closeForward)()
+		if dialForward.DestinationAddr != forward.DestinationAddr {
+			defer tracker.TrackForward(dialForward, closeForward)()
+		}
+	}
+
+	start := time.Now()
+	bidirectionalStream := stream.NewBidirectionalStream(sourceConn, dstConn, "tunnel", "destination")
+	received, sent := bidirectionalStream.Stream()
+	reason := bidirectionalStream.CloseReason()
+	if atomic.LoadInt32(&revoked) == 1 {
+		reason = "revoked"
 	}
+	auditClosed(forwardId, forward, dialForward.DestinationAddr, reason, sent, received, start)
+	return nil
 }
 
-func (r *Router) ConnectionForward(sourceConn io.ReadWriteCloser, forward auth.ForwardAction) error {
-	if policyRes := r.authorizer.AuthorizeForward(forward); policyRes {
-		metrics.IncrementRouterForwardAcceptedConnections()
-		dstConn, err := net.Dial(forward.NetType, forward.DestinationAddr)
+// vetDestination returns the forwards to the addresses that can be dialed for the destination, and the addresses
+// a host name resolved to. Host names are resolved on the server, each address must be allowed by the destination
+// policy and the IP policy. The resolved addresses are left out of the errors, which are sent to the client.
+func (r *Router) vetDestination(forward auth.ForwardAction) ([]auth.ForwardAction, []string, error) {
+	host, port, err := net.SplitHostPort(forward.DestinationAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid destination %s: %v", forward.DestinationAddr, err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !r.destinations.Allowed(ip) {
+			metrics.IncrementRouterForwardBlockedDestinations()
+			return nil, nil, denied("denied %s access to %s/%s, destination network not allowed", forward.Subject, forward.NetType, forward.DestinationAddr)
+		}
+		return []auth.ForwardAction{forward}, nil, nil
+	}
+
+	ips, err := r.destinations.Resolve(host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not resolve %s: %v", host, err)
+	}
+	var dialForwards []auth.ForwardAction
+	var resolved []string
+	for _, ip := range ips {
+		resolved = append(resolved, ip.String())
+		ipForward := forward
+		ipForward.DestinationAddr = net.JoinHostPort(ip.String(), port)
+		if !r.destinations.Allowed(ip) {
+			metrics.IncrementRouterForwardBlockedDestinations()
+			log.Warnf("%s resolved to %s for %s, destination network not allowed", host, ip, forward.Subject)
+			continue
+		}
+		if !auth.AuthorizeResolved(r.authorizer, ipForward) {
+			log.Debugf("%s resolved to %s for %s, denied by the IP policy", host, ip, forward.Subject)
+			continue
+		}
+		dialForwards = append(dialForwards, ipForward)
+	}
+	if len(dialForwards) == 0 {
+		log.Infof("denied %s access to %s/%s, no allowed address in %v", forward.Subject, forward.NetType, forward.DestinationAddr, resolved)
+		return nil, resolved, denied("denied %s access to %s/%s, no allowed address", forward.Subject, forward.NetType, forward.DestinationAddr)
+	}
+	return dialForwards, resolved, nil
+}
+
+// DnsForward pipes a DNS over TCP stream to the resolver selected by the server, if the policies allow the
+// subject to reach it. newForward builds the forward of the tunnel session to the resolver, established is called
+// once it's connected.
+func (r *Router) DnsForward(sourceConn io.ReadWriteCloser, newForward func(destinationAddr, netType string) auth.ForwardAction, established func()) error {
+	resolver := r.dnsResolver
+	if resolver == "" {
+		var err error
+		resolver, err = SystemNameserver()
 		if err != nil {
-			return fmt.Errorf("can not connect to %s: %v", forward.DestinationAddr, err)
+			return fmt.Errorf("no DNS resolver available: %v", err)
 		}
-		defer dstConn.Close()
+	}
+	forward := newForward(resolver, "tcp")
+	forwardId := newForwardId()
+	decision := auth.Decide(r.authorizer, forward)
+	if !decision.Allowed {
+		err := denied("denied %s access to DNS resolver %s", forward.Subject, resolver)
+		auditDecision(forwardId, forward, decision, nil, err)
+		return err
+	}
+	auditDecision(forwardId, forward, decision, nil, nil)
+	log.Debugf("Forwarding DNS queries from %s to %s", forward.Subject, resolver)
+	metrics.IncrementRouterDnsForwardConnections()
+	dstConn, err := net.Dial("tcp", resolver)
+	if err != nil {
+		return fmt.Errorf("can not connect to DNS resolver %s: %v", resolver, err)
+	}
+	defer dstConn.Close()
+	established()
 
-		stream.NewBidirectionalStream(sourceConn, dstConn, "tunnel", "destination").Stream()
-		return nil
-	} else {
-		return fmt.Errorf("denied %s access to %s/%s", forward.Subject, forward.NetType, forward.DestinationAddr)
+	start := time.Now()
+	bidirectionalStream := stream.NewBidirectionalStream(sourceConn, idleConn{Conn: dstConn, timeout: dnsIdleTimeout}, "tunnel", "resolver")
+	received, sent := bidirectionalStream.Stream()
+	auditClosed(forwardId, forward, resolver, bidirectionalStream.CloseReason(), sent, received, start)
+	return nil
+}
+
+// idleConn fails reads after timeout without data, closing idle streams
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// newForwardId identifies a forward on its audit events
+func newForwardId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// auditClosed records the end of a forward, address is the one dialed for its destination
+func auditClosed(forwardId string, forward auth.ForwardAction, address string, reason string, sent, received int64, start time.Time) {
+	audit.Log(audit.Event{
+		Type:       audit.ConnectionClosedEvent,
+		Subject:    forward.Subject,
+		RemoteAddr: forward.Client["remoteIp"],
+		Reason:     reason,
+		Fields: map[string]interface{}{
+			"forward":       forwardId,
+			"destination":   forward.DestinationAddr,
+			"address":       address,
+			"network":       forward.NetType,
+			"bytesSent":     sent,
+			"bytesReceived": received,
+			"duration":      time.Since(start).Seconds(),
+		},
+	})
+}
+
+// auditDecision records if a forward was allowed, with the rules that matched and the addresses its host name
+// resolved to, err is why it was not
+func auditDecision(forwardId string, forward auth.ForwardAction, decision auth.PolicyDecision, resolved []string, err error) {
+	matches := make([]string, 0, len(decision.Matches))
+	for _, match := range decision.Matches {
+		matches = append(matches, match.Principal+": "+strings.Join(match.Rule, ", "))
+	}
+	event := audit.Event{
+		Type:       audit.ForwardDecisionEvent,
+		Subject:    forward.Subject,
+		RemoteAddr: forward.Client["remoteIp"],
+		Fields: map[string]interface{}{
+			"forward":     forwardId,
+			"destination": forward.DestinationAddr,
+			"network":     forward.NetType,
+			"decision":    "allow",
+			"policy":      decision.Policy,
+			"matches":     matches,
+			"tunnel":      forward.Client["tunnel"],
+		},
+	}
+	if !decision.Allowed {
+		event.Fields["decision"] = "deny"
+	}
+	if len(resolved) > 0 {
+		event.Fields["resolved"] = resolved
+	}
+	if err != nil {
+		event.Reason = err.Error()
 	}
+	audit.Log(event)
 }
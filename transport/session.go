@@ -0,0 +1,210 @@
+package transport
+
+import (
+	"context"
+	"edgeproxy/audit"
+	"edgeproxy/metrics"
+	"edgeproxy/server/auth"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TunnelSession is the authenticated identity of a server tunnel. The tunnel is closed when the credentials expire
+// or are revoked, unless the client re-authenticates in-band before with fresh ones.
+type TunnelSession struct {
+	request            *http.Request
+	authenticate       auth.Authenticate
+	revalidateInterval time.Duration
+	quotas             *Quotas
+	// forwardStatus is set when the client reads a status before each forwarded stream
+	forwardStatus   bool
+	mu              sync.RWMutex
+	subject         auth.Subject
+	generation      int
+	reauthenticated chan struct{}
+}
+
+// NewTunnelSession tracks the credentials of the subject authenticated on the tunnel request,
+// revocations are checked every revalidateInterval, zero disables it. Forwarded streams are limited by quotas.
+func NewTunnelSession(r *http.Request, authenticate auth.Authenticate, subject auth.Subject, revalidateInterval time.Duration, quotas *Quotas) *TunnelSession {
+	return &TunnelSession{
+		request:            r,
+		authenticate:       authenticate,
+		revalidateInterval: revalidateInterval,
+		quotas:             quotas,
+		forwardStatus:      r.Header.Get(HeaderForwardStatus) != "",
+		subject:            subject,
+		reauthenticated:    make(chan struct{}, 1),
+	}
+}
+
+// Subject is the last authenticated subject, streams opened after a re-authentication get its new attributes
+func (s *TunnelSession) Subject() auth.Subject {
+	subject, _ := s.current()
+	return subject
+}
+
+// ForwardAction is a forward of the current subject, with the metadata of the tunnel client
+func (s *TunnelSession) ForwardAction(destinationAddr, netType string) auth.ForwardAction {
+	forwardAction := auth.NewForwardAction(s.Subject(), destinationAddr, netType)
+	remoteIp, _, err := net.SplitHostPort(s.request.RemoteAddr)
+	if err != nil {
+		remoteIp = s.request.RemoteAddr
+	}
+	forwardAction.Client = map[string]string{
+		"remoteIp":  remoteIp,
+		"userAgent": s.request.UserAgent(),
+		"tunnel":    s.request.URL.Path,
+	}
+	return forwardAction
+}
+
+// AcquireStream counts a forwarded stream on the subject quotas, release must be called when it's closed
+func (s *TunnelSession) AcquireStream() (release func(), err error) {
+	return s.quotas.AcquireStream(s.Subject())
+}
+
+// writeForwardStatus tells the client if the forward was established, when the client reads it
+func (s *TunnelSession) writeForwardStatus(w io.Writer, err error) {
+	if !s.forwardStatus {
+		return
+	}
+	if err := writeForwardStatus(w, err); err != nil {
+		log.Debugf("can not write forward status: %v", err)
+	}
+}
+
+// current returns the subject and how many times it was re-authenticated
+func (s *TunnelSession) current() (auth.Subject, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.subject, s.generation
+}
+
+// Reauthenticate validates the credential headers sent in-band, they must authenticate the same subject
+func (s *TunnelSession) Reauthenticate(headers http.Header) error {
+	current := s.Subject()
+	r := s.request.Clone(s.request.Context())
+	r.Header = headers
+	ok, subject := s.authenticate.Authenticate(discardResponseWriter{}, r)
+	if !ok {
+		return s.rejectReauthentication(current, "invalid_credentials", errors.New("invalid credentials"))
+	}
+	if subject.GetSubject() != current.GetSubject() {
+		return s.rejectReauthentication(current, "subject_mismatch", fmt.Errorf("credentials of %s", subject.GetSubject()))
+	}
+
+	s.mu.Lock()
+	s.subject = subject
+	s.generation++
+	s.mu.Unlock()
+	select {
+	case s.reauthenticated <- struct{}{}:
+	default:
+	}
+	metrics.IncrementTunnelReauthentications("success")
+	audit.Log(audit.Event{
+		Type:       audit.SessionReauthenticatedEvent,
+		Subject:    subject.GetSubject(),
+		RemoteAddr: s.request.RemoteAddr,
+		Fields:     map[string]interface{}{"expiry": auth.SubjectCredentialExpiry(subject)},
+	})
+	return nil
+}
+
+func (s *TunnelSession) rejectReauthentication(subject auth.Subject, reason string, err error) error {
+	metrics.IncrementTunnelReauthentications("failure")
+	audit.Log(audit.Event{
+		Type:       audit.SessionReauthenticatedEvent,
+		Subject:    subject.GetSubject(),
+		RemoteAddr: s.request.RemoteAddr,
+		Reason:     reason,
+	})
+	return err
+}
+
+// Supervise blocks until the credentials expire or are revoked, returning why, or until ctx is done
+func (s *TunnelSession) Supervise(ctx context.Context) error {
+	var revalidate <-chan time.Time
+	if s.revalidateInterval > 0 {
+		ticker := time.NewTicker(s.revalidateInterval)
+		defer ticker.Stop()
+		revalidate = ticker.C
+	}
+	for {
+		if err := s.wait(ctx, revalidate); err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// wait returns when the current credentials are re-authenticated, expire, fail a revalidation or ctx is done
+func (s *TunnelSession) wait(ctx context.Context, revalidate <-chan time.Time) error {
+	subject, generation := s.current()
+	var expired <-chan time.Time
+	expiry := auth.SubjectCredentialExpiry(subject)
+	if !expiry.IsZero() {
+		timer := time.NewTimer(time.Until(expiry))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ctx.Done():
+	case <-s.reauthenticated:
+	case <-expired:
+		// a re-authentication may have raced with the timer
+		if _, current := s.current(); current == generation {
+			return s.terminate(subject, "expired", fmt.Errorf("credentials expired at %s", expiry))
+		}
+	case <-revalidate:
+		if revalidating, ok := subject.(auth.RevalidatingSubject); ok {
+			if err := revalidating.Revalidate(); err != nil {
+				return s.terminate(subject, "revoked", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TunnelSession) terminate(subject auth.Subject, reason string, err error) error {
+	log.Infof("Closing tunnel of %s: %v", subject.GetSubject(), err)
+	metrics.IncrementTunnelSessionsTerminated(reason)
+	audit.Log(audit.Event{
+		Type:       audit.SessionTerminatedEvent,
+		Subject:    subject.GetSubject(),
+		RemoteAddr: s.request.RemoteAddr,
+		Reason:     reason,
+		Fields:     map[string]interface{}{"error": err.Error()},
+	})
+	return err
+}
+
+// supervise closes the tunnel when the session credentials are no longer valid, until the returned stop is called
+func (s *TunnelSession) supervise(closeTunnel func() error) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := s.Supervise(ctx); err != nil {
+			closeTunnel()
+		}
+	}()
+	return cancel
+}
+
+// discardResponseWriter lets authenticators run on the in-band re-authentication, where no HTTP response is sent
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardResponseWriter) WriteHeader(int) {}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"context"
+	"edgeproxy/server/auth"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSubject struct {
+	name    string
+	expiry  time.Time
+	revoked *int32
+}
+
+func (s testSubject) GetSubject() string {
+	return s.name
+}
+
+func (s testSubject) CredentialExpiry() time.Time {
+	return s.expiry
+}
+
+func (s testSubject) Revalidate() error {
+	if s.revoked != nil && atomic.LoadInt32(s.revoked) == 1 {
+		return errors.New("revoked")
+	}
+	return nil
+}
+
+// testAuthenticator authenticates the X-Test-Subject header, with credentials valid for X-Test-Lifetime
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (bool, auth.Subject) {
+	name := r.Header.Get("X-Test-Subject")
+	lifetime, err := time.ParseDuration(r.Header.Get("X-Test-Lifetime"))
+	if name == "" || err != nil {
+		return false, nil
+	}
+	return true, testSubject{name: name, expiry: time.Now().Add(lifetime)}
+}
+
+func testCredentials(subject string, lifetime time.Duration) http.Header {
+	headers := http.Header{}
+	headers.Set("X-Test-Subject", subject)
+	headers.Set("X-Test-Lifetime", lifetime.String())
+	return headers
+}
+
+func newTestSession(subject auth.Subject, revalidateInterval time.Duration) *TunnelSession {
+	return NewTunnelSession(httptest.NewRequest(http.MethodGet, "/", nil), testAuthenticator{}, subject, revalidateInterval, nil)
+}
+
+func TestTunnelSessionExpiry(t *testing.T) {
+	session := newTestSession(testSubject{name: "alice", expiry: time.Now().Add(100 * time.Millisecond)}, 0)
+	done := make(chan error, 1)
+	go func() { done <- session.Supervise(context.Background()) }()
+
+	// Fresh credentials postpone the expiry, another subject is refused
+	assert.Error(t, session.Reauthenticate(testCredentials("bob", time.Hour)))
+	assert.Error(t, session.Reauthenticate(http.Header{}))
+	assert.NoError(t, session.Reauthenticate(testCredentials("alice", 300*time.Millisecond)))
+	select {
+	case <-done:
+		t.Fatal("session closed before the refreshed credentials expired")
+	case <-time.After(200 * time.Millisecond):
+	}
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("session not closed when credentials expired")
+	}
+
+	// Supervision stops with the tunnel
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, newTestSession(testSubject{name: "alice", expiry: time.Now().Add(time.Hour)}, 0).Supervise(ctx))
+}
+
+func TestTunnelSessionRevoked(t *testing.T) {
+	revoked := int32(0)
+	session := newTestSession(testSubject{name: "alice", revoked: &revoked}, 20*time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- session.Supervise(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&revoked, 1)
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("session not closed when credentials were revoked")
+	}
+}
+
+func TestYamuxReauthentication(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	muxer, err := NewYamuxMuxer()
+	assert.NoError(t, err)
+	session := newTestSession(testSubject{name: "alice", expiry: time.Now().Add(200 * time.Millisecond)}, 0)
+	done := make(chan error, 1)
+	go func() { done <- muxer.ExecuteServerRouter(NewRouter(nil, "", nil), serverConn, session) }()
+
+	client, err := yamux.Client(clientConn, nil)
+	assert.NoError(t, err)
+	reauthenticate := func(headers http.Header) error {
+		conn, err := client.Open()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		frame, reauth := NewReauthenticateFrame(headers)
+		conn.Write(append(frame, reauth...))
+		return ReadReauthenticateStatus(conn)
+	}
+	assert.Error(t, reauthenticate(testCredentials("bob", time.Hour)))
+	assert.NoError(t, reauthenticate(testCredentials("alice", 400*time.Millisecond)))
+	assert.Equal(t, "alice", session.Subject().GetSubject())
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel not closed when credentials expired")
+	}
+	_, err = client.Ping()
+	assert.Error(t, err)
+}